@@ -19,11 +19,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/soheilhy/cmux"
 )
 
@@ -35,8 +37,10 @@ import (
 
 // App is a struct representing the externally-accessible state of the data store
 type App struct {
-	db   dbAccess
-	view viewList
+	db     dbAccess
+	view   viewList
+	gossip *GossipVals // Used to hand off data when the node is decommissioned
+	stop   func()      // Shuts the node down once it has been decommissioned
 }
 
 // Initialize takes a Listener, assigns a Router to it, and then attaches HTTP handler
@@ -52,20 +56,47 @@ func (app *App) Initialize(l net.Listener) {
 	s := r.PathPrefix(rootURL).Subrouter()
 
 	// This is the search handler, which has a different prefix
-	s.HandleFunc(search+keySuffix, app.SearchHandler).Methods(http.MethodGet)
+	s.HandleFunc(search+keySuffix, app.routed(app.SearchHandler)).Methods(http.MethodGet)
+
+	// Range and prefix scans hang off the root itself
+	r.HandleFunc(rootURL, app.RangeHandler).Methods(http.MethodGet)
 
 	// These handlers implement the /view endpoint and handle GET, PUT, DELETE
 	r.HandleFunc(view, app.ViewPutHandler).Methods(http.MethodPut)
 	r.HandleFunc(view, app.ViewGetHandler).Methods(http.MethodGet)
 	r.HandleFunc(view, app.ViewDeleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc(view+statusSuffix, app.ViewStatusHandler).Methods(http.MethodGet)
+
+	// Admin endpoints for operating the node
+	r.HandleFunc(admin+snapshotSuffix, app.SnapshotHandler).Methods(http.MethodPut)
+	r.HandleFunc(node+decommissionSuffix, app.DecommissionHandler).Methods(http.MethodPut)
+	r.HandleFunc(node+rebalanceSuffix, app.RebalanceHandler).Methods(http.MethodGet)
+
+	// These handlers implement the /shard endpoints
+	r.HandleFunc(shard+myIDSuffix, app.ShardIDHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+allIDsSuffix, app.ShardAllHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+membersSuffix, app.ShardMembersHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+countSuffix, app.ShardCountHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+changeShardSuffix, app.ShardChangeHandler).Methods(http.MethodPut)
+
+	// Batches are posted to their own endpoint, which has to be matched before {subject}
+	s.HandleFunc(batchSuffix, app.routedBatch(app.BatchHandler)).Methods(http.MethodPost)
+
+	// The history of a key hangs off the key itself
+	s.HandleFunc(keySuffix+historySuffix, app.routed(app.HistoryHandler)).Methods(http.MethodGet)
+
+	// So do the operations on typed keys
+	s.HandleFunc(keySuffix+counterSuffix, app.routed(app.CounterHandler)).Methods(http.MethodPost)
+	s.HandleFunc(keySuffix+setSuffix, app.routed(app.SetHandler)).Methods(http.MethodPost)
+	s.HandleFunc(keySuffix+registerSuffix, app.routed(app.RegisterHandler)).Methods(http.MethodPost)
 
 	// These handlers implement the KVS API and handle GET, PUT, DELETE
-	s.HandleFunc(keySuffix, app.PutHandler).Methods(http.MethodPut)
-	s.HandleFunc(keySuffix, app.GetHandler).Methods(http.MethodGet)
-	s.HandleFunc(keySuffix, app.DeleteHandler).Methods(http.MethodDelete)
+	s.HandleFunc(keySuffix, app.routed(app.PutHandler)).Methods(http.MethodPut)
+	s.HandleFunc(keySuffix, app.routed(app.GetHandler)).Methods(http.MethodGet)
+	s.HandleFunc(keySuffix, app.routed(app.DeleteHandler)).Methods(http.MethodDelete)
 
 	// LoggingHandler allows us to log all router activity to our predefined log
-	Logger := handlers.LoggingHandler(MultiLogOutput, r)
+	Logger := handlers.LoggingHandler(MultiLogOutput, whenReady(whenWritable(r)))
 
 	// We define a server here and attach the log-enabled router to it
 	v := &http.Server{
@@ -149,6 +180,24 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		key := vars["subject"]
 
+		// A TTL can come in either the form or a header. It's turned into an absolute
+		// expiry right here so that every replica agrees on when the key goes away.
+		var expires time.Time
+		var ttlErr error
+		ttl := r.Header.Get(ttlHeader)
+		if r.Form[ttlField] != nil {
+			ttl = r.Form[ttlField][0]
+		}
+		if ttl != "" {
+			var d time.Duration
+			if d, ttlErr = parseTTL(ttl); ttlErr == nil {
+				expires = time.Now().Add(d)
+			}
+		}
+
+		// A write is conditional if the client sends the version or clock it expects
+		cond, condErr := parseCondition(r.Header.Get(ifMatchHeader), r.Header.Get(ifMatchClockHeader))
+
 		// Check for valid input
 		if len(value) > maxVal {
 			// The value is > 1MB so error out
@@ -188,48 +237,139 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
 			}
+		} else if ttlErr != nil {
+			// The TTL couldn't be parsed or wasn't positive
+			log.Println("ERROR: Invalid TTL: ", ttlErr)
+
+			// Set the status code
+			status = http.StatusBadRequest // code 400
+
+			resp := map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Invalid TTL: " + ttlErr.Error(),
+				"payload": payloadInt,
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+		} else if condErr != nil {
+			// The condition headers couldn't be parsed
+			log.Println("ERROR: Invalid condition: ", condErr)
+
+			// Set the status code
+			status = http.StatusBadRequest // code 400
+			resp := map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Invalid condition: " + condErr.Error(),
+				"payload": payloadInt,
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+		} else if cond != nil {
+			// A conditional write. The check and the write happen in the db under one
+			// lock so nothing can sneak in between them on this replica.
+			log.Println("Conditional write, checking the key first")
+			timestamp := hlc.Now()
+
+			// The client's payload is the causal context the write is stored with
+			newPayload := copyClock(payloadInt)
+
+			applied, curVersion, curClock, putErr := app.db.CompareAndPut(key, value, timestamp, newPayload, expires, *cond)
+			var resp map[string]interface{}
+			if putErr != nil {
+				// The write isn't durable, so it can't be acknowledged
+				log.Println("ERROR: Write failed: ", putErr)
+				status = http.StatusInternalServerError // code 500
+				resp = map[string]interface{}{
+					"result":  "Error",
+					"msg":     "Write failed",
+					"payload": payloadInt,
+				}
+			} else if !applied {
+				// Hand back what the key actually looks like so the client can retry
+				log.Println("Condition failed, key is at version ", curVersion)
+				status = http.StatusPreconditionFailed // code 412
+				resp = map[string]interface{}{
+					"result":      "Error",
+					"msg":         "Precondition failed",
+					"version":     curVersion,
+					"clock":       curClock,
+					"consistency": casConsistency,
+					"payload":     payloadInt,
+				}
+			} else {
+				replaced := curVersion > 0
+				status = http.StatusOK // code 200
+				msg := "Added successfully"
+				if replaced {
+					status = http.StatusCreated // code 201
+					msg = "Updated successfully"
+				}
+				resp = map[string]interface{}{
+					"replaced":    replaced,
+					"msg":         msg,
+					"version":     curVersion + 1,
+					"consistency": casConsistency,
+					"payload":     app.writtenPayload(key, payloadInt),
+				}
+				if !expires.IsZero() {
+					resp["expires"] = expires.Format(time.RFC3339Nano)
+				}
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
 		} else {
 			// key/val are valid inputs, let's insert into the db
 			log.Println("Key and value lengths ok")
 
 			// Check to see if the db already contains the key. The type of response
-			// the client receives here depends on their causul history. If there is
-			// a constraint such that they shouldn't be shown our version of the key,
-			// that's the same as if the key doesn't exist.
+			// the client receives here depends on their causul history. If we haven't
+			// seen everything the client has, we can't show them our version of the key,
+			// and that's the same as if the key doesn't exist.
 			alive, version := app.db.Contains(key)
 			log.Println("Alive: ", alive)
 			log.Println("Version: ", version)
 
 			// The key hasn't been deleted, and it's recent enough to show to the,
 			// client so we can give them the 'overwrite' response.
-			if alive && payloadInt[key] <= version {
+			if alive && dots.Covers(payloadInt, app.owners(key)) {
 				log.Println("Key already exists in DB, overwriting...")
 
 				// Set the timestamp for the new version of the key.
-				time := time.Now()
+				timestamp := hlc.Now()
 
-				// Create the payload to be inserted into the db, starting with this key
-				newPayload := map[string]int{key: version + 1}
-
-				// Add each of the client's payload elements
-				for k, v := range payloadInt {
-					if k != key {
-						newPayload[k] = v
-					}
-				}
+				// The client's payload is the causal context the write is stored with
+				newPayload := copyClock(payloadInt)
 
 				// Put it in the db
-				app.db.Put(key, value, time, newPayload)
+				_, putErr := app.db.PutWithExpiry(key, value, timestamp, newPayload, expires)
 
 				// Set status
 				status = http.StatusCreated // code 201
 
-				// Build the response body, including the payload. It's got the adjustment
-				// above, which isn't really strictly to spec, but it should be ok.
+				// Build the response body, including the payload with the new write in it
 				resp := map[string]interface{}{
 					"replaced": true,
 					"msg":      "Updated successfully",
-					"payload":  payloadInt,
+					"payload":  app.writtenPayload(key, payloadInt),
+				}
+				if !expires.IsZero() {
+					resp["expires"] = expires.Format(time.RFC3339Nano)
+				}
+				if putErr != nil {
+					// The write isn't durable, so it can't be acknowledged
+					log.Println("ERROR: Write failed: ", putErr)
+					status = http.StatusInternalServerError // code 500
+					resp = map[string]interface{}{
+						"result":  "Error",
+						"msg":     "Write failed",
+						"payload": payloadInt,
+					}
 				}
 				body, err = json.Marshal(resp)
 				if err != nil {
@@ -240,26 +380,32 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 				// In either case, from the client's perspective, it doesn't exist.
 				log.Println("Key does not exist in DB, inserting...")
 				status = http.StatusOK // code 200
-				time := time.Now()
-
-				// Create the payload to be inserted into the db, starting with this key
-				newPayload := map[string]int{key: version + 1}
+				timestamp := hlc.Now()
 
-				// Add each of the client's payload elements
-				for k, v := range payloadInt {
-					if k != key {
-						newPayload[k] = v
-					}
-				}
+				// The client's payload is the causal context the write is stored with
+				newPayload := copyClock(payloadInt)
 
 				// Put it in the db
-				app.db.Put(key, value, time, newPayload)
+				_, putErr := app.db.PutWithExpiry(key, value, timestamp, newPayload, expires)
 
 				// And a slightly different response body
 				resp := map[string]interface{}{
 					"replaced": false,
 					"msg":      "Added successfully",
-					"payload":  payloadInt,
+					"payload":  app.writtenPayload(key, payloadInt),
+				}
+				if !expires.IsZero() {
+					resp["expires"] = expires.Format(time.RFC3339Nano)
+				}
+				if putErr != nil {
+					// The write isn't durable, so it can't be acknowledged
+					log.Println("ERROR: Write failed: ", putErr)
+					status = http.StatusInternalServerError // code 500
+					resp = map[string]interface{}{
+						"result":  "Error",
+						"msg":     "Write failed",
+						"payload": payloadInt,
+					}
 				}
 				body, err = json.Marshal(resp)
 				if err != nil {
@@ -347,16 +493,20 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 	// Same content type for everything
 	w.Header().Set("Content-Type", "application/json")
 
+	// A request for a particular version is answered out of the key's history
+	if v := r.URL.Query().Get("version"); v != "" {
+		app.writeVersion(w, key, v, payloadInt)
+		return
+	}
+
 	// Here we'll check to see if the requested key exists and get its version.
 	alive, version := app.db.Contains(key)
 	log.Println("Alive: ", alive)
 	log.Println("Version: ", version)
-	log.Println("Client version: ", payloadInt[key])
 
-	// If the version of the key stored in the DB is older than the value in the client's payload,
-	// then it would violate causality to show the key to the client. In this case we return an error
-	// message per the spec.
-	if version < payloadInt[key] {
+	// If the client's payload holds writes we haven't seen yet, then it would violate causality
+	// to show the key to the client. In this case we return an error message per the spec.
+	if !dots.Covers(payloadInt, app.owners(key)) {
 		w.WriteHeader(http.StatusBadRequest) // Code 400
 
 		log.Println("Key requested is out of date")
@@ -387,6 +537,26 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 			"value":   val,
 			"payload": payload,
 		}
+
+		// A typed key also gets its value back in its own shape
+		if c := app.db.GetCRDT(key); c != nil {
+			resp["type"] = c.Type
+			resp["crdt"] = c.render()
+		}
+
+		// A key in sibling mode can have more than one value, the client gets all of them
+		// and resolves them by writing back with the payload above
+		if sibs := app.db.GetSiblings(key); len(sibs) > 0 {
+			items := make([]map[string]interface{}, len(sibs))
+			for i, s := range sibs {
+				items[i] = map[string]interface{}{
+					"value":     s.Value,
+					"clock":     s.past(),
+					"timestamp": s.Timestamp,
+				}
+			}
+			resp["siblings"] = items
+		}
 		body, err = json.Marshal(resp)
 		if err != nil {
 			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
@@ -468,8 +638,8 @@ func (app *App) SearchHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("SEARCH with payload ", payloadInt)
 
 	// See if the key exists in the db
-	alive, version := app.db.Contains(key)
-	if version < payloadInt[key] {
+	alive, _ := app.db.Contains(key)
+	if !dots.Covers(payloadInt, app.owners(key)) {
 		log.Println("Payload out of date error")
 		w.WriteHeader(http.StatusBadRequest) // code 400
 
@@ -570,13 +740,12 @@ func (app *App) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		payloadInt[k] = int(v.(float64))
 	}
 
-	// Here we'll check to see if the requested key exists and get its version.
-	alive, version := app.db.Contains(key)
+	// Here we'll check to see if the requested key exists.
+	alive, _ := app.db.Contains(key)
 
-	// If the version of the key stored in the DB is older than the value in the client's payload,
-	// then it would violate causality to show the key to the client. In this case we return an error
-	// message per the spec.
-	if version < payloadInt[key] {
+	// If the client's payload holds writes we haven't seen yet, then it would violate causality
+	// to show the key to the client. In this case we return an error message per the spec.
+	if !dots.Covers(payloadInt, app.owners(key)) {
 		w.WriteHeader(http.StatusBadRequest) // Code 400
 
 		log.Println("Key requested is out of date")
@@ -594,17 +763,28 @@ func (app *App) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	} else if alive {
 		// The version is recent enough to show to the client, and the key has not been deleted, so we can
 		// return the values normally.
-		w.WriteHeader(http.StatusOK) // code 200
 
 		// Delete it
-		time := time.Now()
-		app.db.Delete(key, time, payloadInt)
+		time := hlc.Now()
+		_, delErr := app.db.Delete(key, time, copyClock(payloadInt))
 
 		// Successful response
 		resp := map[string]interface{}{
 			"result":  "Success",
 			"msg":     "Key deleted",
-			"payload": payloadInt,
+			"payload": app.writtenPayload(key, payloadInt),
+		}
+		if delErr != nil {
+			// The delete isn't durable, so it can't be acknowledged
+			log.Println("ERROR: Delete failed: ", delErr)
+			w.WriteHeader(http.StatusInternalServerError) // code 500
+			resp = map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Delete failed",
+				"payload": payloadInt,
+			}
+		} else {
+			w.WriteHeader(http.StatusOK) // code 200
 		}
 		body, err = json.Marshal(resp)
 		if err != nil {
@@ -713,7 +893,8 @@ func (app *App) ViewGetHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Package it into a map->JSON->[]byte
 	resp := map[string]interface{}{
-		"view": str,
+		"view":  str,
+		"epoch": app.view.Epoch(),
 	}
 	body, err = json.Marshal(resp)
 	if err != nil {
@@ -723,6 +904,34 @@ func (app *App) ViewGetHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// ViewStatusHandler returns what the failure detectors think of each member of the view
+func (app *App) ViewStatusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /view/status GET request")
+
+	status := make(map[string]interface{})
+	for _, m := range app.view.List() {
+		s := members.Get(m)
+		status[m] = map[string]interface{}{
+			"status":      s.Status.String(),
+			"incarnation": s.Incarnation,
+			"phi":         heartbeats.Phi(m),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) // code 200
+	resp := map[string]interface{}{
+		"view":    app.view.String(),
+		"members": status,
+		"skewed":  hlc.Skewed(),
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
 // ViewDeleteHandler inititate a view change. All containers' system view should change.
 func (app *App) ViewDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Handling /view DELETE request")
@@ -780,3 +989,451 @@ func (app *App) ViewDeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(body)
 }
+
+// SnapshotHandler responds to PUT requests on /admin/snapshot by taking a snapshot of
+// the db right away and compacting the write-ahead log behind it.
+func (app *App) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /admin/snapshot PUT request")
+
+	var body []byte
+	var err error
+	var resp map[string]interface{}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = app.db.Snapshot(); err != nil {
+		log.Println("Error taking snapshot: ", err)
+		w.WriteHeader(http.StatusInternalServerError) // code 500
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    err.Error(),
+		}
+	} else {
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result": "Success",
+			"msg":    "Snapshot written",
+		}
+	}
+	body, err = json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// writtenPayload is the payload handed back to a client after a write to the key: their
+// own with the dot of the write added, so their next request has seen it
+func (app *App) writtenPayload(key string, payloadInt map[string]int) map[string]int {
+	payload := copyClock(payloadInt)
+	node, dot := app.db.GetNode(key), app.db.GetDot(key)
+	if payload[node] < dot {
+		payload[node] = dot
+	}
+	return payload
+}
+
+// readBodyPayload reads the causal payload out of a form-encoded request body. It
+// returns an empty map if there's no payload.
+func readBodyPayload(r *http.Request) (map[string]int, error) {
+	payloadInt := make(map[string]int)
+	if r.Body == nil {
+		return payloadInt, nil
+	}
+	s, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(s))
+	if err != nil {
+		return nil, err
+	}
+	return parsePayload(form.Get("payload"))
+}
+
+// parsePayload decodes a causal payload sent as a JSON string. It returns an empty map
+// if the string is empty.
+func parsePayload(payloadString string) (map[string]int, error) {
+	payloadInt := make(map[string]int)
+	if payloadString == "" {
+		return payloadInt, nil
+	}
+
+	// JSON numbers decode as float64 so go through an intermediate map
+	var payloadMap map[string]interface{}
+	if err := json.Unmarshal([]byte(payloadString), &payloadMap); err != nil {
+		return nil, err
+	}
+	for k, v := range payloadMap {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, errors.New("Payload value for " + k + " is not a number")
+		}
+		payloadInt[k] = int(f)
+	}
+	return payloadInt, nil
+}
+
+// RangeHandler responds to GET requests on /keyValue-store with the live keys that match
+// the prefix, start, end and cursor query parameters, in lexical order, a page at a time.
+// Like the other read paths it refuses to answer if the client's payload shows it has
+// seen writes that this replica hasn't.
+func (app *App) RangeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling RANGE request")
+
+	var body []byte
+	var err error
+	var resp map[string]interface{}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Read the bounds out of the query string
+	query := r.URL.Query()
+	q := rangeQuery{
+		Prefix: query.Get("prefix"),
+		Start:  query.Get("start"),
+		End:    query.Get("end"),
+		After:  query.Get("cursor"),
+		Limit:  rangeDefaultLimit,
+	}
+	var limitErr error
+	if l := query.Get("limit"); l != "" {
+		q.Limit, limitErr = strconv.Atoi(l)
+		if limitErr == nil && (q.Limit < 1 || q.Limit > rangeMaxLimit) {
+			limitErr = errors.New("limit must be between 1 and " + strconv.Itoa(rangeMaxLimit))
+		}
+	}
+
+	payloadInt, err := readBodyPayload(r)
+	if err != nil {
+		log.Println("ERROR: Invalid payload: ", err)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Invalid payload",
+			"payload": map[string]interface{}{},
+		}
+	} else if partitioned() {
+		// We only hold the keys we own, so a scan here would silently miss the rest
+		log.Println("ERROR: Range scan with partitioned keys")
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Range scans are not supported when keys are partitioned",
+			"payload": payloadInt,
+		}
+	} else if limitErr != nil {
+		log.Println("ERROR: Invalid limit: ", limitErr)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Invalid limit: " + limitErr.Error(),
+			"payload": payloadInt,
+		}
+	} else {
+		res := app.db.Range(q, payloadInt)
+		if res.Stale {
+			log.Println("Range requested is out of date")
+			w.WriteHeader(http.StatusBadRequest) // code 400
+			resp = map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Payload out of date",
+				"payload": payloadInt,
+			}
+		} else {
+			w.WriteHeader(http.StatusOK) // code 200
+			resp = map[string]interface{}{
+				"result":  "Success",
+				"keys":    res.Keys,
+				"next":    res.Next,
+				"payload": res.Clock,
+			}
+		}
+	}
+
+	body, err = json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// BatchHandler responds to POST requests on /keyValue-store/_batch. The body is a JSON
+// object holding a list of puts and deletes and the client's causal payload. The whole
+// batch is applied at once and the response holds the result of each operation.
+func (app *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling BATCH request")
+
+	var body []byte
+	var err error
+	var resp map[string]interface{}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req batchRequest
+	if r.Body != nil {
+		err = json.NewDecoder(r.Body).Decode(&req)
+	}
+	if req.Payload == nil {
+		req.Payload = make(map[string]int)
+	}
+
+	if r.Body == nil || err != nil {
+		log.Println("ERROR: Invalid batch: ", err)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Batch must be a JSON object with a list of ops",
+			"payload": map[string]int{},
+		}
+	} else if results, clock, err := app.db.Batch(req.Ops, hlc.Now(), req.Payload); err == errNotDurable {
+		// The batch isn't durable, so it can't be acknowledged
+		log.Println("ERROR: Batch failed: ", err)
+		w.WriteHeader(http.StatusInternalServerError) // code 500
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Write failed",
+			"payload": req.Payload,
+		}
+	} else if err != nil {
+		log.Println("ERROR: Invalid batch: ", err)
+		w.WriteHeader(http.StatusUnprocessableEntity) // code 422
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     err.Error(),
+			"payload": req.Payload,
+		}
+	} else {
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result":  "Success",
+			"results": results,
+			"payload": clock,
+		}
+	}
+
+	body, err = json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// historyItem is a single version of a key as it's shown to the client
+type historyItem struct {
+	Version   int            `json:"version"`
+	Value     string         `json:"value"`
+	Clock     map[string]int `json:"clock"`
+	Timestamp time.Time      `json:"timestamp"`
+	Tombstone bool           `json:"tombstone"`
+}
+
+// HistoryHandler responds to GET requests on /keyValue-store/{key}/history with every
+// version of the key this replica still holds, oldest first, ending with the current one.
+func (app *App) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling HISTORY request")
+
+	key := mux.Vars(r)["subject"]
+
+	var body []byte
+	var err error
+	var resp map[string]interface{}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	h := app.db.History(key)
+	if len(h) == 0 {
+		log.Println("No history for key")
+		w.WriteHeader(http.StatusNotFound) // code 404
+		resp = map[string]interface{}{
+			"result": "Error",
+			"error":  "Key does not exist",
+		}
+	} else {
+		items := make([]historyItem, len(h))
+		for i, e := range h {
+			items[i] = historyItem{
+				Version:   e.Version,
+				Value:     e.Value,
+				Clock:     past(&h[i]),
+				Timestamp: e.Timestamp,
+				Tombstone: e.Tombstone,
+			}
+		}
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result":  "Success",
+			"history": items,
+		}
+	}
+
+	body, err = json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// writeVersion answers a GET for a particular version of a key. The payload returned is
+// the client's merged with the clock that version was written with.
+func (app *App) writeVersion(w http.ResponseWriter, key string, v string, payloadInt map[string]int) {
+	var body []byte
+	var err error
+	var resp map[string]interface{}
+
+	version, verr := strconv.Atoi(v)
+	e, found := findVersion(app.db.History(key), version)
+
+	if verr != nil || version < 1 {
+		log.Println("ERROR: Invalid version: ", v)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Version must be a positive number",
+			"payload": payloadInt,
+		}
+	} else if !found {
+		log.Println("Version not found in history")
+		w.WriteHeader(http.StatusNotFound) // code 404
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"error":   "Version does not exist",
+			"payload": payloadInt,
+		}
+	} else {
+		payload := mergeClocks(copyClock(payloadInt), past(&e))
+
+		if e.Tombstone {
+			log.Println("Version is a tombstone")
+			w.WriteHeader(http.StatusNotFound) // code 404
+			resp = map[string]interface{}{
+				"result":  "Error",
+				"error":   "Key was deleted at this version",
+				"version": e.Version,
+				"payload": payload,
+			}
+		} else {
+			w.WriteHeader(http.StatusOK) // code 200
+			resp = map[string]interface{}{
+				"result":    "Success",
+				"value":     e.Value,
+				"version":   e.Version,
+				"timestamp": e.Timestamp,
+				"payload":   payload,
+			}
+		}
+	}
+
+	body, err = json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// CounterHandler responds to POST requests on /keyValue-store/{key}/counter. The form
+// holds the type, gcounter by default or pncounter, the op, increment or decrement,
+// the amount, 1 by default, and the client's payload.
+func (app *App) CounterHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling COUNTER request")
+	r.ParseForm()
+
+	op := crdtOp{Type: r.Form.Get("type"), Op: r.Form.Get("op"), Amount: 1}
+	if op.Type == "" {
+		op.Type = crdtGCounter
+	}
+	if op.Op == "" {
+		op.Op = crdtIncrement
+	}
+	if a := r.Form.Get("amount"); a != "" {
+		var err error
+		if op.Amount, err = strconv.Atoi(a); err != nil {
+			op.Amount = 0
+		}
+	}
+	app.applyCRDT(w, r, op)
+}
+
+// SetHandler responds to POST requests on /keyValue-store/{key}/set. The form holds
+// the op, add or remove, the element, and the client's payload.
+func (app *App) SetHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling SET request")
+	r.ParseForm()
+
+	op := crdtOp{Type: crdtORSet, Op: r.Form.Get("op"), Element: r.Form.Get("element")}
+	app.applyCRDT(w, r, op)
+}
+
+// RegisterHandler responds to POST requests on /keyValue-store/{key}/register. The form
+// holds the type, lww by default or mvregister, the value to assign, and the client's payload.
+func (app *App) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling REGISTER request")
+	r.ParseForm()
+
+	op := crdtOp{Type: r.Form.Get("type"), Op: crdtAssign, Value: r.Form.Get("val")}
+	if op.Type == "" {
+		op.Type = crdtLWWRegister
+	}
+	app.applyCRDT(w, r, op)
+}
+
+// applyCRDT performs an operation on a typed key and writes the response. The request
+// form must already be parsed.
+func (app *App) applyCRDT(w http.ResponseWriter, r *http.Request, op crdtOp) {
+	key := mux.Vars(r)["subject"]
+
+	var body []byte
+	var resp map[string]interface{}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	payloadInt, err := parsePayload(r.Form.Get("payload"))
+	if err != nil {
+		log.Println("ERROR: Invalid payload: ", err)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Invalid payload",
+			"payload": map[string]int{},
+		}
+	} else if state, clock, err := app.db.ApplyCRDT(key, op, hlc.Now(), payloadInt); err == errCRDTType {
+		log.Println("ERROR: Key holds a different type")
+		w.WriteHeader(http.StatusConflict) // code 409
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Key is not a " + op.Type,
+			"payload": payloadInt,
+		}
+	} else if err == errNotDurable {
+		// The operation isn't durable, so it can't be acknowledged
+		log.Println("ERROR: Operation failed: ", err)
+		w.WriteHeader(http.StatusInternalServerError) // code 500
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Write failed",
+			"payload": payloadInt,
+		}
+	} else if err != nil {
+		log.Println("ERROR: Invalid operation: ", err)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     err.Error(),
+			"payload": payloadInt,
+		}
+	} else {
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result":  "Success",
+			"type":    state.Type,
+			"value":   state.render(),
+			"payload": clock,
+		}
+	}
+
+	body, err = json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
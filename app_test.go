@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -43,6 +44,12 @@ type TestKVS struct {
 	dbClock   map[string]int
 	dbTime    time.Time
 	dbVersion int
+	dbExpires time.Time
+	dbSibs    []sibling
+	dbCRDT    *crdtState
+	dbNode    string
+	dbDot     int
+	dbErr     error // Returned by every write, as if the log had failed
 }
 
 func (kvs *TestKVS) GetTimestamp(key string) time.Time {
@@ -76,22 +83,118 @@ func (kvs *TestKVS) Get(key string, clock map[string]int) (string, map[string]in
 }
 
 // This stub returns true for the key which exists and false for the one which doesn't
-func (kvs *TestKVS) Delete(key string, timestamp time.Time, payload map[string]int) bool {
+func (kvs *TestKVS) Delete(key string, timestamp time.Time, payload map[string]int) (bool, error) {
 	if key == kvs.dbKey {
-		return true
+		return true, kvs.dbErr
 	}
-	return false
+	return false, nil
 }
 
 // idk lets try this
-func (kvs *TestKVS) Put(key, valExists string, time time.Time, payload map[string]int) bool {
+func (kvs *TestKVS) Put(key, valExists string, time time.Time, payload map[string]int) (bool, error) {
 	for k := range kvs.dbClock {
 		kvs.dbClock[k] = 0
 	}
 	for k, v := range payload {
 		kvs.dbClock[k] = v
 	}
-	return true
+	return true, kvs.dbErr
+}
+
+func (kvs *TestKVS) PutWithExpiry(key, valExists string, time time.Time, payload map[string]int, expires time.Time) (bool, error) {
+	kvs.dbExpires = expires
+	return kvs.Put(key, valExists, time, payload)
+}
+
+func (kvs *TestKVS) CompareAndPut(key, val string, time time.Time, payload map[string]int, expires time.Time, cond casCondition) (bool, int, map[string]int, error) {
+	alive, version := kvs.Contains(key)
+	clock := map[string]int{}
+	if alive {
+		clock = kvs.GetClock(key)
+	}
+	if !cond.matches(alive, version, clock) {
+		return false, version, clock, nil
+	}
+	ok, err := kvs.PutWithExpiry(key, val, time, payload, expires)
+	return ok, version, clock, err
+}
+
+// This stub bumps the version of every key in the batch and puts them all in the clock
+func (kvs *TestKVS) Batch(ops []batchOp, time time.Time, payload map[string]int) ([]batchResult, map[string]int, error) {
+	if err := checkBatch(ops); err != nil {
+		return nil, nil, err
+	}
+	clock := map[string]int{}
+	for k, v := range payload {
+		clock[k] = v
+	}
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		alive, version := kvs.Contains(op.Key)
+		results[i] = batchResult{Key: op.Key, Op: op.Op, Result: "Success", Replaced: alive, Version: version + 1}
+		clock[op.Key] = version + 1
+	}
+	return results, clock, nil
+}
+
+// This stub only knows the current version of the key which exists
+func (kvs *TestKVS) History(key string) []Entry {
+	if key != kvs.dbKey {
+		return []Entry{}
+	}
+	return []Entry{{Version: kvs.dbVersion, Value: kvs.dbVal, Clock: kvs.dbClock, Timestamp: kvs.dbTime}}
+}
+
+func (kvs *TestKVS) GetSiblings(key string) []sibling {
+	if key == kvs.dbKey {
+		return kvs.dbSibs
+	}
+	return nil
+}
+
+// This stub applies the operation to the one typed value it holds
+func (kvs *TestKVS) ApplyCRDT(key string, op crdtOp, time time.Time, payload map[string]int) (*crdtState, map[string]int, error) {
+	if key == kvs.dbKey && (kvs.dbCRDT == nil || kvs.dbCRDT.Type != op.Type) {
+		return nil, nil, errCRDTType
+	}
+	if kvs.dbCRDT == nil {
+		var err error
+		if kvs.dbCRDT, err = newCRDT(op.Type); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := kvs.dbCRDT.apply(op, testMain, time); err != nil {
+		return nil, nil, err
+	}
+	return kvs.dbCRDT, payload, nil
+}
+
+func (kvs *TestKVS) GetCRDT(key string) *crdtState {
+	if key == kvs.dbKey {
+		return kvs.dbCRDT
+	}
+	return nil
+}
+
+func (kvs *TestKVS) GetNode(key string) string {
+	if key == kvs.dbKey {
+		return kvs.dbNode
+	}
+	return ""
+}
+
+func (kvs *TestKVS) GetDot(key string) int {
+	if key == kvs.dbKey {
+		return kvs.dbDot
+	}
+	return 0
+}
+
+func (kvs *TestKVS) OverwriteEntries(eg entryGlob) {
+	for k, e := range eg.Keys {
+		entry := e
+		kvs.OverwriteEntry(k, &entry)
+	}
 }
 
 func (kvs *TestKVS) OverwriteEntry(key string, entry KeyEntry) {
@@ -116,6 +219,21 @@ func (kvs *TestKVS) GetTimeGlob() timeGlob {
 	return g
 }
 
+func (kvs *TestKVS) GetEntry(key string) *Entry {
+	if key != kvs.dbKey || kvs.dbVersion == 0 {
+		return nil
+	}
+	return &Entry{
+		Version:   kvs.dbVersion,
+		Clock:     kvs.dbClock,
+		Timestamp: kvs.dbTime,
+		Value:     kvs.dbVal,
+		Siblings:  kvs.dbSibs,
+		Node:      kvs.dbNode,
+		Dot:       kvs.dbDot,
+	}
+}
+
 func (kvs *TestKVS) GetEntryGlob(g timeGlob) entryGlob {
 	m := make(map[string]Entry)
 	e := Entry{
@@ -130,16 +248,61 @@ func (kvs *TestKVS) GetEntryGlob(g timeGlob) entryGlob {
 	return j
 }
 
+func (kvs *TestKVS) Range(q rangeQuery, payload map[string]int) rangeResult {
+	if payload[kvs.dbKey] > kvs.dbVersion {
+		return rangeResult{Stale: true}
+	}
+	if q.matches(kvs.dbKey) {
+		return rangeResult{Keys: []string{kvs.dbKey}, Clock: kvs.dbClock}
+	}
+	return rangeResult{Keys: []string{}, Clock: payload}
+}
+
+func (kvs *TestKVS) Snapshot() error {
+	return nil
+}
+
+func (kvs *TestKVS) AckTombstones(peer string, acked timeGlob) {
+}
+
+func (kvs *TestKVS) CollectTombstones(peers []string, members []string) int {
+	return 0
+}
+
+func (kvs *TestKVS) Count() int {
+	if kvs.dbKey == "" {
+		return 0
+	}
+	return 1
+}
+
+func (kvs *TestKVS) Forget(tg timeGlob) int {
+	return 0
+}
+
+func (kvs *TestKVS) MerkleHashes(nodes []int) []uint64 {
+	return make([]uint64, len(nodes))
+}
+
+func (kvs *TestKVS) GetLeafGlob(nodes []int) timeGlob {
+	return kvs.GetTimeGlob()
+}
+
+func (kvs *TestKVS) AckMerkle(peer string, matched map[int]uint64) {
+}
+
 // Trying to reduce code repetition
 func setup(key string, val string) (string, *mux.Router) {
-	clock := map[string]int{key: 1}
+	// The key was written on another replica and that write has reached us
+	clock := map[string]int{viewExist: 1}
+	dots.Observe(viewExist, 1)
 	testKVS = TestKVS{dbKey: key, dbVal: val, dbClock: clock, dbVersion: 1}
 
 	// This should probably be converted to a mock instance
 	v := NewView(testMain, testView)
 
 	// Stub the app
-	testApp := App{&testKVS, *v}
+	testApp := App{db: &testKVS, view: *v}
 
 	l, err := net.Listen("tcp", "")
 	if err != nil {
@@ -156,6 +319,14 @@ func setup(key string, val string) (string, *mux.Router) {
 	testRouter.HandleFunc(view, testApp.ViewPutHandler).Methods(http.MethodPut)
 	testRouter.HandleFunc(view, testApp.ViewGetHandler).Methods(http.MethodGet)
 	testRouter.HandleFunc(view, testApp.ViewDeleteHandler).Methods(http.MethodDelete)
+	testRouter.HandleFunc(view+statusSuffix, testApp.ViewStatusHandler).Methods(http.MethodGet)
+	testRouter.HandleFunc(admin+snapshotSuffix, testApp.SnapshotHandler).Methods(http.MethodPut)
+	testRouter.HandleFunc(rootURL, testApp.RangeHandler).Methods(http.MethodGet)
+	testRouter.HandleFunc(rootURL+batchSuffix, testApp.BatchHandler).Methods(http.MethodPost)
+	testRouter.HandleFunc(rootURL+keySuffix+historySuffix, testApp.HistoryHandler).Methods(http.MethodGet)
+	testRouter.HandleFunc(rootURL+keySuffix+counterSuffix, testApp.CounterHandler).Methods(http.MethodPost)
+	testRouter.HandleFunc(rootURL+keySuffix+setSuffix, testApp.SetHandler).Methods(http.MethodPost)
+	testRouter.HandleFunc(rootURL+keySuffix+registerSuffix, testApp.RegisterHandler).Methods(http.MethodPost)
 
 	// Stub the server
 	testServer := httptest.NewUnstartedServer(testRouter)
@@ -218,6 +389,32 @@ func TestPutRequestKeyExists(t *testing.T) {
 	teardown()
 }
 
+// TestPutRequestNotLogged verifies a write that couldn't be logged isn't acknowledged
+func TestPutRequestNotLogged(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	testKVS.dbErr = errNotDurable
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodPut, serverURL+rootURL+"/"+keyExists, strings.NewReader("val="+valExists))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusInternalServerError, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, "Error", gotBody["result"])
+
+	// A delete isn't acknowledged either
+	recorder = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodDelete, serverURL+rootURL+"/"+keyExists, nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+	equals(t, http.StatusInternalServerError, recorder.Code)
+
+	teardown()
+}
+
 // TestPutRequestKeyDoesntExist verifies the response given when adding a new key
 func TestPutRequestKeyDoesntExist(t *testing.T) {
 	// Setup the test
@@ -447,7 +644,7 @@ func TestGetRequestKeyExists(t *testing.T) {
 
 	var gotBody map[string]interface{}
 
-	expectedPayload := map[string]interface{}{keyExists: float64(1)}
+	expectedPayload := map[string]interface{}{viewExist: float64(1)}
 	err = json.Unmarshal(body, &gotBody)
 	ok(t, err)
 	expectedBody := map[string]interface{}{
@@ -536,7 +733,7 @@ func TestGetRequestReturnsPayload(t *testing.T) {
 
 	var gotBody map[string]interface{}
 
-	expectedPayload := map[string]interface{}{keyExists: float64(1)}
+	expectedPayload := map[string]interface{}{viewExist: float64(1)}
 
 	err = json.Unmarshal(body, &gotBody)
 	ok(t, err)
@@ -605,7 +802,7 @@ func TestDeleteKeyExistsStalePayload(t *testing.T) {
 
 	// Set up the URL
 	url := serverURL + rootURL + "/" + subject
-	testPayload := map[string]int{keyExists: 2}
+	testPayload := map[string]int{viewNotExist: 2}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -635,7 +832,7 @@ func TestDeleteKeyExistsStalePayload(t *testing.T) {
 	expectedBody := map[string]interface{}{
 		"msg":     "Payload out of date",
 		"result":  "Error",
-		"payload": map[string]interface{}{keyExists: float64(2)},
+		"payload": map[string]interface{}{viewNotExist: float64(2)},
 	}
 
 	equals(t, expectedBody, gotBody)
@@ -935,13 +1132,52 @@ func TestViewGetRequestViewExists(t *testing.T) {
 	ok(t, err)
 	// Hard coded View example for testing
 	expectedBody := map[string]interface{}{
-		"view": testView,
+		"view":  testView,
+		"epoch": 0.0,
 	}
 
 	equals(t, expectedBody, gotBody)
 	teardown()
 }
 
+func TestViewStatusRequest(t *testing.T) {
+	// Setup the test
+	serverURL, router := setup(keyExists, valExists)
+	members.Merge(map[string]memberState{"176.32.164.10:8084": {Status: statusDead, Incarnation: 2}})
+	defer func() { members = memberList{} }()
+
+	// Use a httptest recorder to observe responses
+	recorder := httptest.NewRecorder()
+
+	// Stub a request
+	req, err := http.NewRequest(http.MethodGet, serverURL+view+statusSuffix, nil)
+	ok(t, err)
+
+	// Finally, make the request to the function being tested.
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	body, err := ioutil.ReadAll(recorder.Body)
+	ok(t, err)
+
+	var gotBody map[string]interface{}
+	err = json.Unmarshal(body, &gotBody)
+	ok(t, err)
+
+	// Members we've heard nothing about are taken to be alive
+	expectedBody := map[string]interface{}{
+		"view": testView,
+		"members": map[string]interface{}{
+			testMain:             map[string]interface{}{"status": "alive", "incarnation": 0.0, "phi": 0.0},
+			viewExist:            map[string]interface{}{"status": "alive", "incarnation": 0.0, "phi": 0.0},
+			"176.32.164.10:8084": map[string]interface{}{"status": "dead", "incarnation": 2.0, "phi": 0.0},
+		},
+		"skewed": float64(hlc.Skewed()),
+	}
+	equals(t, expectedBody, gotBody)
+	teardown()
+}
+
 func TestViewDeleteRequestViewExists(t *testing.T) {
 	// Setup the test
 	serverURL, router := setup(keyExists, valExists)
@@ -1043,8 +1279,7 @@ func TestPutHandlerStoresPayload(t *testing.T) {
 
 	// Start with a payload map
 	testPayload := map[string]int{
-		keyExists:    1,
-		keyNotExists: 2,
+		viewExist: 1,
 	}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
@@ -1064,7 +1299,6 @@ func TestPutHandlerStoresPayload(t *testing.T) {
 
 	// Finally, make the request to the function being tested.
 	router.ServeHTTP(recorder, req)
-	testPayload[keyExists] = 2
 
 	expectedStatus := http.StatusCreated // code 201
 	gotStatus := recorder.Code
@@ -1091,7 +1325,7 @@ func TestGetHandlerStalePayload(t *testing.T) {
 	// Set up the URL
 	url := serverURL + rootURL + "/" + subject
 
-	testPayload := map[string]int{keyExists: 2}
+	testPayload := map[string]int{viewNotExist: 2}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -1116,7 +1350,7 @@ func TestGetHandlerStalePayload(t *testing.T) {
 	ok(t, err)
 
 	var gotBody map[string]interface{}
-	expectedPayload := map[string]interface{}{keyExists: float64(2)}
+	expectedPayload := map[string]interface{}{viewNotExist: float64(2)}
 
 	err = json.Unmarshal(body, &gotBody)
 	ok(t, err)
@@ -1152,7 +1386,7 @@ func TestSearchHandlerValidPayloadKeyExists(t *testing.T) {
 
 	// Set up the URL
 	url := serverURL + rootURL + search + "/" + subject
-	testPayload := map[string]int{keyExists: 1}
+	testPayload := map[string]int{viewExist: 1}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -1181,7 +1415,7 @@ func TestSearchHandlerValidPayloadKeyExists(t *testing.T) {
 	expectedBody := map[string]interface{}{
 		"isExists": true,
 		"result":   "Success",
-		"payload":  map[string]interface{}{keyExists: float64(1)},
+		"payload":  map[string]interface{}{viewExist: float64(1)},
 	}
 
 	equals(t, expectedBody, gotBody)
@@ -1202,7 +1436,7 @@ func TestSearchHandlerStalePayloadKeyExists(t *testing.T) {
 
 	// Set up the URL
 	url := serverURL + rootURL + search + "/" + subject
-	testPayload := map[string]int{keyExists: 2}
+	testPayload := map[string]int{viewNotExist: 2}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -1231,7 +1465,7 @@ func TestSearchHandlerStalePayloadKeyExists(t *testing.T) {
 	expectedBody := map[string]interface{}{
 		"msg":     "Payload out of date",
 		"result":  "Error",
-		"payload": map[string]interface{}{keyExists: float64(2)},
+		"payload": map[string]interface{}{viewNotExist: float64(2)},
 	}
 
 	equals(t, expectedBody, gotBody)
@@ -1240,6 +1474,405 @@ func TestSearchHandlerStalePayloadKeyExists(t *testing.T) {
 
 }
 
+// TestSnapshotHandlerTakesSnapshot verifies the response from the admin snapshot trigger
+func TestSnapshotHandlerTakesSnapshot(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodPut, serverURL+admin+snapshotSuffix, nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	expectedBody := map[string]interface{}{
+		"result": "Success",
+		"msg":    "Snapshot written",
+	}
+	equals(t, expectedBody, gotBody)
+
+	teardown()
+}
+
+// TestPutHandlerStoresExpiry verifies that a TTL in the form becomes an absolute expiry
+func TestPutHandlerStoresExpiry(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader("val=" + valExists + "&" + ttlField + "=60")
+	req, err := http.NewRequest(http.MethodPut, serverURL+rootURL+"/"+keyExists, reqBody)
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	before := time.Now()
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusCreated, recorder.Code)
+	assert(t, testKVS.dbExpires.After(before.Add(59*time.Second)), "Expiry not set from TTL")
+	assert(t, testKVS.dbExpires.Before(time.Now().Add(61*time.Second)), "Expiry too far out")
+
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	assert(t, gotBody["expires"] != nil, "Response is missing the expiry")
+
+	teardown()
+}
+
+// TestPutHandlerTTLHeader verifies that a TTL can be sent as a header
+func TestPutHandlerTTLHeader(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader("val=" + valExists)
+	req, err := http.NewRequest(http.MethodPut, serverURL+rootURL+"/"+keyNotExists, reqBody)
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(ttlHeader, "5m")
+
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	assert(t, testKVS.dbExpires.After(time.Now().Add(4*time.Minute)), "Expiry not set from header")
+
+	teardown()
+}
+
+// TestPutHandlerInvalidTTL verifies that a bad TTL is rejected
+func TestPutHandlerInvalidTTL(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader("val=" + valExists + "&" + ttlField + "=-1")
+	req, err := http.NewRequest(http.MethodPut, serverURL+rootURL+"/"+keyExists, reqBody)
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, "Error", gotBody["result"])
+
+	teardown()
+}
+
+// TestPutHandlerConditionFails verifies that a write against the wrong version is refused
+func TestPutHandlerConditionFails(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader("val=" + valone)
+	req, err := http.NewRequest(http.MethodPut, serverURL+rootURL+"/"+keyExists, reqBody)
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(ifMatchHeader, "7")
+
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusPreconditionFailed, recorder.Code)
+	equals(t, valExists, testKVS.dbVal)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, float64(testKVS.dbVersion), gotBody["version"])
+	equals(t, casConsistency, gotBody["consistency"])
+
+	teardown()
+}
+
+// TestPutHandlerConditionMatches verifies that a write against the current version goes through
+func TestPutHandlerConditionMatches(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader("val=" + valone)
+	req, err := http.NewRequest(http.MethodPut, serverURL+rootURL+"/"+keyExists, reqBody)
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(ifMatchHeader, strconv.Itoa(testKVS.dbVersion))
+
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusCreated, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, float64(testKVS.dbVersion+1), gotBody["version"])
+
+	teardown()
+}
+
+// TestPutHandlerInvalidCondition verifies that a bad If-Match header is rejected
+func TestPutHandlerInvalidCondition(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader("val=" + valone)
+	req, err := http.NewRequest(http.MethodPut, serverURL+rootURL+"/"+keyExists, reqBody)
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(ifMatchHeader, "latest")
+
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+
+	teardown()
+}
+
+// TestBatchHandlerAppliesOps verifies the per-operation results and combined payload of a batch
+func TestBatchHandlerAppliesOps(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader(`{"ops":[{"op":"put","key":"` + keyExists + `","val":"` + valone + `"},{"op":"delete","key":"` + keyone + `"}],"payload":{"` + keyNotHere + `":3}}`)
+	req, err := http.NewRequest(http.MethodPost, serverURL+rootURL+batchSuffix, reqBody)
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, "Success", gotBody["result"])
+	equals(t, map[string]interface{}{keyExists: 2.0, keyone: 1.0, keyNotHere: 3.0}, gotBody["payload"])
+
+	results := gotBody["results"].([]interface{})
+	equals(t, 2, len(results))
+	first := results[0].(map[string]interface{})
+	equals(t, keyExists, first["key"])
+	equals(t, true, first["replaced"])
+
+	teardown()
+}
+
+// TestBatchHandlerRejectsInvalidBatch verifies that a bad operation rejects the whole batch
+func TestBatchHandlerRejectsInvalidBatch(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+
+	for body, code := range map[string]int{
+		`not json`:   http.StatusBadRequest,
+		`{"ops":[]}`: http.StatusUnprocessableEntity,
+		`{"ops":[{"op":"frobnicate","key":"a"}]}`: http.StatusUnprocessableEntity,
+	} {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, serverURL+rootURL+batchSuffix, strings.NewReader(body))
+		ok(t, err)
+		router.ServeHTTP(recorder, req)
+		equals(t, code, recorder.Code)
+	}
+
+	teardown()
+}
+
+// TestGetHandlerVersion verifies reading a particular version of a key
+func TestGetHandlerVersion(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+
+	for v, code := range map[string]int{"1": http.StatusOK, "2": http.StatusNotFound, "first": http.StatusBadRequest} {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"/"+keyExists+"?version="+v, nil)
+		ok(t, err)
+		router.ServeHTTP(recorder, req)
+		equals(t, code, recorder.Code)
+
+		if code == http.StatusOK {
+			var gotBody map[string]interface{}
+			ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+			equals(t, valExists, gotBody["value"])
+			equals(t, 1.0, gotBody["version"])
+		}
+	}
+
+	teardown()
+}
+
+// TestHistoryHandler verifies the history listing of a key
+func TestHistoryHandler(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"/"+keyExists+historySuffix, nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	history := gotBody["history"].([]interface{})
+	equals(t, 1, len(history))
+	equals(t, valExists, history[0].(map[string]interface{})["value"])
+
+	recorder = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, serverURL+rootURL+"/"+keyNotExists+historySuffix, nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+	equals(t, http.StatusNotFound, recorder.Code)
+
+	teardown()
+}
+
+// TestGetHandlerSiblings verifies that every sibling of a key is returned
+func TestGetHandlerSiblings(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	testKVS.dbSibs = []sibling{
+		{Value: valone, Clock: map[string]int{}, Node: viewExist, Dot: 1},
+		{Value: valtwo, Clock: map[string]int{}, Node: viewNotExist, Dot: 1},
+	}
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"/"+keyExists, nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	sibs := gotBody["siblings"].([]interface{})
+	equals(t, 2, len(sibs))
+	equals(t, valtwo, sibs[1].(map[string]interface{})["value"])
+
+	teardown()
+}
+
+// TestCounterHandler verifies incrementing a new counter
+func TestCounterHandler(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodPost, serverURL+rootURL+"/"+keyNotExists+counterSuffix, strings.NewReader("amount=5"))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, crdtGCounter, gotBody["type"])
+	equals(t, 5.0, gotBody["value"])
+
+	teardown()
+}
+
+// TestSetHandlerWrongType verifies that an operation on a plain key is refused
+func TestSetHandlerWrongType(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodPost, serverURL+rootURL+"/"+keyExists+setSuffix, strings.NewReader("op=add&element=a"))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusConflict, recorder.Code)
+
+	teardown()
+}
+
+// TestRegisterHandlerInvalidType verifies that an unknown register type is refused
+func TestRegisterHandlerInvalidType(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodPost, serverURL+rootURL+"/"+keyNotExists+registerSuffix, strings.NewReader("type=fancy&val=a"))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+
+	teardown()
+}
+
+// TestGetHandlerCRDT verifies that a typed key is returned in its own shape
+func TestGetHandlerCRDT(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	testKVS.dbCRDT, _ = newCRDT(crdtORSet)
+	testKVS.dbCRDT.apply(crdtOp{Op: crdtAdd, Element: valone}, testMain, time.Now())
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"/"+keyExists, nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, crdtORSet, gotBody["type"])
+	equals(t, []interface{}{valone}, gotBody["crdt"])
+
+	teardown()
+}
+
+// TestRangeHandlerListsKeys verifies the response from a prefix scan
+func TestRangeHandlerListsKeys(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"?prefix=KEY_&limit=10", nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	expectedBody := map[string]interface{}{
+		"result":  "Success",
+		"keys":    []interface{}{keyExists},
+		"next":    "",
+		"payload": map[string]interface{}{viewExist: 1.0},
+	}
+	equals(t, expectedBody, gotBody)
+
+	teardown()
+}
+
+// TestRangeHandlerStalePayload verifies that a scan refuses to violate causality
+func TestRangeHandlerStalePayload(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	reqBody := strings.NewReader(`payload={"` + keyExists + `":5}`)
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL, reqBody)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, "Payload out of date", gotBody["msg"])
+
+	teardown()
+}
+
+// TestRangeHandlerInvalidLimit verifies that out of range page sizes are rejected
+func TestRangeHandlerInvalidLimit(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"?limit=0", nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+
+	teardown()
+}
+
+func TestRangeHandlerRefusedWhenPartitioned(t *testing.T) {
+	defer withReplicas(2)()
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"?prefix=subject", nil)
+	ok(t, err)
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+
+	teardown()
+}
+
 // These functions were taken from Ben Johnson's post here: https://medium.com/@benbjohnson/structuring-tests-in-go-46ddee7a25c
 
 // assert fails the test if the condition is false.
@@ -0,0 +1,156 @@
+// batch.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines multi-key batches of puts and deletes. A batch is applied to the db under a
+// single write lock, so a reader on this replica sees either all of it or none of it.
+//
+// Every key in the batch gets the same timestamp and the same clock: the client's
+// payload plus the new version of every key in the batch. The batch is logged as one
+// record, goes out in the same entryGlob when it's gossiped since every key in it
+// changed at once, and is written in one go by the replica that receives it.
+//
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	batchPut    = "put"
+	batchDelete = "delete"
+)
+
+// batchOp is a single operation in a batch as the client sends it
+type batchOp struct {
+	Op  string `json:"op"`  // Either put or delete
+	Key string `json:"key"` // Key to write
+	Val string `json:"val"` // Value for a put
+	TTL string `json:"ttl"` // Optional TTL for a put, see expiry.go
+}
+
+// batchRequest is the body of a POST to the batch endpoint
+type batchRequest struct {
+	Ops     []batchOp      `json:"ops"`
+	Payload map[string]int `json:"payload"`
+}
+
+// batchResult is the outcome of a single operation in a batch
+type batchResult struct {
+	Key      string `json:"key"`
+	Op       string `json:"op"`
+	Result   string `json:"result"`
+	Msg      string `json:"msg"`
+	Replaced bool   `json:"replaced"` // For a put, true if the key was alive before
+	Version  int    `json:"version"`  // Version of the key after the batch
+}
+
+// checkBatch makes sure every operation in the batch is valid before any of it is applied
+func checkBatch(ops []batchOp) error {
+	if len(ops) == 0 {
+		return errors.New("Batch is empty")
+	}
+	if len(ops) > batchMaxOps {
+		return errors.New("Batch has more than " + strconv.Itoa(batchMaxOps) + " operations")
+	}
+	seen := make(map[string]bool, len(ops))
+	for i, op := range ops {
+		where := "Operation " + strconv.Itoa(i) + ": "
+		if op.Op != batchPut && op.Op != batchDelete {
+			return errors.New(where + "op must be " + batchPut + " or " + batchDelete)
+		}
+		if op.Key == "" || len(op.Key) > maxKey {
+			return errors.New(where + "Key not valid")
+		}
+		if len(op.Val) > maxVal {
+			return errors.New(where + "Object too large. Size limit is 1MB")
+		}
+		if op.TTL != "" {
+			if _, err := parseTTL(op.TTL); err != nil {
+				return errors.Wrap(err, where+"Invalid TTL")
+			}
+		}
+		// Two writes to one key in the same batch would both claim the same version
+		if seen[op.Key] {
+			return errors.New(where + "Key " + op.Key + " appears more than once")
+		}
+		seen[op.Key] = true
+	}
+	return nil
+}
+
+// Batch applies every operation under a single write lock. It returns the result of
+// each operation in order along with the client's payload joined with the dots of the
+// writes, which is the payload the client should send next.
+func (k *KVS) Batch(ops []batchOp, timestamp time.Time, payload map[string]int) ([]batchResult, map[string]int, error) {
+	if err := checkBatch(ops); err != nil {
+		return nil, nil, err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// Work out the new version of every key first, every write has the payload as its context
+	clock := copyClock(payload)
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		alive, version := k.contains(op.Key)
+		results[i] = batchResult{Key: op.Key, Op: op.Op, Result: "Success", Version: version}
+		if op.Op == batchDelete && !alive {
+			results[i].Result = "Error"
+			results[i].Msg = "Key does not exist"
+			continue
+		}
+		results[i].Replaced = alive
+		results[i].Version = version + 1
+	}
+
+	written := make(map[string]Entry, len(ops))
+	for i, op := range ops {
+		if results[i].Result != "Success" {
+			continue
+		}
+		e := NewEntry(timestamp, payload, op.Val, results[i].Version)
+		if op.Op == batchDelete {
+			e.Value = ""
+			e.Tombstone = true
+			results[i].Msg = "Deleted successfully"
+		} else {
+			if op.TTL != "" {
+				d, _ := parseTTL(op.TTL)
+				e.Expires = timestamp.Add(d)
+			}
+			results[i].Msg = "Added successfully"
+			if results[i].Replaced {
+				results[i].Msg = "Updated successfully"
+			}
+		}
+		k.archive(op.Key, timestamp)
+		k.db[op.Key] = e
+		k.index.Insert(op.Key)
+		k.rehash(op.Key)
+		delete(k.graveyard, op.Key)
+		written[op.Key] = *e
+		if clock[e.Node] < e.Dot {
+			clock[e.Node] = e.Dot
+		}
+	}
+
+	if len(written) > 0 {
+		if err := k.logBatch(written); err != nil {
+			return nil, nil, err
+		}
+	}
+	log.Printf("Applied batch of %d operations, wrote %d keys\n", len(ops), len(written))
+	return results, clock, nil
+}
@@ -0,0 +1,106 @@
+// batch_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for multi-key batches
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckBatch(t *testing.T) {
+	ok(t, checkBatch([]batchOp{{Op: batchPut, Key: keyone, Val: valone}, {Op: batchDelete, Key: keyExists}}))
+
+	assert(t, checkBatch(nil) != nil, "Empty batch accepted")
+	assert(t, checkBatch([]batchOp{{Op: "get", Key: keyone}}) != nil, "Unknown op accepted")
+	assert(t, checkBatch([]batchOp{{Op: batchPut, Key: invalidKey}}) != nil, "Long key accepted")
+	assert(t, checkBatch([]batchOp{{Op: batchPut, Key: keyone, TTL: "-1"}}) != nil, "Bad TTL accepted")
+	assert(t, checkBatch([]batchOp{{Op: batchPut, Key: keyone}, {Op: batchDelete, Key: keyone}}) != nil, "Duplicate key accepted")
+}
+
+func TestBatchSharesOneClock(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+
+	ops := []batchOp{
+		{Op: batchPut, Key: keyExists, Val: valone},
+		{Op: batchPut, Key: keyone, Val: valtwo},
+		{Op: batchDelete, Key: keyNotHere},
+	}
+	results, clock, err := k.Batch(ops, time.Now(), map[string]int{viewExist: 4})
+	ok(t, err)
+
+	equals(t, 4, clock[viewExist])
+	equals(t, true, results[0].Replaced)
+	equals(t, 2, results[0].Version)
+	equals(t, "Success", results[1].Result)
+	equals(t, "Error", results[2].Result)
+
+	// Every key written by the batch has the payload as its context, and the payload
+	// handed back has seen all of them
+	equals(t, map[string]int{viewExist: 4}, k.GetClock(keyExists))
+	equals(t, map[string]int{viewExist: 4}, k.GetClock(keyone))
+	assert(t, covers(clock, k.db[keyExists]) && covers(clock, k.db[keyone]), "Payload hasn't seen the batch")
+	equals(t, k.GetTimestamp(keyExists), k.GetTimestamp(keyone))
+}
+
+func TestBatchDeletes(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+
+	_, _, err := k.Batch([]batchOp{{Op: batchDelete, Key: keyExists}}, time.Now(), map[string]int{})
+	ok(t, err)
+	alive, version := k.Contains(keyExists)
+	assert(t, !alive, "Deleted key is alive")
+	equals(t, 2, version)
+}
+
+func TestInvalidBatchWritesNothing(t *testing.T) {
+	k := NewKVS()
+	ops := []batchOp{{Op: batchPut, Key: keyone, Val: valone}, {Op: batchPut, Key: invalidKey}}
+	_, _, err := k.Batch(ops, time.Now(), map[string]int{})
+	assert(t, err != nil, "Invalid batch accepted")
+
+	alive, _ := k.Contains(keyone)
+	assert(t, !alive, "Part of an invalid batch was written")
+}
+
+func TestBatchSurvivesRestart(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	ops := []batchOp{{Op: batchPut, Key: keyExists, Val: valExists}, {Op: batchPut, Key: keyone, Val: valone}}
+	_, clock, err := k.Batch(ops, time.Now(), map[string]int{})
+	ok(t, err)
+	ok(t, k.Close())
+
+	r := NewKVS()
+	defer r.Close()
+	assert(t, covers(clock, r.db[keyExists]), "Batch lost its dot in the restart")
+	equals(t, k.GetDot(keyExists), r.GetDot(keyExists))
+	val, _ := r.Get(keyone, map[string]int{})
+	equals(t, valone, val)
+}
+
+// A batch that arrives through gossip is written in one go
+func TestUpdateKVSAppliesBatchTogether(t *testing.T) {
+	k := NewKVS()
+	ops := []batchOp{{Op: batchPut, Key: keyExists, Val: valExists}, {Op: batchPut, Key: keyone, Val: valone}}
+	_, _, err := k.Batch(ops, time.Now(), map[string]int{})
+	ok(t, err)
+
+	r := NewKVS()
+	g := GossipVals{kvs: r, view: &TestView{view: testMain}}
+	g.UpdateKVS(k.GetEntryGlob(k.GetTimeGlob()))
+	equals(t, k.GetEntryGlob(k.GetTimeGlob()), r.GetEntryGlob(r.GetTimeGlob()))
+}
@@ -0,0 +1,130 @@
+// cas.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines conditional writes for the KVS. A client can send the version it expects
+// a key to be at in an If-Match header, and/or the vector clock it expects in an
+// X-If-Match-Clock header, and the write only goes through if the entry on this
+// replica still matches.
+//
+// The check and the write happen under the same lock, so the guarantee holds for
+// writes made through this replica. It is NOT a cluster-wide guarantee: replicas
+// are eventually consistent, so a write accepted by another replica can still be
+// concurrent with this one and will be settled by conflict resolution in gossip.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ifMatchHeader      = "If-Match"         // Expected version of the key, or * for any live version
+	ifMatchClockHeader = "X-If-Match-Clock" // Expected vector clock of the key as JSON
+
+	// casConsistency is sent back with every conditional write so clients know what they got
+	casConsistency = "per-replica: the condition is checked against this replica only, concurrent writes on other replicas are resolved by gossip"
+)
+
+// casCondition is what a conditional write expects the current entry to look like
+type casCondition struct {
+	AnyVersion bool           // Any live version will do
+	Version    int            // Expected version, 0 means the key must not exist
+	HasVersion bool           // True if Version should be checked
+	Clock      map[string]int // Expected clock, nil if it shouldn't be checked
+}
+
+// parseCondition reads the conditional write headers from a request. It returns nil
+// if the request isn't conditional.
+func parseCondition(ifMatch string, ifClock string) (*casCondition, error) {
+	if ifMatch == "" && ifClock == "" {
+		return nil, nil
+	}
+	var c casCondition
+
+	// ETags are usually quoted, so accept the version either way
+	ifMatch = strings.Trim(strings.TrimSpace(ifMatch), `"`)
+	if ifMatch == "*" {
+		c.AnyVersion = true
+	} else if ifMatch != "" {
+		v, err := strconv.Atoi(ifMatch)
+		if err != nil || v < 0 {
+			return nil, errors.New(ifMatchHeader + " must be a version number or *")
+		}
+		c.Version = v
+		c.HasVersion = true
+	}
+
+	if ifClock != "" {
+		var clock map[string]int
+		if err := json.Unmarshal([]byte(ifClock), &clock); err != nil {
+			return nil, errors.Wrap(err, ifMatchClockHeader+" must be a JSON clock")
+		}
+		c.Clock = clock
+	}
+	return &c, nil
+}
+
+// matches returns true if an entry with the given liveness, version and clock satisfies the condition
+func (c casCondition) matches(alive bool, version int, clock map[string]int) bool {
+	// A key that's deleted or expired is at version 0 as far as the client is concerned
+	if !alive {
+		version = 0
+		clock = map[string]int{}
+	}
+	if c.AnyVersion && !alive {
+		return false
+	}
+	if c.HasVersion && c.Version != version {
+		return false
+	}
+	if c.Clock != nil {
+		if len(c.Clock) != len(clock) {
+			return false
+		}
+		for k, v := range c.Clock {
+			if clock[k] != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CompareAndPut writes the key only if its current entry on this replica matches the
+// condition. It returns whether the write happened along with the version and clock
+// of the entry as it was when the condition was checked, and an error if the write
+// couldn't be logged.
+func (k *KVS) CompareAndPut(key string, val string, timestamp time.Time, payload map[string]int, expires time.Time, cond casCondition) (bool, int, map[string]int, error) {
+	if len(key) > maxKey || len(val) > maxVal {
+		return false, 0, map[string]int{}, nil
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	alive, version := k.contains(key)
+	clock := map[string]int{}
+	if e, ok := k.db[key]; ok && alive {
+		clock = past(e)
+	}
+	if !alive {
+		version = 0
+	}
+
+	if !cond.matches(alive, version, clock) {
+		return false, version, clock, nil
+	}
+	return true, version, clock, k.put(key, val, timestamp, payload, expires)
+}
@@ -0,0 +1,108 @@
+// cas_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for conditional writes
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCondition(t *testing.T) {
+	c, err := parseCondition("", "")
+	ok(t, err)
+	assert(t, c == nil, "Unconditional write parsed as a condition")
+
+	c, err = parseCondition(`"3"`, "")
+	ok(t, err)
+	equals(t, casCondition{Version: 3, HasVersion: true}, *c)
+
+	c, err = parseCondition("*", `{"a":1}`)
+	ok(t, err)
+	equals(t, casCondition{AnyVersion: true, Clock: map[string]int{"a": 1}}, *c)
+
+	_, err = parseCondition("-1", "")
+	assert(t, err != nil, "Negative version accepted")
+	_, err = parseCondition("", "{")
+	assert(t, err != nil, "Garbage clock accepted")
+}
+
+func TestCompareAndPutVersion(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+
+	applied, version, _, _ := k.CompareAndPut(keyExists, valone, time.Now(), map[string]int{}, time.Time{}, casCondition{Version: 2, HasVersion: true})
+	assert(t, !applied, "Write applied against the wrong version")
+	equals(t, 1, version)
+	val, _ := k.Get(keyExists, map[string]int{})
+	equals(t, valExists, val)
+
+	applied, _, _, _ = k.CompareAndPut(keyExists, valone, time.Now(), map[string]int{}, time.Time{}, casCondition{Version: 1, HasVersion: true})
+	assert(t, applied, "Write rejected against the current version")
+	_, version = k.Contains(keyExists)
+	equals(t, 2, version)
+}
+
+func TestCompareAndPutCreateOnly(t *testing.T) {
+	k := NewKVS()
+	create := casCondition{HasVersion: true}
+
+	applied, _, _, _ := k.CompareAndPut(keyone, valone, time.Now(), map[string]int{}, time.Time{}, create)
+	assert(t, applied, "Create of a missing key rejected")
+	applied, version, _, _ := k.CompareAndPut(keyone, valtwo, time.Now(), map[string]int{}, time.Time{}, create)
+	assert(t, !applied, "Create of an existing key applied")
+	equals(t, 1, version)
+
+	// A deleted key counts as missing, and If-Match: * needs it to be alive
+	k.Delete(keyone, time.Now(), map[string]int{})
+	applied, _, _, _ = k.CompareAndPut(keyone, valtwo, time.Now(), map[string]int{}, time.Time{}, casCondition{AnyVersion: true})
+	assert(t, !applied, "If-Match * applied to a deleted key")
+	applied, _, _, _ = k.CompareAndPut(keyone, valtwo, time.Now(), map[string]int{}, time.Time{}, create)
+	assert(t, applied, "Create of a deleted key rejected")
+}
+
+func TestCompareAndPutClock(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{viewExist: 1, viewNotExist: 4})
+	clock := past(k.db[keyExists])
+
+	applied, _, got, _ := k.CompareAndPut(keyExists, valone, time.Now(), map[string]int{}, time.Time{}, casCondition{Clock: map[string]int{viewExist: 1}})
+	assert(t, !applied, "Write applied against the wrong clock")
+	equals(t, clock, got)
+
+	applied, _, _, _ = k.CompareAndPut(keyExists, valone, time.Now(), map[string]int{}, time.Time{}, casCondition{Clock: got})
+	assert(t, applied, "Write rejected against the current clock")
+}
+
+// Only one of many racing writers against the same version can win
+func TestCompareAndPutRace(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wins := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied, _, _, _ := k.CompareAndPut(keyExists, valone, time.Now(), map[string]int{}, time.Time{}, casCondition{Version: 1, HasVersion: true})
+			if applied {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	equals(t, 1, wins)
+}
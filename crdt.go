@@ -0,0 +1,436 @@
+// crdt.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the conflict-free replicated data types a key can hold instead of a plain
+// string: grow-only and positive-negative counters, observed-remove sets, and
+// last-writer-wins and multi-value registers. They are changed through their own
+// operations rather than PUT, and when gossip brings in a copy of a typed key that
+// we also hold, the two are merged by their join instead of one of them winning
+// conflict resolution.
+//
+// Each replica identifies its own contributions by its IP and the time it started, so
+// the join of two states never loses an operation from either side. A node that comes
+// back without its data starts counting under a new name, rather than from zero under
+// a name whose old count it will get back through gossip and lose its increments to.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	crdtGCounter    = "gcounter"   // Counter that only goes up
+	crdtPNCounter   = "pncounter"  // Counter that goes up and down
+	crdtORSet       = "orset"      // Set where an add wins over a concurrent remove
+	crdtLWWRegister = "lww"        // Single value, the latest write wins
+	crdtMVRegister  = "mvregister" // Keeps every concurrent value
+
+	crdtIncrement = "increment"
+	crdtDecrement = "decrement"
+	crdtAdd       = "add"
+	crdtRemove    = "remove"
+	crdtAssign    = "assign"
+)
+
+// errCRDTType is returned for an operation on a key that holds a different type
+var errCRDTType = errors.New("Key holds a different type")
+
+// register is a single value held by a register
+type register struct {
+	Value     string
+	Timestamp time.Time      // When it was written, orders writes to an LWW register
+	Node      string         // Who wrote it, breaks timestamp ties in an LWW register
+	Clock     map[string]int // Writes per replica it has seen, orders values in an MV register
+}
+
+// crdtState is the value of a typed key. Only the fields for its type are used.
+type crdtState struct {
+	Type    string
+	Inc     map[string]int             // Counters: increments by each replica
+	Dec     map[string]int             // PN-counter: decrements by each replica
+	Elems   map[string]map[string]bool // OR-set: the add tags of each element
+	Removed map[string]bool            // OR-set: tags that have been removed
+	Regs    []register                 // Registers: the current value or values
+}
+
+// crdtOp is a single operation on a typed key
+type crdtOp struct {
+	Type    string // Type the key should hold, it's created as this type if it doesn't exist
+	Op      string // One of the crdt operation constants
+	Amount  int    // For counters
+	Element string // For sets
+	Value   string // For registers
+}
+
+// newCRDT returns an empty state of the given type
+func newCRDT(typ string) (*crdtState, error) {
+	switch typ {
+	case crdtGCounter, crdtPNCounter, crdtORSet, crdtLWWRegister, crdtMVRegister:
+	default:
+		return nil, errors.New("Unknown type " + typ)
+	}
+	c := crdtState{Type: typ}
+	return c.copy(), nil
+}
+
+// copy returns a deep copy of the state. Empty maps and slices always come out the
+// same way so that states can be compared after a trip through gob.
+func (c *crdtState) copy() *crdtState {
+	if c == nil {
+		return nil
+	}
+	n := crdtState{
+		Type:    c.Type,
+		Inc:     make(map[string]int),
+		Dec:     make(map[string]int),
+		Elems:   make(map[string]map[string]bool),
+		Removed: make(map[string]bool),
+	}
+	for k, v := range c.Inc {
+		n.Inc[k] = v
+	}
+	for k, v := range c.Dec {
+		n.Dec[k] = v
+	}
+	for e, tags := range c.Elems {
+		n.Elems[e] = make(map[string]bool, len(tags))
+		for t := range tags {
+			n.Elems[e][t] = true
+		}
+	}
+	for t := range c.Removed {
+		n.Removed[t] = true
+	}
+	for _, r := range c.Regs {
+		clock := make(map[string]int, len(r.Clock))
+		for k, v := range r.Clock {
+			clock[k] = v
+		}
+		r.Clock = clock
+		n.Regs = append(n.Regs, r)
+	}
+	return &n
+}
+
+// apply performs an operation on behalf of node, the state is changed in place
+func (c *crdtState) apply(op crdtOp, node string, now time.Time) error {
+	switch {
+	case (c.Type == crdtGCounter || c.Type == crdtPNCounter) && op.Op == crdtIncrement:
+		if op.Amount < 1 {
+			return errors.New("Amount must be positive")
+		}
+		c.Inc[node] += op.Amount
+	case c.Type == crdtPNCounter && op.Op == crdtDecrement:
+		if op.Amount < 1 {
+			return errors.New("Amount must be positive")
+		}
+		c.Dec[node] += op.Amount
+	case c.Type == crdtORSet && op.Op == crdtAdd:
+		if op.Element == "" {
+			return errors.New("Element must not be empty")
+		}
+		if c.Elems[op.Element] == nil {
+			c.Elems[op.Element] = make(map[string]bool)
+		}
+		c.Elems[op.Element][node+"/"+strconv.FormatInt(now.UnixNano(), 10)] = true
+	case c.Type == crdtORSet && op.Op == crdtRemove:
+		// Only the adds we've seen are removed, a concurrent add elsewhere survives
+		for t := range c.Elems[op.Element] {
+			c.Removed[t] = true
+		}
+		delete(c.Elems, op.Element)
+	case c.Type == crdtLWWRegister && op.Op == crdtAssign:
+		c.Regs = []register{{Value: op.Value, Timestamp: now, Node: node, Clock: map[string]int{}}}
+	case c.Type == crdtMVRegister && op.Op == crdtAssign:
+		// The new value has seen every value it replaces
+		clock := make(map[string]int)
+		for _, r := range c.Regs {
+			for k, v := range r.Clock {
+				if clock[k] < v {
+					clock[k] = v
+				}
+			}
+		}
+		clock[node]++
+		c.Regs = []register{{Value: op.Value, Timestamp: now, Node: node, Clock: clock}}
+	default:
+		return errors.New("Can't " + op.Op + " a " + c.Type)
+	}
+	return nil
+}
+
+// joinCRDT returns the least upper bound of two states of the same type
+func joinCRDT(a *crdtState, b *crdtState) *crdtState {
+	j := a.copy()
+	for k, v := range b.Inc {
+		if j.Inc[k] < v {
+			j.Inc[k] = v
+		}
+	}
+	for k, v := range b.Dec {
+		if j.Dec[k] < v {
+			j.Dec[k] = v
+		}
+	}
+
+	// An element survives with every tag either side added that neither side removed
+	for t := range b.Removed {
+		j.Removed[t] = true
+	}
+	for e, tags := range b.Elems {
+		if j.Elems[e] == nil {
+			j.Elems[e] = make(map[string]bool)
+		}
+		for t := range tags {
+			j.Elems[e][t] = true
+		}
+	}
+	for e, tags := range j.Elems {
+		for t := range tags {
+			if j.Removed[t] {
+				delete(tags, t)
+			}
+		}
+		if len(tags) == 0 {
+			delete(j.Elems, e)
+		}
+	}
+
+	regs := append(j.Regs, b.copy().Regs...)
+	switch j.Type {
+	case crdtLWWRegister:
+		j.Regs = nil
+		for _, r := range regs {
+			if len(j.Regs) == 0 || laterRegister(r, j.Regs[0]) {
+				j.Regs = []register{r}
+			}
+		}
+	case crdtMVRegister:
+		j.Regs = nil
+		for i, r := range regs {
+			keep := true
+			for k, s := range regs {
+				dominated := descends(s.Clock, r.Clock) && !descends(r.Clock, s.Clock)
+				same := k < i && reflect.DeepEqual(s, r)
+				if dominated || same {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				j.Regs = append(j.Regs, r)
+			}
+		}
+		sort.Slice(j.Regs, func(x, y int) bool { return j.Regs[x].Value < j.Regs[y].Value })
+	}
+	return j
+}
+
+// laterRegister returns true if a was written after b, ties broken by node and value
+func laterRegister(a register, b register) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	if a.Node != b.Node {
+		return a.Node > b.Node
+	}
+	return a.Value > b.Value
+}
+
+// equalCRDT returns true if two states hold exactly the same information
+func equalCRDT(a *crdtState, b *crdtState) bool {
+	return reflect.DeepEqual(a.copy(), b.copy())
+}
+
+// digest returns a hash of everything the state holds. A merge gives its result a
+// timestamp derived from the two sides, so two replicas can hold different states at
+// the same timestamp, and anti-entropy compares digests to tell them apart. A nil
+// state, which is every untyped key, has a digest of 0.
+func (c *crdtState) digest() uint64 {
+	if c == nil {
+		return 0
+	}
+	d := c.copy()
+	regs := make([]string, 0, len(d.Regs))
+	for _, r := range d.Regs {
+		r.Timestamp = r.Timestamp.UTC()
+		b, _ := json.Marshal(r)
+		regs = append(regs, string(b))
+	}
+	sort.Strings(regs)
+	d.Regs = nil
+
+	h := fnv.New64a()
+	b, _ := json.Marshal(d)
+	h.Write(b)
+	for _, r := range regs {
+		h.Write([]byte(r))
+	}
+	return h.Sum64()
+}
+
+// render returns the value of the state the way a client sees it
+func (c *crdtState) render() interface{} {
+	switch c.Type {
+	case crdtGCounter, crdtPNCounter:
+		n := 0
+		for _, v := range c.Inc {
+			n += v
+		}
+		for _, v := range c.Dec {
+			n -= v
+		}
+		return n
+	case crdtORSet:
+		elems := []string{}
+		for e := range c.Elems {
+			elems = append(elems, e)
+		}
+		sort.Strings(elems)
+		return elems
+	case crdtLWWRegister:
+		if len(c.Regs) == 0 {
+			return ""
+		}
+		return c.Regs[0].Value
+	default:
+		vals := []string{}
+		for _, r := range c.Regs {
+			vals = append(vals, r.Value)
+		}
+		return vals
+	}
+}
+
+// String returns the rendered value as it's stored in Entry.Value
+func (c *crdtState) String() string {
+	switch v := c.render().(type) {
+	case int:
+		return strconv.Itoa(v)
+	case string:
+		return v
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// ApplyCRDT performs an operation on a typed key, creating it if it doesn't exist. It
+// returns the new state and the clock of the key merged with the client's payload.
+func (k *KVS) ApplyCRDT(key string, op crdtOp, timestamp time.Time, payload map[string]int) (*crdtState, map[string]int, error) {
+	if len(key) > maxKey || len(op.Value) > maxVal || len(op.Element) > maxVal {
+		return nil, nil, errors.New("Key or value too large")
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	alive, version := k.contains(key)
+	var state *crdtState
+	if alive {
+		state = k.db[key].GetCRDT().copy()
+		if state == nil || state.Type != op.Type {
+			return nil, nil, errCRDTType
+		}
+	} else {
+		var err error
+		if state, err = newCRDT(op.Type); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := state.apply(op, replicaID, timestamp); err != nil {
+		return nil, nil, err
+	}
+
+	// The operation has seen the state it was applied to
+	clock := copyClock(payload)
+	if alive {
+		clock = mergeClocks(clock, past(k.db[key]))
+	}
+
+	e := NewEntry(timestamp, clock, state.String(), version+1)
+	e.CRDT = state
+	k.archive(key, timestamp)
+	k.db[key] = e
+	k.index.Insert(key)
+	k.rehash(key)
+	delete(k.graveyard, key)
+	if err := k.logEntry(walPut, key); err != nil {
+		return nil, nil, err
+	}
+	return state.copy(), past(e), nil
+}
+
+// GetCRDT returns the state of a typed key, or nil if it holds a plain value or doesn't exist
+func (k *KVS) GetCRDT(key string) *crdtState {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if alive, _ := k.contains(key); !alive {
+		return nil
+	}
+	return k.db[key].GetCRDT().copy()
+}
+
+// sameCRDT returns true if both entries hold typed values of the same type
+func sameCRDT(a KeyEntry, b KeyEntry) bool {
+	ca, cb := a.GetCRDT(), b.GetCRDT()
+	return ca != nil && cb != nil && ca.Type == cb.Type
+}
+
+// mergeCRDT joins an incoming typed entry into the one we hold. It returns false if
+// ours already holds everything in it. Otherwise the entry returned is Alice's if the
+// join is exactly her state, so the same entry doesn't bounce back and forth in gossip,
+// or a new one holding the join.
+func mergeCRDT(key string, bob Entry, alice Entry) (Entry, bool) {
+	joined := joinCRDT(bob.CRDT, alice.CRDT)
+
+	clock := make(map[string]int)
+	for _, c := range []map[string]int{past(&bob), past(&alice)} {
+		for n, v := range c {
+			if clock[n] < v {
+				clock[n] = v
+			}
+		}
+	}
+	version := bob.Version
+	if alice.Version > version {
+		version = alice.Version
+	}
+
+	toAlice := equalCRDT(joined, alice.CRDT)
+	toBob := equalCRDT(joined, bob.CRDT)
+	if toBob && (!toAlice || !alice.Timestamp.After(bob.Timestamp)) {
+		return bob, false
+	}
+
+	e := Entry{Version: version, Clock: clock, Value: joined.String(), CRDT: joined, Node: alice.Node, Dot: alice.Dot}
+	e.Timestamp = alice.Timestamp
+	if !toAlice {
+		// A state neither side had, give it a timestamp neither side has and the dot
+		// of the later write, so both sides build the same entry
+		e.Timestamp = alice.Timestamp
+		if bob.Timestamp.After(e.Timestamp) {
+			e.Timestamp = bob.Timestamp
+		}
+		e.Timestamp = e.Timestamp.Add(time.Nanosecond)
+		if laterWrite(bob.Timestamp, bob.Node, alice.Timestamp, alice.Node) {
+			e.Node, e.Dot = bob.Node, bob.Dot
+		}
+	}
+	return e, true
+}
@@ -0,0 +1,183 @@
+// crdt_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for typed values
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// applyAs performs an operation on a KVS as if it were the replica at node
+func applyAs(t *testing.T, k *KVS, node string, op crdtOp) *crdtState {
+	replicaID = node
+	defer func() { replicaID = "" }()
+	state, _, err := k.ApplyCRDT(keyExists, op, time.Now(), map[string]int{})
+	ok(t, err)
+	return state
+}
+
+// gossipBoth sends each KVS's entries to the other
+func gossipBoth(a *KVS, b *KVS) {
+	ga := GossipVals{kvs: a, view: &TestView{view: testMain}}
+	gb := GossipVals{kvs: b, view: &TestView{view: testMain}}
+	fromA := a.GetEntryGlob(a.GetTimeGlob())
+	ga.UpdateKVS(b.GetEntryGlob(b.GetTimeGlob()))
+	gb.UpdateKVS(fromA)
+}
+
+func TestCounters(t *testing.T) {
+	c, err := newCRDT(crdtPNCounter)
+	ok(t, err)
+	ok(t, c.apply(crdtOp{Op: crdtIncrement, Amount: 5}, peerOne, time.Now()))
+	ok(t, c.apply(crdtOp{Op: crdtDecrement, Amount: 2}, peerTwo, time.Now()))
+	equals(t, 3, c.render())
+	equals(t, "3", c.String())
+
+	g, _ := newCRDT(crdtGCounter)
+	assert(t, g.apply(crdtOp{Op: crdtDecrement, Amount: 1}, peerOne, time.Now()) != nil, "G-counter went down")
+	assert(t, g.apply(crdtOp{Op: crdtIncrement, Amount: 0}, peerOne, time.Now()) != nil, "Zero increment accepted")
+}
+
+func TestORSetAddWinsOverConcurrentRemove(t *testing.T) {
+	a, _ := newCRDT(crdtORSet)
+	ok(t, a.apply(crdtOp{Op: crdtAdd, Element: valone}, peerOne, time.Now()))
+	b := a.copy()
+
+	// One replica removes the element while the other adds it again
+	ok(t, a.apply(crdtOp{Op: crdtRemove, Element: valone}, peerOne, time.Now()))
+	ok(t, b.apply(crdtOp{Op: crdtAdd, Element: valone}, peerTwo, time.Now()))
+	ok(t, b.apply(crdtOp{Op: crdtAdd, Element: valtwo}, peerTwo, time.Now()))
+
+	equals(t, []string{valone, valtwo}, joinCRDT(a, b).render())
+	assert(t, equalCRDT(joinCRDT(a, b), joinCRDT(b, a)), "Join isn't commutative")
+}
+
+func TestRegisters(t *testing.T) {
+	now := time.Now()
+	a, _ := newCRDT(crdtLWWRegister)
+	b := a.copy()
+	ok(t, a.apply(crdtOp{Op: crdtAssign, Value: valone}, peerOne, now))
+	ok(t, b.apply(crdtOp{Op: crdtAssign, Value: valtwo}, peerTwo, now.Add(time.Second)))
+	equals(t, valtwo, joinCRDT(a, b).render())
+	equals(t, valtwo, joinCRDT(b, a).render())
+
+	m, _ := newCRDT(crdtMVRegister)
+	ok(t, m.apply(crdtOp{Op: crdtAssign, Value: valExists}, peerOne, now))
+	n := m.copy()
+	ok(t, m.apply(crdtOp{Op: crdtAssign, Value: valone}, peerOne, now))
+	ok(t, n.apply(crdtOp{Op: crdtAssign, Value: valtwo}, peerTwo, now))
+	j := joinCRDT(m, n)
+	equals(t, []string{valone, valtwo}, j.render())
+
+	// Assigning after reading both replaces both
+	ok(t, j.apply(crdtOp{Op: crdtAssign, Value: valExists}, peerTwo, now))
+	equals(t, []string{valExists}, joinCRDT(j, m).render())
+}
+
+func TestCRDTConvergesThroughGossip(t *testing.T) {
+	a, b := NewKVS(), NewKVS()
+	applyAs(t, a, peerOne, crdtOp{Type: crdtPNCounter, Op: crdtIncrement, Amount: 3})
+	gossipBoth(a, b)
+
+	// Concurrent updates on both sides are both kept
+	applyAs(t, a, peerOne, crdtOp{Type: crdtPNCounter, Op: crdtIncrement, Amount: 2})
+	applyAs(t, b, peerTwo, crdtOp{Type: crdtPNCounter, Op: crdtDecrement, Amount: 1})
+	gossipBoth(a, b)
+
+	equals(t, 4, a.GetCRDT(keyExists).render())
+	equals(t, a.GetEntryGlob(a.GetTimeGlob()), b.GetEntryGlob(b.GetTimeGlob()))
+
+	// Once they agree nothing else changes hands
+	ts := a.GetTimestamp(keyExists)
+	gossipBoth(a, b)
+	equals(t, ts, a.GetTimestamp(keyExists))
+}
+
+func TestMergedStatesAtSameTimestampReconcile(t *testing.T) {
+	now := time.Now()
+	incrementAt := func(node string, ts time.Time) *KVS {
+		k := NewKVS()
+		replicaID = node
+		defer func() { replicaID = "" }()
+		_, _, err := k.ApplyCRDT(keyExists, crdtOp{Type: crdtGCounter, Op: crdtIncrement, Amount: 1}, ts, map[string]int{})
+		ok(t, err)
+		return k
+	}
+	a := incrementAt(testMain, now)
+	b := incrementAt(peerOne, now.Add(-time.Second))
+	c := incrementAt(peerTwo, now.Add(-time.Second))
+
+	// A joins B's increment and C joins A's, which leaves both holding a state neither
+	// had at the same timestamp, but with different increments in it
+	fromA := a.GetEntryGlob(a.GetTimeGlob())
+	ga := GossipVals{kvs: a, view: &TestView{view: testView}}
+	gc := GossipVals{kvs: c, view: &TestView{view: testView}}
+	ga.UpdateKVS(b.GetEntryGlob(b.GetTimeGlob()))
+	gc.UpdateKVS(fromA)
+	equals(t, a.GetTimestamp(keyExists), c.GetTimestamp(keyExists))
+	assert(t, a.MerkleHashes([]int{1})[0] != c.MerkleHashes([]int{1})[0], "Different states hashed the same")
+
+	// One session brings them together
+	all := []int{1}
+	sent := a.GetLeafGlob(all)
+	resp := gc.Answer(syncRequest{From: testMain, Leaves: all, Times: sent})
+	eg, _ := ga.reply(viewExist, sent, resp)
+	gc.Receive(eg)
+	equals(t, 3, a.GetCRDT(keyExists).render())
+	equals(t, 3, c.GetCRDT(keyExists).render())
+	equals(t, a.MerkleHashes(all), c.MerkleHashes(all))
+}
+
+func TestCRDTWrongType(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	_, _, err := k.ApplyCRDT(keyExists, crdtOp{Type: crdtGCounter, Op: crdtIncrement, Amount: 1}, time.Now(), map[string]int{})
+	equals(t, errCRDTType, err)
+
+	// Plain keys are untouched, and a PUT turns a typed key back into a plain one
+	val, _ := k.Get(keyExists, map[string]int{})
+	equals(t, valExists, val)
+	_, _, err = k.ApplyCRDT(keyone, crdtOp{Type: crdtORSet, Op: crdtAdd, Element: valone}, time.Now(), map[string]int{})
+	ok(t, err)
+	k.Put(keyone, valtwo, time.Now(), map[string]int{})
+	assert(t, k.GetCRDT(keyone) == nil, "PUT kept the typed value")
+}
+
+func TestCRDTSurvivesRestart(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	applyAs(t, k, peerOne, crdtOp{Type: crdtORSet, Op: crdtAdd, Element: valone})
+	ok(t, k.Close())
+
+	r := NewKVS()
+	defer r.Close()
+	equals(t, []string{valone}, r.GetCRDT(keyExists).render())
+	val, _ := r.Get(keyExists, map[string]int{})
+	equals(t, `["Value One"]`, val)
+}
+
+func TestCounterSurvivesRestartWithoutData(t *testing.T) {
+	// The node counted to 5 before it went down and lost its data
+	before := NewKVS()
+	applyAs(t, before, peerOne+"@1", crdtOp{Type: crdtGCounter, Op: crdtIncrement, Amount: 5})
+
+	// It comes back empty under a new name and counts again before gossip catches it up
+	after := NewKVS()
+	applyAs(t, after, peerOne+"@2", crdtOp{Type: crdtGCounter, Op: crdtIncrement, Amount: 2})
+	gossipBoth(before, after)
+
+	equals(t, 7, before.GetCRDT(keyExists).render())
+	equals(t, 7, after.GetCRDT(keyExists).render())
+}
@@ -24,23 +24,84 @@ type dbAccess interface {
 	Get(string, map[string]int) (string, map[string]int)
 
 	// Delete removes a key-value pair from the object. If the key does not exist it returns false.
-	Delete(string, time.Time, map[string]int) bool
+	Delete(string, time.Time, map[string]int) (bool, error)
 
 	// Put adds a key-value pair to the data store. If the key already exists, then it overwrites the existing value. If the key does not exist then it is added.
-	Put(string, string, time.Time, map[string]int) bool
+	Put(string, string, time.Time, map[string]int) (bool, error)
 
-	// Returns an entry's vector clock
+	// PutWithExpiry is Put for a key that expires at the given time
+	PutWithExpiry(string, string, time.Time, map[string]int, time.Time) (bool, error)
+
+	// CompareAndPut is PutWithExpiry that only writes if the key matches the condition.
+	// It returns whether it wrote, the version and clock the key had, and an error if the write couldn't be logged.
+	CompareAndPut(string, string, time.Time, map[string]int, time.Time, casCondition) (bool, int, map[string]int, error)
+
+	// Applies a batch of puts and deletes atomically, returning the result of each and the new payload
+	Batch([]batchOp, time.Time, map[string]int) ([]batchResult, map[string]int, error)
+
+	// Returns every version of a key this replica still holds, oldest first
+	History(string) []Entry
+
+	// Returns the concurrent values of a key, nil if it only has one
+	GetSiblings(string) []sibling
+
+	// Performs an operation on a typed key, returning its new state and the new payload
+	ApplyCRDT(string, crdtOp, time.Time, map[string]int) (*crdtState, map[string]int, error)
+
+	// Returns the typed value of a key, nil if it holds a plain string
+	GetCRDT(string) *crdtState
+
+	// Returns the causal context an entry was written with
 	GetClock(string) map[string]int
 
 	// Returns an entry's timestamp
 	GetTimestamp(string) time.Time
 
+	// Returns the node that made the last write to a key
+	GetNode(string) string
+
+	// Returns the counter of the last write to a key on its node
+	GetDot(string) int
+
 	// Overwrite the existing entry for this key with the one provided
 	OverwriteEntry(string, KeyEntry)
 
+	// Overwrite every entry in the entryGlob at once
+	OverwriteEntries(entryGlob)
+
 	// Returns a timeGlob struct of all of the keys in the db
 	GetTimeGlob() timeGlob
 
+	// Returns a copy of a key's entry read all at once, nil if it's never been written
+	GetEntry(string) *Entry
+
 	// Returns an entryGlob struct of all of the keys in the given timeGlob
 	GetEntryGlob(timeGlob) entryGlob
+
+	// Returns the hashes of the given nodes of the Merkle tree over the keys
+	MerkleHashes([]int) []uint64
+
+	// Returns a timeGlob struct of the keys under the given nodes of the Merkle tree
+	GetLeafGlob([]int) timeGlob
+
+	// Returns a page of live keys in lexical order that match the query
+	Range(rangeQuery, map[string]int) rangeResult
+
+	// Writes a snapshot of the data store and compacts its log
+	Snapshot() error
+
+	// Records that a peer holds the keys in the timeGlob at those timestamps
+	AckTombstones(string, timeGlob)
+
+	// Records that a peer holds the keys under the nodes of the Merkle tree that matched
+	AckMerkle(string, map[int]uint64)
+
+	// Purges tombstones that every given peer has seen, returns the number purged
+	CollectTombstones([]string, []string) int
+
+	// Returns the number of live keys
+	Count() int
+
+	// Drops the keys in the timeGlob that are still at those timestamps, returns the number dropped
+	Forget(timeGlob) int
 }
@@ -0,0 +1,247 @@
+// decommission.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines how a node leaves the cluster without losing any writes. Removing a node
+// from the view only stops the others from talking to it, and anything written there
+// that hadn't spread yet is lost along with it. A node told to decommission instead
+// stops taking writes, then runs anti-entropy with each live peer until the root of
+// the peer's Merkle tree matches its own, which means the peer holds everything it
+// does. Once every peer has caught up it sends the view without itself to the rest
+// of the cluster and shuts down.
+//
+// When keys are partitioned a peer only holds the keys it owns, so its tree never
+// matches ours. The node instead sends each of its keys to the key's owners in the
+// view without it, the same way keys are moved when the view changes, until every
+// owner has taken them.
+//
+// If a peer can't be brought level before the timeout the node gives up, starts
+// taking writes again and stays in the view.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// leaving is 1 while the node is handing off its data
+var leaving int32
+
+// startLeaving marks the node as leaving, and returns false if it already was
+func startLeaving() bool {
+	return atomic.CompareAndSwapInt32(&leaving, 0, 1)
+}
+
+// stopLeaving marks the node as staying after all
+func stopLeaving() {
+	atomic.StoreInt32(&leaving, 0)
+}
+
+// isLeaving returns true while the node is handing off its data
+func isLeaving() bool {
+	return atomic.LoadInt32(&leaving) == 1
+}
+
+// whenWritable refuses writes to the key-value store with a 503 while the node is
+// leaving, since they'd have to be handed off again. Reads are still served.
+func whenWritable(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLeaving() && r.Method != http.MethodGet && strings.HasPrefix(r.URL.Path, rootURL) {
+			log.Println("Refusing write while decommissioning")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable) // code 503
+			resp := map[string]interface{}{
+				"result": "Error",
+				"msg":    "Node is decommissioning",
+			}
+			body, err := json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+			w.Write(body)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Decommission hands our data off to every live peer and then tells them we've left.
+// The caller has to have stopped writes already.
+func (g *GossipVals) Decommission() error {
+	peers := g.live()
+	if len(peers) == 0 {
+		return errors.New("No live peers to hand off to")
+	}
+
+	deadline := time.Now().Add(decommissionTimeout)
+	var err error
+	if partitioned() {
+		err = g.handOffKeys(deadline)
+	} else {
+		err = g.handOff(peers, deadline)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Everyone has our data, so we can leave the view
+	rest := g.peers()
+	g.view.Remove(g.view.Primary())
+	v := g.view.State()
+	for _, bob := range rest {
+		err := sendView(bob, v)
+		if err != nil {
+			log.Println("Error telling "+bob+" we're leaving: ", err)
+		}
+	}
+	viewChange = false
+	log.Println("Left the view")
+	return nil
+}
+
+// handOff runs anti-entropy with each peer until its keyspace matches ours, giving up
+// at the deadline
+func (g *GossipVals) handOff(peers []string, deadline time.Time) error {
+	left := append([]string(nil), peers...)
+	for {
+		var behind []string
+		for _, bob := range left {
+			synced, err := g.syncRound(bob)
+			if err != nil {
+				log.Println("Error handing off to "+bob+": ", err)
+			}
+			if synced {
+				log.Println("Handed off to " + bob)
+			} else {
+				behind = append(behind, bob)
+			}
+		}
+		left = behind
+		if len(left) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("Peers still behind after %v: %v", decommissionTimeout, left)
+		}
+		time.Sleep(decommissionPoll)
+	}
+}
+
+// handOffKeys sends every key we hold to its owners in the view without us, and sends
+// what they haven't taken again until they've taken everything, giving up at the
+// deadline
+func (g *GossipVals) handOffKeys(deadline time.Time) error {
+	rest := without(g.view.List(), g.view.Primary())
+	left := make(map[string]timeGlob)
+	for key, ts := range g.kvs.GetTimeGlob().List {
+		for _, o := range ring.Owners(key, rest) {
+			if _, ok := left[o]; !ok {
+				left[o] = timeGlob{List: make(map[string]time.Time)}
+			}
+			left[o].List[key] = ts
+		}
+	}
+
+	// The answer reader of a migrate session can still be marking keys taken after
+	// sendMigrate has given up on it, so what's left is only touched under the lock
+	var mutex sync.Mutex
+	for {
+		for owner, tg := range left {
+			mutex.Lock()
+			sent := timeGlob{List: make(map[string]time.Time, len(tg.List))}
+			for k, t := range tg.List {
+				sent.List[k] = t
+			}
+			mutex.Unlock()
+			err := g.sendMigrate(owner, sent, func(keys map[string]time.Time) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				for k := range keys {
+					delete(tg.List, k)
+				}
+			})
+			if err != nil {
+				log.Println("Error handing off to "+owner+": ", err)
+			}
+			mutex.Lock()
+			handed := len(tg.List) == 0
+			mutex.Unlock()
+			if handed {
+				log.Println("Handed off to " + owner)
+				delete(left, owner)
+			}
+		}
+		if len(left) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			var behind []string
+			for owner := range left {
+				behind = append(behind, owner)
+			}
+			return errors.Errorf("Owners still missing keys after %v: %v", decommissionTimeout, behind)
+		}
+		time.Sleep(decommissionPoll)
+	}
+}
+
+// DecommissionHandler responds to PUT requests on the /node/decommission endpoint. It
+// hands the node's data off to its peers, leaves the view and shuts the node down.
+func (app *App) DecommissionHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /node/decommission PUT request")
+
+	var body []byte
+	var err error
+	var resp map[string]interface{}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !startLeaving() {
+		w.WriteHeader(http.StatusConflict) // code 409
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    "Node is already decommissioning",
+		}
+	} else if err = app.gossip.Decommission(); err != nil {
+		log.Println("Error decommissioning: ", err)
+		stopLeaving()
+		w.WriteHeader(http.StatusServiceUnavailable) // code 503
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    err.Error(),
+		}
+	} else {
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result": "Success",
+			"msg":    "Node decommissioned",
+		}
+	}
+	body, err = json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+
+	// Make sure the client hears back before we go
+	if resp["result"] == "Success" && app.stop != nil {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go app.stop()
+	}
+}
@@ -0,0 +1,102 @@
+// decommission_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for decommissioning a node
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWhenWritableRefusesWritesWhileLeaving(t *testing.T) {
+	h := whenWritable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	assert(t, startLeaving(), "Node was already leaving")
+	assert(t, !startLeaving(), "Node started leaving twice")
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPost} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, rootURL+"/subject", nil))
+		equals(t, http.StatusServiceUnavailable, rec.Code)
+	}
+
+	// Reads are still served while the data is handed off
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, rootURL+"/subject", nil))
+	equals(t, http.StatusOK, rec.Code)
+
+	stopLeaving()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, rootURL+"/subject", nil))
+	equals(t, http.StatusOK, rec.Code)
+}
+
+func TestDecommissionNeedsLivePeers(t *testing.T) {
+	g := GossipVals{kvs: NewKVS(), view: NewView(testMain, testMain)}
+	assert(t, g.Decommission() != nil, "Decommissioned with nobody to hand off to")
+
+	// Dead peers can't take our data either
+	g.view = NewView(testMain, testMain+","+viewExist)
+	members.Merge(map[string]memberState{viewExist: {Status: statusDead}})
+	defer func() { members = memberList{} }()
+	assert(t, g.Decommission() != nil, "Decommissioned with only dead peers")
+	assert(t, g.view.Contains(testMain), "Node left the view without handing off")
+}
+
+func TestDecommissionHandlerStaysOnFailure(t *testing.T) {
+	stopped := false
+	app := App{
+		db:     NewKVS(),
+		gossip: &GossipVals{kvs: NewKVS(), view: NewView(testMain, testMain)},
+		stop:   func() { stopped = true },
+	}
+
+	rec := httptest.NewRecorder()
+	app.DecommissionHandler(rec, httptest.NewRequest(http.MethodPut, node+decommissionSuffix, nil))
+	equals(t, http.StatusServiceUnavailable, rec.Code)
+	assert(t, !isLeaving(), "Node still refuses writes after failing to leave")
+	assert(t, !stopped, "Node shut down after failing to leave")
+
+	// A second request while one is running is turned away
+	startLeaving()
+	defer stopLeaving()
+	rec = httptest.NewRecorder()
+	app.DecommissionHandler(rec, httptest.NewRequest(http.MethodPut, node+decommissionSuffix, nil))
+	equals(t, http.StatusConflict, rec.Code)
+}
+
+func TestTakeFromLeavingSenderUsesViewWithoutIt(t *testing.T) {
+	defer withReplicas(1)()
+	k := NewKVS()
+	g := GossipVals{kvs: k, view: NewView(viewExist, testView)}
+
+	// A key that's the sender's now, and ours once it's gone
+	members := strings.Split(testView, ",")
+	var key string
+	for i := 0; key == ""; i++ {
+		s := "subject" + strconv.Itoa(i)
+		if ring.Owns(testMain, s, members) && ring.Owns(viewExist, s, without(members, testMain)) {
+			key = s
+		}
+	}
+	entries := entryGlob{Keys: map[string]Entry{
+		key: {Version: 1, Timestamp: time.Now(), Value: valone, Clock: map[string]int{}},
+	}}
+
+	equals(t, 0, len(g.take(migrateRequest{Entries: entries}).Keys))
+	equals(t, []string{key}, g.take(migrateRequest{Entries: entries, Leaving: testMain}).Keys)
+	assert(t, g.view.Contains(testMain), "Taking keys from a leaving node changed the view")
+}
@@ -0,0 +1,171 @@
+// delta.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines push gossip of recent mutations. Every write to the KVS, whether it came
+// from a client or from a peer, is put in a bounded buffer of deltas, and the push loop
+// sends them to a few random peers as soon as they show up, so a write reaches the
+// rest of the view in milliseconds instead of waiting for the next anti-entropy round.
+//
+// Deltas spread like rumors. Each one is pushed for a few rounds and then retired, and
+// a peer that receives one only passes it on if it won conflict resolution, which is
+// to say if it was news to the peer. A rumor stops spreading once everyone has heard
+// it. Deltas that are dropped because the buffer filled up, or pushes that fail, are
+// caught up by anti-entropy, which is still the backstop.
+//
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// delta is a recent mutation of a key waiting to be pushed
+type delta struct {
+	entry Entry  // State of the key after the mutation
+	left  int    // Pushes left before the delta is retired
+	seq   uint64 // Order the delta was added in, the oldest is dropped when the buffer is full
+}
+
+// deltaBuffer holds the mutations that are still being pushed to peers
+type deltaBuffer struct {
+	mutex   sync.Mutex
+	pending map[string]delta // Newest mutation of each key
+	size    int              // Most deltas held at once
+	seq     uint64
+	ready   chan struct{} // Signalled when a delta is added
+}
+
+// newDeltaBuffer creates an empty buffer that holds up to size deltas
+func newDeltaBuffer(size int) *deltaBuffer {
+	return &deltaBuffer{
+		pending: make(map[string]delta),
+		size:    size,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Add puts the new state of a key in the buffer, replacing any delta for it that's
+// still pending. If the buffer is full the oldest delta is dropped.
+func (b *deltaBuffer) Add(key string, e Entry) {
+	if b == nil || b.size <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	if _, ok := b.pending[key]; !ok && len(b.pending) >= b.size {
+		b.dropOldest()
+	}
+	b.seq++
+	b.pending[key] = delta{entry: e, left: deltaRounds, seq: b.seq}
+	b.mutex.Unlock()
+
+	// Wake the push loop, unless it's already been woken
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dropOldest drops the delta that was added first, the caller must hold the lock
+func (b *deltaBuffer) dropOldest() {
+	oldest := ""
+	for key, d := range b.pending {
+		if oldest == "" || d.seq < b.pending[oldest].seq {
+			oldest = key
+		}
+	}
+	log.Println("Delta buffer full, leaving key to anti-entropy: ", oldest)
+	delete(b.pending, oldest)
+}
+
+// Take returns the deltas for the next round of pushes, retiring those that have been
+// pushed enough times
+func (b *deltaBuffer) Take() entryGlob {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	eg := entryGlob{Keys: make(map[string]Entry, len(b.pending))}
+	for key, d := range b.pending {
+		eg.Keys[key] = d.entry
+		d.left--
+		if d.left <= 0 {
+			delete(b.pending, key)
+		} else {
+			b.pending[key] = d
+		}
+	}
+	return eg
+}
+
+// Ready returns a channel that's signalled when there are deltas to push
+func (b *deltaBuffer) Ready() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.ready
+}
+
+// PushLoop pushes recent mutations to peers as soon as they're made, for as many
+// rounds as they stay in the buffer
+func (g *GossipVals) PushLoop() {
+	log.Println("Push loop starts...")
+	for range g.deltas.Ready() {
+		for {
+			// Give writes that arrive together the chance to go out together
+			time.Sleep(deltaPushDelay)
+			eg := g.deltas.Take()
+			if len(eg.Keys) == 0 {
+				break
+			}
+			for bob, part := range g.pushTargets(eg) {
+				if err := sendEntryGlob(bob, part); err != nil {
+					log.Println("Error pushing deltas: ", err)
+				}
+			}
+		}
+	}
+}
+
+// pushTargets returns the peers to push a batch of deltas to, along with the part of
+// the batch each one gets. Unpartitioned, a few random peers get all of it. Otherwise
+// every reachable peer that owns some of the keys gets those keys.
+func (g *GossipVals) pushTargets(eg entryGlob) map[string]entryGlob {
+	targets := make(map[string]entryGlob)
+	peers := g.reachable()
+	if !partitioned() {
+		for _, bob := range first(shuffled(peers), deltaFanout) {
+			targets[bob] = eg
+		}
+		return targets
+	}
+	members := g.view.List()
+	for _, bob := range peers {
+		for key, e := range eg.Keys {
+			if !ring.Owns(bob, key, members) {
+				continue
+			}
+			if _, ok := targets[bob]; !ok {
+				targets[bob] = entryGlob{Keys: make(map[string]Entry)}
+			}
+			targets[bob].Keys[key] = e
+		}
+	}
+	return targets
+}
+
+// spread puts the current state of a key in the delta buffer, if there is one and
+// the node isn't still being filled by a seed. The caller must hold the write lock.
+func (k *KVS) spread(key string) {
+	if k.deltas == nil || !isReady() {
+		return
+	}
+	if e, ok := k.db[key]; ok {
+		k.deltas.Add(key, toEntry(e))
+	}
+}
@@ -0,0 +1,94 @@
+// delta_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for push gossip of recent mutations
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeltaBufferRetiresAfterRounds(t *testing.T) {
+	b := newDeltaBuffer(10)
+	b.Add(keyone, Entry{Value: valone})
+
+	for i := 0; i < deltaRounds; i++ {
+		eg := b.Take()
+		equals(t, valone, eg.Keys[keyone].Value)
+	}
+	equals(t, 0, len(b.Take().Keys))
+}
+
+func TestDeltaBufferKeepsNewest(t *testing.T) {
+	b := newDeltaBuffer(10)
+	b.Add(keyone, Entry{Value: valone})
+	b.Take()
+	b.Add(keyone, Entry{Value: valtwo})
+
+	// The newer write replaces the pending one and is pushed for the full number of rounds
+	for i := 0; i < deltaRounds; i++ {
+		eg := b.Take()
+		equals(t, 1, len(eg.Keys))
+		equals(t, valtwo, eg.Keys[keyone].Value)
+	}
+}
+
+func TestDeltaBufferDropsOldest(t *testing.T) {
+	b := newDeltaBuffer(2)
+	b.Add(keyone, Entry{Value: valone})
+	b.Add(keyExists, Entry{Value: valExists})
+	b.Add(keyNotHere, Entry{Value: valtwo})
+
+	eg := b.Take()
+	equals(t, 2, len(eg.Keys))
+	_, found := eg.Keys[keyone]
+	assert(t, !found, "Oldest delta wasn't dropped")
+}
+
+func TestDeltaBufferSignalsReady(t *testing.T) {
+	b := newDeltaBuffer(10)
+	b.Add(keyone, Entry{Value: valone})
+	b.Add(keyExists, Entry{Value: valExists})
+
+	select {
+	case <-b.Ready():
+	default:
+		t.Fatal("Buffer didn't signal a delta")
+	}
+}
+
+func TestWritesAreSpread(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyone, valone, time.Now(), map[string]int{})
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	k.Delete(keyExists, time.Now(), map[string]int{})
+
+	eg := k.deltas.Take()
+	equals(t, valone, eg.Keys[keyone].Value)
+	assert(t, eg.Keys[keyExists].Tombstone, "Delete wasn't spread")
+
+	// Purging a tombstone isn't news to anyone
+	k.deltas = newDeltaBuffer(10)
+	equals(t, 1, k.CollectTombstones(nil, nil))
+	equals(t, 0, len(k.deltas.Take().Keys))
+}
+
+func TestUnchangedMergeIsNotSpread(t *testing.T) {
+	k := NewKVS()
+	_, _, err := k.ApplyCRDT(keyone, crdtOp{Type: crdtGCounter, Op: crdtIncrement, Amount: 1}, time.Now(), map[string]int{})
+	ok(t, err)
+	e := toEntry(k.db[keyone])
+
+	// Gossip bringing back a state we already have doesn't start a new rumor
+	k.deltas = newDeltaBuffer(10)
+	k.OverwriteEntries(entryGlob{Keys: map[string]Entry{keyone: e}})
+	equals(t, 0, len(k.deltas.Take().Keys))
+}
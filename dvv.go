@@ -0,0 +1,199 @@
+// dvv.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the dotted version vectors that track causality between writes. Every write
+// made on a replica gets a dot: the ID of the replica and the next value of a counter
+// that replica keeps. An entry stores its dot, as its Node and Dot, next to its clock,
+// which is the causal context the write was made with: a version vector keyed by
+// replica holding the newest dot the client had seen from each one. Clocks and
+// payloads hold one number per replica, however many keys a client touches.
+//
+// Keeping the dot out of the context is what lets two writes made on the same replica
+// by clients that hadn't seen each other be told apart as concurrent. A write has seen
+// another exactly when its context covers the other's dot. Since a context only keeps
+// the newest dot from each replica, having seen a write means having seen every write
+// made before it on the same replica, whichever key it was to.
+//
+// The client's payload is its causal context. Every response hands it back joined
+// with what the client was shown, and a replica refuses to answer a client whose
+// payload holds a dot it hasn't seen, since it would be showing the client a past
+// older than the one it already knows about.
+//
+// Gossip doesn't hand writes over in the order they were made, so seeing a replica's
+// dot n doesn't mean having seen every dot before it. A replica only counts dots from
+// another one as seen up to the end of the run it holds without a gap, and keeps the
+// ones past a gap aside until it fills. A dot whose write was overwritten before it
+// got here never arrives on its own, so those gaps are filled by anti-entropy: once a
+// sync round with a peer has taken everything the peer held, we've seen every dot the
+// peer had seen when the round started.
+//
+// When keys are partitioned, a replica never sees the dots of writes to keys it
+// doesn't own, so the check for a key only goes over the dots of the key's owners.
+// Anti-entropy with a peer in the same shard brings in every dot the peer had seen,
+// since they hold the same keys. Replicas whose owner groups overlap without lining
+// up only take the peer's own dots, as the rest may be on keys they don't hold.
+//
+
+package main
+
+import (
+	"sync"
+)
+
+// dotClock issues the dots of the writes made on this replica and remembers which
+// dots it has seen from every replica
+type dotClock struct {
+	mutex sync.Mutex
+	seen  map[string]int          // Every dot up to this one has been seen, per replica, our own included
+	ahead map[string]map[int]bool // Dots seen past a gap in seen, per replica
+}
+
+// dots is the clock every write on this replica gets its dot from
+var dots dotClock
+
+// Next returns the counter for a new write made on this replica
+func (c *dotClock) Next() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]int)
+		c.ahead = make(map[string]map[int]bool)
+	}
+	c.seen[myIP]++
+	return c.seen[myIP]
+}
+
+// Observe records a dot made on a replica. A dot of our own from before a restart
+// moves our counter past it so it's never issued twice.
+func (c *dotClock) Observe(node string, counter int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]int)
+		c.ahead = make(map[string]map[int]bool)
+	}
+	if counter <= c.seen[node] {
+		return
+	}
+	// Every write we made is in the KVS or was overwritten there
+	if node == myIP {
+		c.seen[node] = counter
+		return
+	}
+	if c.ahead[node] == nil {
+		c.ahead[node] = make(map[int]bool)
+	}
+	c.ahead[node][counter] = true
+	c.advance(node)
+}
+
+// Merge records every dot a peer had seen, once we hold everything the peer held
+func (c *dotClock) Merge(frontier map[string]int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]int)
+		c.ahead = make(map[string]map[int]bool)
+	}
+	for node, v := range frontier {
+		if node == myIP || v <= c.seen[node] {
+			continue
+		}
+		c.seen[node] = v
+		for d := range c.ahead[node] {
+			if d <= v {
+				delete(c.ahead[node], d)
+			}
+		}
+		c.advance(node)
+	}
+}
+
+// advance moves a replica's seen counter over the dots past it that have filled in
+func (c *dotClock) advance(node string) {
+	for c.ahead[node][c.seen[node]+1] {
+		c.seen[node]++
+		delete(c.ahead[node], c.seen[node])
+	}
+	if len(c.ahead[node]) == 0 {
+		delete(c.ahead, node)
+	}
+}
+
+// Frontier returns a copy of the dot counters up to which we've seen every dot
+func (c *dotClock) Frontier() map[string]int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return copyClock(c.seen)
+}
+
+// ObserveEntry records the dot of every value an entry holds
+func (c *dotClock) ObserveEntry(e KeyEntry) {
+	for _, s := range siblingsOf(toEntry(e)) {
+		c.Observe(s.Node, s.Dot)
+	}
+}
+
+// Covers returns true if we've seen every dot in a client's payload made by one of the
+// given replicas, or by any replica if owners is nil. A replica only sees the dots of
+// writes to the keys it owns, and only the owners of a key ever write it, so a check
+// for a key only goes over the dots of its owners.
+func (c *dotClock) Covers(payload map[string]int, owners []string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for node, v := range payload {
+		if owners != nil && !contains(owners, node) {
+			continue
+		}
+		if c.seen[node] < v {
+			return false
+		}
+	}
+	return true
+}
+
+// past returns the causal history of an entry: its context joined with its own dot
+func past(e KeyEntry) map[string]int {
+	clock := copyClock(e.GetClock())
+	if node, dot := e.GetNode(), e.GetDot(); clock[node] < dot {
+		clock[node] = dot
+	}
+	return clock
+}
+
+// copyClock returns a copy of a clock that's safe to change
+func copyClock(clock map[string]int) map[string]int {
+	c := make(map[string]int, len(clock)+1)
+	for node, v := range clock {
+		c[node] = v
+	}
+	return c
+}
+
+// covers returns true if a causal context has seen every value the entry holds
+func covers(ctx map[string]int, e KeyEntry) bool {
+	for _, s := range siblingsOf(toEntry(e)) {
+		if ctx[s.Node] < s.Dot {
+			return false
+		}
+	}
+	return true
+}
+
+// seen returns true if entry a has seen everything entry b holds. A value has always
+// seen itself, which is the only way a write's context can hold its own dot.
+func seen(a KeyEntry, b KeyEntry) bool {
+	ctx := a.GetClock()
+	for _, s := range siblingsOf(toEntry(b)) {
+		if ctx[s.Node] < s.Dot && (s.Node != a.GetNode() || s.Dot != a.GetDot()) {
+			return false
+		}
+	}
+	return true
+}
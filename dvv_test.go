@@ -0,0 +1,118 @@
+// dvv_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for dotted version vectors
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDotClockCovers(t *testing.T) {
+	var c dotClock
+	c.Observe("10.0.0.1:8080", 1)
+	c.Observe("10.0.0.1:8080", 3)
+
+	assert(t, c.Covers(map[string]int{}, nil), "Empty payload isn't covered")
+	assert(t, c.Covers(map[string]int{"10.0.0.1:8080": 1}, nil), "Observed dot isn't covered")
+	assert(t, !c.Covers(map[string]int{"10.0.0.1:8080": 3}, nil), "Dot past a gap is covered")
+	assert(t, !c.Covers(map[string]int{"10.0.0.2:8080": 1}, nil), "Dot from an unseen replica is covered")
+
+	// Once the gap fills, the dots past it count too
+	c.Observe("10.0.0.1:8080", 2)
+	assert(t, c.Covers(map[string]int{"10.0.0.1:8080": 3}, nil), "Filled gap isn't covered")
+	assert(t, !c.Covers(map[string]int{"10.0.0.1:8080": 4}, nil), "Newer dot is covered")
+}
+
+func TestDotClockMergeFillsGaps(t *testing.T) {
+	var c dotClock
+	c.Observe("10.0.0.1:8080", 2)
+	c.Observe("10.0.0.1:8080", 5)
+
+	// Dot 1 was overwritten before it got here, a peer that had seen it fills the gap
+	c.Merge(map[string]int{"10.0.0.1:8080": 3})
+	equals(t, map[string]int{"10.0.0.1:8080": 3}, c.Frontier())
+	c.Observe("10.0.0.1:8080", 4)
+	equals(t, map[string]int{"10.0.0.1:8080": 5}, c.Frontier())
+}
+
+func TestDotClockNextSkipsObserved(t *testing.T) {
+	var c dotClock
+	equals(t, 1, c.Next())
+
+	// A dot of our own from before a restart is never issued again
+	c.Observe(myIP, 7)
+	equals(t, 8, c.Next())
+}
+
+func TestSeenGoesByDot(t *testing.T) {
+	now := time.Now()
+	a := &Entry{Timestamp: now, Clock: map[string]int{}, Node: viewExist, Dot: 1}
+	b := &Entry{Timestamp: now, Clock: map[string]int{}, Node: viewExist, Dot: 2}
+	assert(t, !seen(a, b) && !seen(b, a), "Blind writes on one replica have seen each other")
+
+	c := &Entry{Timestamp: now, Clock: past(b), Node: testMain, Dot: 1}
+	assert(t, seen(c, b) && !seen(b, c), "Write with context hasn't seen the value it read")
+	assert(t, seen(c, a), "Write hasn't seen an earlier dot from the replica it read from")
+	assert(t, seen(a, a), "Write hasn't seen itself")
+	assert(t, covers(past(c), b), "Causal history doesn't cover the value read")
+}
+
+func TestPayloadStaysBounded(t *testing.T) {
+	k := NewKVS()
+	payload := map[string]int{}
+	for i := 0; i < 100; i++ {
+		key := keyone + strconv.Itoa(i)
+		k.Put(key, valone, time.Now(), copyClock(payload))
+		_, payload = k.Get(key, payload)
+	}
+
+	// One entry per replica however many keys the client touched
+	equals(t, 1, len(payload))
+	equals(t, 1, len(k.GetClock(keyone+"99")))
+	assert(t, dots.Covers(payload, nil), "Replica hasn't seen its own writes")
+}
+
+func TestDotsSurviveRestart(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{viewExist: 2})
+	ok(t, k.Close())
+
+	r := NewKVS()
+	defer r.Close()
+	equals(t, k.GetNode(keyExists), r.GetNode(keyExists))
+	equals(t, k.GetDot(keyExists), r.GetDot(keyExists))
+	equals(t, map[string]int{viewExist: 2}, r.GetClock(keyExists))
+}
+
+func TestCoversOnlyOwners(t *testing.T) {
+	var c dotClock
+	c.Observe(viewExist, 1)
+
+	// A write through a replica that doesn't own the key can't be missing here
+	payload := map[string]int{viewExist: 1, viewNotExist: 4}
+	assert(t, c.Covers(payload, []string{viewExist, testMain}), "Dots of the key's owners aren't covered")
+	assert(t, !c.Covers(payload, []string{viewNotExist}), "Unseen dot of an owner is covered")
+	assert(t, !c.Covers(payload, nil), "Unseen dot is covered with every replica checked")
+}
+
+func TestCaughtUpTakesOnlyPeerDotsWhenOwnersOverlap(t *testing.T) {
+	frontier := map[string]int{viewExist: 3, viewNotExist: 5}
+	equals(t, frontier, caughtUp(viewExist, frontier))
+
+	defer withReplicas(1)()
+	equals(t, map[string]int{viewExist: 3}, caughtUp(viewExist, frontier))
+}
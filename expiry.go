@@ -0,0 +1,95 @@
+// expiry.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines per-key expiry for the KVS. A PUT with a TTL stores an absolute expiry time
+// in the entry, computed once by the replica that accepted the write, and that time
+// replicates along with the rest of the entry. Reads treat a key past its expiry as
+// absent, and a background reaper turns expired keys into tombstones.
+//
+// The reaper makes the tombstone deterministic: its timestamp is the stored expiry
+// and its version and clock are the next ones after the live entry. Every replica
+// that reaps a key therefore produces the exact same tombstone no matter when its
+// reaper runs or how far its clock has drifted, and gossip has nothing to resolve.
+//
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// expired returns true if the entry has an expiry and it has passed
+func expired(e KeyEntry, now time.Time) bool {
+	exp := e.GetExpiry()
+	return !exp.IsZero() && !now.Before(exp)
+}
+
+// parseTTL reads a TTL given either as a number of seconds or as a duration like "90s"
+func parseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	if n, err := strconv.Atoi(s); err == nil {
+		ttl = time.Duration(n) * time.Second
+	} else if d, err := time.ParseDuration(s); err == nil {
+		ttl = d
+	} else {
+		return 0, errors.New("TTL must be a number of seconds or a duration")
+	}
+	if ttl <= 0 {
+		return 0, errors.New("TTL must be positive")
+	}
+	return ttl, nil
+}
+
+// ReapExpired turns every live key whose expiry has passed into a tombstone and
+// returns the number of keys it reaped
+func (k *KVS) ReapExpired(now time.Time) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	reaped := 0
+	for key, e := range k.db {
+		if !e.Alive() || !expired(e, now) {
+			continue
+		}
+		log.Println("Reaping expired key ", key)
+
+		// Build the tombstone from the entry itself so every replica builds the same one.
+		// It keeps the value's dot and has seen the value.
+		exp := e.GetExpiry()
+		clock := past(e)
+		node, dot := e.GetNode(), e.GetDot()
+		k.archive(key, exp)
+		e.Delete(key, exp, clock)
+		if d, ok := e.(*Entry); ok {
+			d.Node = node
+			d.Dot = dot
+		}
+		k.rehash(key)
+		if err := k.logEntry(walDelete, key); err != nil {
+			log.Println("Error logging expired key: ", err)
+		}
+		reaped++
+	}
+	return reaped
+}
+
+// reapLoop runs the reaper forever at the given interval
+func (k *KVS) reapLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for now := range t.C {
+		if n := k.ReapExpired(now); n > 0 {
+			log.Printf("Reaped %d expired keys\n", n)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// expiry_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for key expiry and the reaper
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	d, err := parseTTL("30")
+	ok(t, err)
+	equals(t, 30*time.Second, d)
+
+	d, err = parseTTL("1m30s")
+	ok(t, err)
+	equals(t, 90*time.Second, d)
+
+	_, err = parseTTL("-5")
+	assert(t, err != nil, "Negative TTL accepted")
+	_, err = parseTTL("soon")
+	assert(t, err != nil, "Garbage TTL accepted")
+}
+
+func TestExpiredKeyIsAbsent(t *testing.T) {
+	k := NewKVS()
+	k.PutWithExpiry(keyExists, valExists, time.Now(), map[string]int{}, time.Now().Add(-time.Second))
+	k.PutWithExpiry(keyone, valone, time.Now(), map[string]int{}, time.Now().Add(time.Hour))
+
+	alive, version := k.Contains(keyExists)
+	assert(t, !alive, "Expired key is alive")
+	equals(t, 1, version)
+
+	alive, _ = k.Contains(keyone)
+	assert(t, alive, "Unexpired key is dead")
+}
+
+func TestPutClearsExpiry(t *testing.T) {
+	k := NewKVS()
+	k.PutWithExpiry(keyExists, valExists, time.Now(), map[string]int{}, time.Now().Add(-time.Second))
+	k.Put(keyExists, valtwo, time.Now(), map[string]int{})
+	equals(t, time.Time{}, k.db[keyExists].GetExpiry())
+}
+
+func TestReapExpiredIsDeterministic(t *testing.T) {
+	exp := time.Now().Add(time.Minute)
+	written := time.Now()
+
+	// Two replicas with the same entry reap it at different times
+	a := NewKVS()
+	b := NewKVS()
+	a.PutWithExpiry(keyExists, valExists, written, map[string]int{viewExist: 1}, exp)
+	b.OverwriteEntry(keyExists, &Entry{
+		Version:   1,
+		Timestamp: written,
+		Clock:     map[string]int{viewExist: 1},
+		Value:     valExists,
+		Expires:   exp,
+		Node:      a.GetNode(keyExists),
+		Dot:       a.GetDot(keyExists),
+	})
+
+	equals(t, 0, a.ReapExpired(time.Now()))
+	equals(t, 1, a.ReapExpired(exp.Add(time.Second)))
+	equals(t, 1, b.ReapExpired(exp.Add(time.Hour)))
+
+	equals(t, toEntry(a.db[keyExists]), toEntry(b.db[keyExists]))
+	assert(t, !a.db[keyExists].Alive(), "Reaped key is still alive")
+	equals(t, exp, a.GetTimestamp(keyExists))
+	equals(t, a.GetDot(keyExists), a.GetClock(keyExists)[a.GetNode(keyExists)])
+}
@@ -16,12 +16,16 @@ package main
 import (
 	"log"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // GossipVals is a struct which implements the Gossip
 type GossipVals struct {
-	view View
-	kvs  dbAccess
+	view   View
+	kvs    dbAccess
+	deltas *deltaBuffer // Recent mutations to push, see delta.go
+	book   *syncBook    // What we know about syncing with each peer, see peers.go
 	// tcp?
 }
 
@@ -33,20 +37,16 @@ var goalTime time.Time
 func setTime() {
 	// Set the time right now
 	now = time.Now()
-	// Set the time goal for 5 seconds after timeNow
-	goalTime = now.Add(5 * time.Second)
+	// Set the time goal for the round interval after timeNow
+	goalTime = now.Add(roundDeadline())
 }
 
-// timesUp purely checks if 5 seconds has past
+// timesUp purely checks if the round interval has past
 func timesUp() bool {
-	if goalTime.Before(time.Now()) {
-		needHelp = true
-		return true
-	}
-	return false
+	return goalTime.Before(time.Now())
 }
 
-// GossipHeartbeat contains a forever loop that will check for need of Gossip every 1 second
+// GossipHeartbeat contains a forever loop that will check for need of Gossip every gossipPoll
 func (g *GossipVals) GossipHeartbeat() {
 	log.Println("Gossip heart starts...")
 	setTime()
@@ -55,55 +55,249 @@ func (g *GossipVals) GossipHeartbeat() {
 		if wakeGossip || viewChange || timesUp() {
 			log.Println("Gossip initiated. Ringing TCP")
 
-			gossipee := g.view.Random(2)
+			// We've gone longer than usual without hearing from anyone
+			if heartbeats.Suspicious(anyPeer) {
+				needHelp = true
+			}
 
 			if needHelp {
-				for _, bob := range gossipee {
+				// Peers that have gone quiet may only be quiet to us, so ask anyone who isn't dead
+				for _, bob := range peerSelection.Select(g.live(), gossipFanout, g.book) {
 					askForHelp(bob)
 				}
 				needHelp = false
 			} else {
+				gossipee := peerSelection.Select(g.reachable(), gossipFanout, g.book)
 				for _, bob := range gossipee {
-					// Get timeglob
-					t := g.kvs.GetTimeGlob()
-					//Send our timeglob to gossipee and return back their pruned timeglob
-					rt, err := sendTimeGlob(bob, t)
-					if err != nil {
-						log.Println("Error sending timeglob: ", err)
-						continue
-					}
-					// turn the pruned timeglob into and entry glob for gossipee
-					re := g.kvs.GetEntryGlob(*rt)
-					//send the entryglob needed to update gosipee kvs
-					err = sendEntryGlob(bob, re)
+					start := time.Now()
+					err := g.syncWith(bob)
+					g.book.Record(bob, time.Since(start), err)
 					if err != nil {
-						log.Println("Error sending entryglob: ", err)
+						log.Println("Error syncing with "+bob+": ", err)
 						continue
 					}
+					heartbeats.Heard(bob)
+				}
+			}
 
-					if viewChange {
-						// Propagate views
-						v := g.view.List()
-						sendViewList(bob, v)
+			if viewChange {
+				// Propagate views to the whole view, not just our shard
+				for _, bob := range peerSelection.Select(g.others(), gossipFanout, g.book) {
+					if members.Get(bob).Status != statusDead {
+						sendView(bob, g.view.State())
 					}
 				}
 			}
 			wakeGossip = false
 			setTime()
+
+			// Purge any tombstones that every peer has now seen
+			if n := g.kvs.CollectTombstones(g.peers(), g.view.List()); n > 0 {
+				log.Printf("Collected %d tombstones\n", n)
+			}
 		}
-		// Sleep for half a second before restarting
-		time.Sleep(50 * time.Millisecond)
+		// Sleep for a moment before restarting
+		time.Sleep(gossipPoll)
+	}
+}
+
+// syncWith runs a round of anti-entropy with bob
+func (g *GossipVals) syncWith(bob string) error {
+	_, err := g.syncRound(bob)
+	return err
+}
+
+// syncRound runs a round of anti-entropy with bob, and returns true if our Merkle trees
+// already matched so there was nothing to sync
+func (g *GossipVals) syncRound(bob string) (bool, error) {
+	// Find the leaves where our Merkle trees differ, there are none if we're in sync
+	diff, err := diffMerkle(bob, g.kvs)
+	if err != nil {
+		return false, errors.Wrap(err, "Error comparing Merkle trees")
+	}
+	// Bob holds what we do under every node that matched, which lets tombstones get collected
+	g.kvs.AckMerkle(bob, diff.Matched)
+
+	if len(diff.Leaves) == 0 {
+		// We hold what bob held, so we've seen every dot bob had
+		dots.Merge(caughtUp(bob, diff.Frontier))
+		return true, nil
 	}
+	complete, err := g.syncLeaves(bob, diff.Leaves)
+	if complete {
+		dots.Merge(caughtUp(bob, diff.Frontier))
+	}
+	return false, err
+}
+
+// caughtUp returns the dots we've seen once we hold every key bob held that we own.
+// If owner groups overlap without lining up, bob has seen dots on keys we don't hold,
+// so only bob's own dots count.
+func caughtUp(bob string, frontier map[string]int) map[string]int {
+	if replicas <= 0 || numShards() > 1 {
+		return frontier
+	}
+	return map[string]int{bob: frontier[bob]}
+}
+
+// syncLeaves runs a push-pull session with bob over the keys under the given leaves of
+// our Merkle tree. In one session bob gets the keys we hold at a different timestamp
+// than bob does, and we get bob's. It returns true if we took every entry bob sent.
+func (g *GossipVals) syncLeaves(bob string, leaves []int) (bool, error) {
+	// Get the timeglob of just those leaves, less the keys bob doesn't own
+	t := ownedBy(bob, g.view.List(), g.kvs.GetLeafGlob(leaves))
+	req := syncRequest{From: g.view.Primary(), Leaves: leaves, Times: t}
+
+	complete := false
+	err := sendSync(bob, req, func(resp syncResponse) entryGlob {
+		var eg entryGlob
+		eg, complete = g.reply(bob, t, resp)
+		return eg
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "Error syncing leaves")
+	}
+	return complete, nil
+}
+
+// reply is the initiator's half of a push-pull session once bob has answered the
+// timeGlob we sent. It returns the entries bob asked for, and true if we took every
+// entry bob sent.
+func (g *GossipVals) reply(bob string, sent timeGlob, resp syncResponse) (entryGlob, bool) {
+	// Anything bob didn't ask for, bob already has, which lets tombstones get collected
+	g.kvs.AckTombstones(bob, ackedKeys(sent, resp.Want))
+	// Take bob's entries first, so what we send back has been resolved against them
+	taken := g.Receive(resp.Entries)
+	return g.kvs.GetEntryGlob(resp.Want), len(taken.Keys) == len(resp.Entries.Keys)
+}
+
+// Answer is bob's half of a push-pull session. It returns the keys the initiator
+// should send us, which are the ones we don't hold at the same timestamp, along with
+// our entries under the same leaves that the initiator doesn't hold at the same
+// timestamp.
+func (g *GossipVals) Answer(req syncRequest) syncResponse {
+	give := g.kvs.GetLeafGlob(req.Leaves)
+	if req.From != "" {
+		give = ownedBy(req.From, g.view.List(), give)
+	}
+	for k, t := range give.List {
+		if ts, ok := req.Times.List[k]; ok && ts.Equal(t) && req.Times.Digests[k] == give.Digests[k] {
+			delete(give.List, k)
+		}
+	}
+
+	// ClockPrune prunes in place, and the request is still needed for the acks
+	want := timeGlob{List: make(map[string]time.Time, len(req.Times.List)), Digests: req.Times.Digests}
+	for k, t := range req.Times.List {
+		want.List[k] = t
+	}
+	want = ownedBy(g.view.Primary(), g.view.List(), g.ClockPrune(want))
+
+	// Whatever we didn't ask for, the initiator holds just like we do
+	if req.From != "" {
+		g.kvs.AckTombstones(req.From, ackedKeys(req.Times, want))
+	}
+	return syncResponse{Want: want, Entries: g.kvs.GetEntryGlob(give)}
+}
+
+// Receive takes entries sent by a peer into the KVS, apart from keys we don't own, and
+// returns the entries it took
+func (g *GossipVals) Receive(data entryGlob) entryGlob {
+	return g.receiveAs(data, g.view.List())
+}
+
+// receiveAs is Receive with ownership worked out among the given members
+func (g *GossipVals) receiveAs(data entryGlob, members []string) entryGlob {
+	taken := entryGlob{Keys: make(map[string]Entry, len(data.Keys))}
+	for key, entry := range data.Keys {
+		if partitioned() && !ring.Owns(g.view.Primary(), key, members) {
+			continue
+		}
+		// Anything we write from now on has to be timestamped after what we just saw,
+		// and clients that have seen these writes can be served by us
+		hlc.Observe(entry.Timestamp)
+		dots.ObserveEntry(&entry)
+		taken.Keys[key] = entry
+	}
+	log.Println("Updating KVS")
+	g.UpdateKVS(taken)
+	return taken
+}
+
+// others returns every member of the view other than this server
+func (g *GossipVals) others() []string {
+	var p []string
+	for _, v := range g.view.List() {
+		if v != g.view.Primary() {
+			p = append(p, v)
+		}
+	}
+	return p
+}
+
+// peers returns the members of the view we gossip with, which are the other members
+// of our shard
+func (g *GossipVals) peers() []string {
+	if g.view.Shards() <= 1 {
+		return g.others()
+	}
+	id := shardOf(g.view, g.view.Primary())
+	if id < 0 {
+		return g.others()
+	}
+	var p []string
+	for _, v := range shardsOf(g.view)[id] {
+		if v != g.view.Primary() {
+			p = append(p, v)
+		}
+	}
+	return p
+}
+
+// live returns the peers the failure detector hasn't declared dead
+func (g *GossipVals) live() []string {
+	var p []string
+	for _, v := range g.peers() {
+		if members.Get(v).Status != statusDead {
+			p = append(p, v)
+		}
+	}
+	return p
+}
+
+// reachable returns the live peers we haven't gone suspiciously long without hearing from
+func (g *GossipVals) reachable() []string {
+	var p []string
+	for _, v := range g.live() {
+		if !heartbeats.Suspicious(v) {
+			p = append(p, v)
+		}
+	}
+	return p
+}
+
+// ackedKeys returns the part of the timeGlob we sent that the gossipee pruned, which
+// are the keys it already holds at exactly our timestamp
+func ackedKeys(sent timeGlob, pruned timeGlob) timeGlob {
+	acked := timeGlob{List: make(map[string]time.Time)}
+	for k, t := range sent.List {
+		if _, ok := pruned.List[k]; !ok {
+			acked.List[k] = t
+		}
+	}
+	return acked
 }
 
 // ClockPrune returns a pruned map that only contains the keys that the gossipee needs updating
 func (g *GossipVals) ClockPrune(input timeGlob) timeGlob {
-	own := g.kvs.GetTimeGlob() // getTimeGlob() is in glob branch
-
-	// Find and delete duplicates between two maps
-	for k := range own.List {
-		// Prune key off of input timeGlob if input's k is as new as own's k
-		if input.List[k] == own.List[k] {
+	// Only the keys we were sent are looked at, which is usually a few leaves of the
+	// Merkle tree rather than the whole db
+	for k, t := range input.List {
+		// Prune key off of input timeGlob if input's k is as new as own's k. Tombstones
+		// we've already purged still report their timestamp, since we've seen them. A
+		// typed key also has to hold the same state, which a merge can leave different
+		// at the same timestamp.
+		if g.kvs.GetTimestamp(k).Equal(t) && input.Digests[k] == g.digest(k) {
 			delete(input.List, k)
 		}
 		// Does NOT prune even if input[k] < own[k], because further checks in causal
@@ -113,6 +307,14 @@ func (g *GossipVals) ClockPrune(input timeGlob) timeGlob {
 	return input
 }
 
+// digest returns the digest of the state we hold for a typed key, and 0 for any other key
+func (g *GossipVals) digest(key string) uint64 {
+	if e := g.kvs.GetEntry(key); e != nil {
+		return e.CRDT.digest()
+	}
+	return 0
+}
+
 // BuildEntryGlob takes timeGlob and turn it into entryGlob
 func (g *GossipVals) BuildEntryGlob(inglob timeGlob) entryGlob {
 	// TODO: understand getEntryGlob() and how to use it
@@ -122,65 +324,30 @@ func (g *GossipVals) BuildEntryGlob(inglob timeGlob) entryGlob {
 
 // UpdateKVS takes entryGlob and update its own KVS. End of Gossip protocol
 func (g *GossipVals) UpdateKVS(inglob entryGlob) {
-	// Loop through all keys, check for conflicts, and update KVS when necessary.
-	for key, aliceEntry := range inglob.Keys {
-		if g.ConflictResolution(key, &aliceEntry) {
-			g.kvs.OverwriteEntry(key, &aliceEntry)
-		}
-	}
+	// Conflicts are settled by the KVS under the same lock as the write, and the
+	// winners are written in one go so that keys which were written together, like a
+	// batch, show up together
+	g.kvs.OverwriteEntries(inglob)
 }
 
-// ConflictResolution returns true if Bob should update with Alice's key
+// ConflictResolution returns true if Bob should update with Alice's key, using the
+// original vector clock then timestamp rule
 func (g *GossipVals) ConflictResolution(key string, aliceEntry KeyEntry) bool {
 	log.Println("Resolving a conflict")
-	isSmaller := false
-	isLarger := false
-	incomparable := false
-
-	log.Printf("Comparing Alice's version '%#v'\n", aliceEntry)
-	aMap := aliceEntry.GetClock()
-	bMap := g.kvs.GetClock(key)
-	log.Println("aMap: ", aMap)
-	log.Println("bMap: ", bMap)
-
-	// if bob does NOT have the key, we definitely update w/ Alice's stuff
-	if len(bMap) == 0 {
-		log.Println("Bob doesn't have the entry: ", key)
-		return true // Bob can't possibly beat Alice's key with no corresponding key of it's own
-	}
-	// else if Bob DOES have the key, we compare causal history & timestamps
-	for k, v := range bMap {
-		if aMap[k] < v {
-			isSmaller = true
-		} else if aMap[k] > v {
-			isLarger = true
-		}
-	}
-	for k := range aMap {
-		if _, exist := bMap[k]; !exist {
-			incomparable = true
-		}
-	}
+	return vectorClockResolver{}.Resolve(key, aliceEntry, g.local(key))
+}
 
-	if (isSmaller && isLarger) || (!isSmaller && !isLarger) || incomparable {
-		// incomparable or identical clocks, later timestamp wins
-		if aliceEntry.GetTimestamp().After(g.kvs.GetTimestamp(key)) {
-			log.Println("Alice wins with the later timestamp")
-			return true // alice wins
-		}
-		log.Println("Bob wins with a later timestamp")
-		return false // bob wins
-	} else if isSmaller == false && isLarger == true {
-		log.Println("Alice wins with a larger clock")
-		return true // alice wins
+// local returns Bob's own entry for a key, or nil if he doesn't have it
+func (g *GossipVals) local(key string) KeyEntry {
+	if e := g.kvs.GetEntry(key); e != nil {
+		return e
 	}
-	log.Println("Bob wins with a larger clock")
-	return false // bob wins
+	return nil
 }
 
-// UpdateViews overwrites our views
-func (g *GossipVals) UpdateViews(v []string) {
-	if len(v) > 0 {
-		g.view.Overwrite(v)
+// UpdateViews takes whatever changes in a peer's view are newer than ours
+func (g *GossipVals) UpdateViews(v viewState) {
+	if len(v.Members) > 0 {
+		g.view.Merge(v)
 	}
 }
@@ -60,6 +60,30 @@ func (v *TestView) Overwrite(in []string) {
 	v.view = strings.Join(in, ",")
 }
 
+func (v *TestView) Merge(in viewState) bool {
+	v.Overwrite(in.List())
+	return true
+}
+
+func (v *TestView) State() viewState {
+	s := viewState{Members: make(map[string]viewStamp)}
+	for _, m := range strings.Split(v.view, ",") {
+		s.Members[m] = viewStamp{}
+	}
+	return s
+}
+
+func (v *TestView) Epoch() int {
+	return 0
+}
+
+func (v *TestView) Shards() int {
+	return 1
+}
+
+func (v *TestView) SetShards(n int) {
+}
+
 func TestSetTimeSetsTime(t *testing.T) {
 	before := time.Now()
 
@@ -77,12 +101,13 @@ func TestSetTimeSetsGoal(t *testing.T) {
 	setTime()
 	assert(t, now.Add(5*time.Second) == goalTime, "SetTime set the wrong goal")
 }
-func TestTimesUpSetsNeedHelp(t *testing.T) {
+func TestTimesUpDoesntAskForHelp(t *testing.T) {
 	setTime()
 	time.Sleep(5 * time.Second)
 	assert(t, timesUp(), "Times up failed")
 	fmt.Println(goalTime)
-	assert(t, needHelp, "Times up didn't set needHelp")
+	// Whether we need help is up to the phi detector, see phi.go
+	assert(t, !needHelp, "Times up set needHelp")
 }
 
 func TestTimesUpReturnsFalseIfEarly(t *testing.T) {
@@ -183,7 +208,7 @@ func TestUpdateViewsUpdatesViews(t *testing.T) {
 	newView := []string{"172.132.164.20:8081", "172.132.164.50:8082"}
 	s := strings.Join(newView, ",")
 
-	g.UpdateViews(newView)
+	g.UpdateViews(viewState{Members: map[string]viewStamp{newView[0]: {}, newView[1]: {}}})
 
 	assert(t, g.view.String() == s, "UpdateViews didn't update the view")
 
@@ -205,10 +230,9 @@ func TestUpdateViewsEmptyInputDoesntUpdate(t *testing.T) {
 	// Make a gossip
 	g := GossipVals{kvs: &k, view: &v}
 
-	newView := []string{}
 	s := g.view.String()
 
-	g.UpdateViews(newView)
+	g.UpdateViews(viewState{})
 
 	assert(t, g.view.String() == s, "UpdateViews updated the view")
 }
@@ -246,10 +270,13 @@ func TestConflictResolutionKeyExistAliceBigger(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 1},
-		dbKey:   keyExists,
-		dbTime:  timeExists,
-		dbVal:   valExists,
+		dbClock:   map[string]int{viewExist: 1},
+		dbKey:     keyExists,
+		dbTime:    timeExists,
+		dbVal:     valExists,
+		dbVersion: 1,
+		dbNode:    testMain,
+		dbDot:     1,
 	}
 
 	// Mock a view
@@ -258,13 +285,15 @@ func TestConflictResolutionKeyExistAliceBigger(t *testing.T) {
 	// Make a gossip
 	g := GossipVals{kvs: &k, view: &v}
 
-	// Mock an input that Bob doesn't have
+	// Mock an input that has seen Bob's write
 	newKeyExistsEntry := Entry{
 		Version:   2,
 		Value:     valNotExists,
 		Timestamp: timeExists,
-		Clock:     map[string]int{keyExists: 2},
+		Clock:     map[string]int{testMain: 1},
 		Tombstone: false,
+		Node:      viewExist,
+		Dot:       2,
 	}
 
 	// Make sure Alice's entry wins
@@ -275,10 +304,13 @@ func TestConflictResolutionKeyExistBobBigger(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 2},
-		dbKey:   keyExists,
-		dbTime:  timeExists,
-		dbVal:   valExists,
+		dbClock:   map[string]int{viewExist: 1},
+		dbKey:     keyExists,
+		dbTime:    timeExists,
+		dbVal:     valExists,
+		dbVersion: 2,
+		dbNode:    testMain,
+		dbDot:     1,
 	}
 
 	// Mock a view
@@ -287,13 +319,15 @@ func TestConflictResolutionKeyExistBobBigger(t *testing.T) {
 	// Make a gossip
 	g := GossipVals{kvs: &k, view: &v}
 
-	// Mock an input that Bob doesn't have
+	// Mock an input that Bob's write has seen
 	newKeyExistsEntry := Entry{
 		Version:   1,
 		Value:     valNotExists,
 		Timestamp: timeExists,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     map[string]int{},
 		Tombstone: false,
+		Node:      viewExist,
+		Dot:       1,
 	}
 
 	// Make sure Bob's entry wins
@@ -304,10 +338,13 @@ func TestConflictResolutionKeyExistAliceLater(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 2, "someKey": 1},
-		dbKey:   keyExists,
-		dbTime:  timeExists,
-		dbVal:   valExists,
+		dbClock:   map[string]int{viewExist: 1},
+		dbKey:     keyExists,
+		dbTime:    timeExists,
+		dbVal:     valExists,
+		dbVersion: 2,
+		dbNode:    testMain,
+		dbDot:     2,
 	}
 
 	// Mock a view
@@ -319,13 +356,15 @@ func TestConflictResolutionKeyExistAliceLater(t *testing.T) {
 
 	aliceTime := time.Now()
 
-	// Mock an input that Bob doesn't have
+	// Mock a concurrent input, neither write has seen the other
 	newKeyExistsEntry := Entry{
 		Version:   2,
 		Value:     valNotExists,
 		Timestamp: aliceTime,
-		Clock:     map[string]int{keyExists: 2, "someOtherKey": 1},
+		Clock:     map[string]int{testMain: 1},
 		Tombstone: false,
+		Node:      viewExist,
+		Dot:       2,
 	}
 
 	// Make sure Alice's entry wins
@@ -338,10 +377,13 @@ func TestConflictResolutionKeyExistBobLater(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	bobTime := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 2, "someKey": 2},
-		dbKey:   keyExists,
-		dbTime:  bobTime,
-		dbVal:   valExists,
+		dbClock:   map[string]int{viewExist: 1},
+		dbKey:     keyExists,
+		dbTime:    bobTime,
+		dbVal:     valExists,
+		dbVersion: 2,
+		dbNode:    testMain,
+		dbDot:     2,
 	}
 
 	// Mock a view
@@ -350,13 +392,15 @@ func TestConflictResolutionKeyExistBobLater(t *testing.T) {
 	// Make a gossip
 	g := GossipVals{kvs: &k, view: &v}
 
-	// Mock an input that Bob doesn't have
+	// Mock a concurrent input, neither write has seen the other
 	newKeyExistsEntry := Entry{
 		Version:   2,
 		Value:     valNotExists,
 		Timestamp: aliceTime,
-		Clock:     map[string]int{keyExists: 2, "someOtherKey": 2},
+		Clock:     map[string]int{testMain: 1},
 		Tombstone: false,
+		Node:      viewExist,
+		Dot:       2,
 	}
 
 	// Make sure Bob's entry wins
@@ -411,3 +455,46 @@ func TestUpdateKVSUpdatesKVS(t *testing.T) {
 // Test nil stuff
 //   - we should not have any panics because of nil entries or objects
 //   - log.fatalln instead or failthrough or something
+
+func TestPushPullSession(t *testing.T) {
+	a, b := twinKVS(20)
+	ga := GossipVals{kvs: a, view: &TestView{view: testView}}
+	gb := GossipVals{kvs: b, view: &TestView{view: testView}}
+
+	later := time.Now().Add(time.Second)
+	a.Put(keyone+"1", valtwo, later, map[string]int{})
+	b.Put(keyone+"2", valtwo, later, map[string]int{})
+	b.Put(keyNotHere, valone, later, map[string]int{})
+
+	// A runs a session with B over the leaves that differ, without going over the wire
+	diff, err := compareMerkle(a, counting(b, new(int)))
+	ok(t, err)
+	sent := a.GetLeafGlob(diff.Leaves)
+	resp := gb.Answer(syncRequest{From: testMain, Leaves: diff.Leaves, Times: sent})
+	eg, complete := ga.reply(viewExist, sent, resp)
+	assert(t, complete, "Not every entry B sent was taken")
+	gb.Receive(eg)
+
+	// One session is enough for both to end up the same
+	equals(t, a.MerkleHashes([]int{1}), b.MerkleHashes([]int{1}))
+	v, _ := a.Get(keyone+"2", map[string]int{})
+	equals(t, valtwo, v)
+	v, _ = a.Get(keyNotHere, map[string]int{})
+	equals(t, valone, v)
+	v, _ = b.Get(keyone+"1", map[string]int{})
+	equals(t, valtwo, v)
+}
+
+func TestAnswerAcksMatchingTombstones(t *testing.T) {
+	a, b := twinKVS(5)
+	now := time.Now().Add(time.Second)
+	a.Delete(keyone+"1", now, map[string]int{})
+	b.Delete(keyone+"1", now, map[string]int{})
+	b.Put(keyone+"2", valtwo, now, map[string]int{})
+
+	// B learns that A holds the same tombstone from the timeGlob A sent
+	gb := GossipVals{kvs: b, view: &TestView{view: testView}}
+	all := []int{1}
+	gb.Answer(syncRequest{From: testMain, Leaves: all, Times: a.GetLeafGlob(all)})
+	equals(t, 1, b.CollectTombstones([]string{testMain}, nil))
+}
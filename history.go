@@ -0,0 +1,91 @@
+// history.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the version history the KVS keeps for each key. Whenever an entry is
+// replaced, whether by a client write, a delete, the reaper or gossip, a copy of the
+// old entry is archived along with the time it was replaced. The history is bounded
+// by a number of versions and optionally by age.
+//
+// History is local to each replica and is never gossiped. It's rebuilt from the
+// write-ahead log on startup and carried in snapshots.
+//
+
+package main
+
+import (
+	"time"
+)
+
+// revision is an entry that has been replaced, along with when it was replaced
+type revision struct {
+	Entry    Entry     // The entry as it was before it was replaced
+	Replaced time.Time // Timestamp of the write that replaced it
+}
+
+// archive copies the current entry for the key into its history before it's replaced by
+// a write with the given timestamp. The caller must hold the write lock.
+func (k *KVS) archive(key string, at time.Time) {
+	if historyDepth <= 0 {
+		return
+	}
+	e, ok := k.db[key]
+	if !ok {
+		return
+	}
+	if k.history == nil {
+		k.history = make(map[string][]revision)
+	}
+	revs := append(k.history[key], revision{Entry: toEntry(e), Replaced: at})
+	k.history[key] = trimHistory(revs, time.Now())
+}
+
+// trimHistory drops the oldest revisions past the depth limit, and any that were
+// replaced longer ago than the age limit
+func trimHistory(revs []revision, now time.Time) []revision {
+	if len(revs) > historyDepth {
+		revs = append([]revision(nil), revs[len(revs)-historyDepth:]...)
+	}
+	if historyMaxAge > 0 {
+		i := 0
+		for i < len(revs) && now.Sub(revs[i].Replaced) > historyMaxAge {
+			i++
+		}
+		revs = revs[i:]
+	}
+	return revs
+}
+
+// History returns every version of the key this replica still holds, oldest first, with
+// the current entry last. It returns an empty slice for a key we know nothing about.
+func (k *KVS) History(key string) []Entry {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	revs := trimHistory(k.history[key], time.Now())
+	h := make([]Entry, 0, len(revs)+1)
+	for _, r := range revs {
+		h = append(h, r.Entry)
+	}
+	if e, ok := k.db[key]; ok {
+		h = append(h, toEntry(e))
+	}
+	return h
+}
+
+// findVersion returns the newest entry in a history with the given version. Two
+// replicas can write the same version concurrently, in which case the one that
+// replaced the other here is the one returned.
+func findVersion(h []Entry, version int) (Entry, bool) {
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].Version == version {
+			return h[i], true
+		}
+	}
+	return Entry{}, false
+}
@@ -0,0 +1,104 @@
+// history_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for version history
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryKeepsReplacedVersions(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valone, time.Now(), map[string]int{})
+	k.Put(keyExists, valtwo, time.Now(), map[string]int{})
+	k.Delete(keyExists, time.Now(), map[string]int{})
+
+	h := k.History(keyExists)
+	equals(t, 3, len(h))
+	equals(t, valone, h[0].Value)
+	equals(t, valtwo, h[1].Value)
+	equals(t, map[string]int{}, h[1].Clock)
+	assert(t, h[1].Dot > h[0].Dot, "Second write didn't get a later dot")
+	assert(t, h[2].Tombstone, "Current version isn't the tombstone")
+
+	e, found := findVersion(h, 2)
+	assert(t, found, "Version 2 not found")
+	equals(t, valtwo, e.Value)
+	_, found = findVersion(h, 4)
+	assert(t, !found, "Version 4 found")
+}
+
+func TestHistoryDepth(t *testing.T) {
+	historyDepth = 2
+	defer func() { historyDepth = defaultHistoryDepth }()
+
+	k := NewKVS()
+	for i := 0; i < 5; i++ {
+		k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	}
+	h := k.History(keyExists)
+	equals(t, 3, len(h))
+	equals(t, 3, h[0].Version)
+	equals(t, 5, h[2].Version)
+}
+
+func TestHistoryAge(t *testing.T) {
+	historyMaxAge = time.Minute
+	defer func() { historyMaxAge = 0 }()
+
+	k := NewKVS()
+	k.Put(keyExists, valone, time.Now(), map[string]int{})
+	k.Put(keyExists, valtwo, time.Now().Add(-2*time.Minute), map[string]int{})
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+
+	// Version 1 was replaced too long ago, version 2 was replaced just now
+	h := k.History(keyExists)
+	equals(t, 2, len(h))
+	equals(t, valtwo, h[0].Value)
+}
+
+func TestHistoryRecordsGossipOverwrites(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valone, time.Now(), map[string]int{})
+	k.OverwriteEntry(keyExists, NewEntry(time.Now(), map[string]int{keyExists: 1, keyone: 1}, valtwo, 1))
+
+	// The version that lost conflict resolution is still there to look at
+	h := k.History(keyExists)
+	equals(t, 2, len(h))
+	equals(t, valone, h[0].Value)
+	equals(t, valtwo, h[1].Value)
+}
+
+func TestHistoryForgottenOnPurge(t *testing.T) {
+	k := deadKVS()
+	equals(t, 1, k.CollectTombstones(nil, nil))
+	equals(t, 0, len(k.History(keyExists)))
+}
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	// Round(0) strips the monotonic clock reading, which doesn't survive a restart
+	k := NewKVS()
+	k.Put(keyExists, valone, time.Now().Round(0), map[string]int{})
+	ok(t, k.Snapshot())
+	k.Put(keyExists, valtwo, time.Now().Round(0), map[string]int{})
+	k.Put(keyExists, valExists, time.Now().Round(0), map[string]int{})
+	want := k.History(keyExists)
+	ok(t, k.Close())
+
+	r := NewKVS()
+	defer r.Close()
+	equals(t, want, r.History(keyExists))
+}
@@ -0,0 +1,95 @@
+// hlc.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the hybrid logical clock that timestamps writes. Wall clocks on different
+// containers drift, so comparing time.Now() from two of them lets the one running
+// fast win every tie. The HLC never goes backwards, and every time we receive an
+// entry from a peer it moves past that entry's timestamp, so a write made here after
+// seeing a peer's write is always timestamped after it, however far behind our wall
+// clock is.
+//
+// The timestamp is still a time.Time so that everything else keeps working. The wall
+// clock part is kept to the microsecond, and the nanoseconds below it hold the logical
+// counter, which is bumped whenever the wall clock hasn't moved past the last timestamp.
+// Two writes can still end up with the same timestamp on different replicas, in which
+// case the ID of the node that made them breaks the tie.
+//
+// A peer whose clock is far ahead would drag every clock it talks to along with it.
+// The clock only follows a timestamp up to MAX_CLOCK_OFFSET ahead of our wall clock.
+// The entry carrying it is still taken, since a clock that stays skewed never gets
+// caught up with and its writes would never spread, but it's counted and logged so
+// the skew can be fixed.
+//
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// hybridClock issues hybrid logical timestamps
+type hybridClock struct {
+	mutex  sync.Mutex
+	last   time.Time // The latest timestamp issued or observed
+	skewed int       // Timestamps observed too far ahead of our wall clock
+}
+
+// hlc is the clock every write on this replica is timestamped with
+var hlc hybridClock
+
+// Now returns a timestamp later than every one issued or observed so far
+func (c *hybridClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Truncating also strips the monotonic reading so timestamps compare the same after gob
+	wall := time.Now().Truncate(time.Microsecond)
+	if wall.After(c.last) {
+		c.last = wall
+	} else {
+		c.last = c.last.Add(time.Nanosecond)
+	}
+	return c.last
+}
+
+// Observe moves the clock past a timestamp received from a peer, but no further than
+// the offset ahead of our wall clock
+func (c *hybridClock) Observe(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if maxClockOffset > 0 {
+		now := time.Now()
+		if ahead := t.Sub(now); ahead > maxClockOffset {
+			log.Printf("ALERT: Timestamp %v is %v ahead of our clock, a peer's clock is skewed\n", t, ahead)
+			c.skewed++
+			t = now.Add(maxClockOffset).Truncate(time.Microsecond)
+		}
+	}
+	if t.After(c.last) {
+		c.last = t.Round(0)
+	}
+}
+
+// Skewed returns the number of timestamps observed too far ahead of our wall clock
+func (c *hybridClock) Skewed() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.skewed
+}
+
+// laterWrite returns true if a write with timestamp ta made by node na beats one with
+// timestamp tb made by node nb. Every replica picks the same winner.
+func laterWrite(ta time.Time, na string, tb time.Time, nb string) bool {
+	if !ta.Equal(tb) {
+		return ta.After(tb)
+	}
+	return na > nb
+}
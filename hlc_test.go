@@ -0,0 +1,91 @@
+// hlc_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the hybrid logical clock
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLCNeverGoesBackwards(t *testing.T) {
+	var c hybridClock
+	prev := c.Now()
+	for i := 0; i < 1000; i++ {
+		next := c.Now()
+		assert(t, next.After(prev), "Timestamp didn't move forward")
+		prev = next
+	}
+}
+
+func TestHLCObserveMovesPastPeer(t *testing.T) {
+	var c hybridClock
+
+	// A peer whose wall clock is ahead of ours, but not by too much
+	ahead := time.Now().Add(maxClockOffset / 2)
+	c.Observe(ahead)
+	assert(t, c.Now().After(ahead), "Write after a peer's isn't timestamped after it")
+
+	// Observing something older doesn't move the clock back
+	before := c.Now()
+	c.Observe(time.Now().Add(-time.Hour))
+	assert(t, c.Now().After(before), "Clock moved back")
+}
+
+func TestHLCBoundsTimestampsTooFarAhead(t *testing.T) {
+	var c hybridClock
+	c.Observe(time.Now().Add(time.Hour))
+	equals(t, 1, c.Skewed())
+	assert(t, c.Now().Before(time.Now().Add(maxClockOffset+time.Second)), "Clock followed a timestamp past the offset")
+}
+
+func TestReceiveTakesEntriesFromSkewedPeer(t *testing.T) {
+	// A peer whose clock runs an hour ahead of ours, for good
+	k := NewKVS()
+	g := GossipVals{kvs: k, view: NewView(testMain, testView)}
+	skewed := hlc.Skewed()
+	ahead := time.Now().Add(time.Hour)
+	taken := g.Receive(entryGlob{Keys: map[string]Entry{
+		keyExists: {Version: 1, Timestamp: ahead, Value: valtwo, Clock: map[string]int{}},
+	}})
+
+	// Its writes are kept and acked, with the timestamp they were made at
+	equals(t, 1, len(taken.Keys))
+	val, _ := k.Get(keyExists, map[string]int{})
+	equals(t, valtwo, val)
+	assert(t, k.GetTimestamp(keyExists).Equal(ahead.Round(0)), "Entry's timestamp was changed")
+	equals(t, skewed+1, hlc.Skewed())
+	assert(t, hlc.Now().Before(ahead), "Clock followed the skewed peer")
+}
+
+func TestLaterWriteBreaksTiesByNode(t *testing.T) {
+	now := time.Now()
+	assert(t, laterWrite(now.Add(time.Nanosecond), peerOne, now, peerTwo), "Later timestamp lost")
+	assert(t, laterWrite(now, peerTwo, now, peerOne), "Tie not broken by node")
+	assert(t, !laterWrite(now, peerOne, now, peerTwo), "Tie broken both ways")
+}
+
+// Two replicas that wrote the same version at the same time agree on the winner
+func TestConflictResolutionTieIsDeterministic(t *testing.T) {
+	now := hlc.Now()
+	one := Entry{Version: 1, Timestamp: now, Clock: map[string]int{keyExists: 1}, Value: valone, Node: peerOne}
+	two := Entry{Version: 1, Timestamp: now, Clock: map[string]int{keyExists: 1}, Value: valtwo, Node: peerTwo}
+
+	a, b := NewKVS(), NewKVS()
+	a.OverwriteEntry(keyExists, &one)
+	b.OverwriteEntry(keyExists, &two)
+	gossipBoth(a, b)
+
+	va, _ := a.Get(keyExists, map[string]int{})
+	vb, _ := b.Get(keyExists, map[string]int{})
+	equals(t, valtwo, va)
+	equals(t, valtwo, vb)
+}
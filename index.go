@@ -0,0 +1,237 @@
+// index.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines an ordered index over the keys in the KVS. The db itself is a map, which
+// can't be walked in order, so the KVS keeps a skip list of every key it holds next
+// to it. The index holds tombstones too, since they live in the db; scans skip
+// anything that isn't alive.
+//
+
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	indexMaxLevel = 24  // Enough levels for about 16 million keys at p = 1/2
+	indexP        = 0.5 // Probability of a node being promoted a level
+)
+
+// indexNode is a single key in the skip list
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+// keyIndex is a skip list of keys in lexical order. It isn't safe for concurrent use,
+// the KVS guards it with its own lock.
+type keyIndex struct {
+	head   *indexNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+// newKeyIndex creates an empty index
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  &indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// randomLevel picks the height of a new node
+func (x *keyIndex) randomLevel() int {
+	l := 1
+	for l < indexMaxLevel && x.rand.Float64() < indexP {
+		l++
+	}
+	return l
+}
+
+// path fills update with the rightmost node before key at every level
+func (x *keyIndex) path(key string, update []*indexNode) *indexNode {
+	n := x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		if update != nil {
+			update[i] = n
+		}
+	}
+	return n.next[0]
+}
+
+// Insert adds a key to the index, returning false if it was already there
+func (x *keyIndex) Insert(key string) bool {
+	if x == nil {
+		return false
+	}
+	update := make([]*indexNode, indexMaxLevel)
+	if n := x.path(key, update); n != nil && n.key == key {
+		return false
+	}
+
+	l := x.randomLevel()
+	if l > x.level {
+		for i := x.level; i < l; i++ {
+			update[i] = x.head
+		}
+		x.level = l
+	}
+	n := &indexNode{key: key, next: make([]*indexNode, l)}
+	for i := 0; i < l; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	x.length++
+	return true
+}
+
+// Remove deletes a key from the index, returning false if it wasn't there
+func (x *keyIndex) Remove(key string) bool {
+	if x == nil {
+		return false
+	}
+	update := make([]*indexNode, indexMaxLevel)
+	n := x.path(key, update)
+	if n == nil || n.key != key {
+		return false
+	}
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+	x.length--
+	return true
+}
+
+// Seek returns the first node whose key is >= key, or nil if there isn't one
+func (x *keyIndex) Seek(key string) *indexNode {
+	if x == nil {
+		return nil
+	}
+	return x.path(key, nil)
+}
+
+// Len returns the number of keys in the index
+func (x *keyIndex) Len() int {
+	if x == nil {
+		return 0
+	}
+	return x.length
+}
+
+// rangeQuery describes a scan over the index. Every bound is optional.
+type rangeQuery struct {
+	Prefix string // Only keys starting with this
+	Start  string // Only keys >= this
+	End    string // Only keys < this
+	After  string // Cursor from a previous page, only keys > this
+	Limit  int    // Maximum number of keys to return
+}
+
+// lower returns the smallest key the query could match
+func (q rangeQuery) lower() string {
+	low := q.Start
+	if q.Prefix > low {
+		low = q.Prefix
+	}
+	if q.After != "" && q.After >= low {
+		// The smallest string greater than After
+		low = q.After + "\x00"
+	}
+	return low
+}
+
+// matches returns true if the key falls inside the query's bounds
+func (q rangeQuery) matches(key string) bool {
+	if !strings.HasPrefix(key, q.Prefix) || key < q.Start {
+		return false
+	}
+	if q.After != "" && key <= q.After {
+		return false
+	}
+	return q.End == "" || key < q.End
+}
+
+// done returns true once the scan has moved past every key the query could match
+func (q rangeQuery) done(key string) bool {
+	if q.End != "" && key >= q.End {
+		return true
+	}
+	return !strings.HasPrefix(key, q.Prefix) && key > q.Prefix
+}
+
+// rangeResult is a page of keys from a scan
+type rangeResult struct {
+	Keys  []string       // Live keys in lexical order
+	Next  string         // Cursor for the next page, empty if this was the last one
+	Clock map[string]int // Causal history of every key returned merged with the client's
+	Stale bool           // True if the client has seen writes that we haven't
+}
+
+// Range scans the index for live keys matching the query and returns a page of them.
+// If the client's payload holds writes we haven't seen, the listing could be missing
+// them and would violate causality, so Stale is set instead.
+func (k *KVS) Range(q rangeQuery, payload map[string]int) rangeResult {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	res := rangeResult{Keys: []string{}, Clock: copyClock(payload)}
+	if q.Limit <= 0 {
+		q.Limit = rangeDefaultLimit
+	}
+
+	// Everything the client has seen has to have reached us
+	if !dots.Covers(payload, nil) {
+		res.Stale = true
+		return res
+	}
+
+	// A KVS that was built without NewKVS has no index, so make a throwaway one
+	index := k.index
+	if index == nil {
+		index = newKeyIndex()
+		for key := range k.db {
+			index.Insert(key)
+		}
+	}
+
+	for n := index.Seek(q.lower()); n != nil; n = n.next[0] {
+		if q.done(n.key) {
+			break
+		}
+		if !q.matches(n.key) {
+			continue
+		}
+		if alive, _ := k.contains(n.key); !alive {
+			continue
+		}
+		if len(res.Keys) == q.Limit {
+			// There's at least one more, so hand back a cursor
+			res.Next = res.Keys[len(res.Keys)-1]
+			break
+		}
+		res.Keys = append(res.Keys, n.key)
+		for c, v := range past(k.db[n.key]) {
+			if res.Clock[c] < v {
+				res.Clock[c] = v
+			}
+		}
+	}
+	return res
+}
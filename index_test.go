@@ -0,0 +1,115 @@
+// index_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the ordered key index and range scans
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// walk returns every key in the index in order
+func walk(x *keyIndex) []string {
+	var keys []string
+	for n := x.Seek(""); n != nil; n = n.next[0] {
+		keys = append(keys, n.key)
+	}
+	return keys
+}
+
+func TestIndexKeepsKeysInOrder(t *testing.T) {
+	x := newKeyIndex()
+	for _, k := range []string{"m", "a", "z", "c", "b"} {
+		assert(t, x.Insert(k), "Insert of %s failed", k)
+	}
+	assert(t, !x.Insert("c"), "Duplicate insert succeeded")
+	equals(t, []string{"a", "b", "c", "m", "z"}, walk(x))
+	equals(t, 5, x.Len())
+
+	assert(t, x.Remove("c"), "Remove failed")
+	assert(t, !x.Remove("c"), "Remove of missing key succeeded")
+	equals(t, []string{"a", "b", "m", "z"}, walk(x))
+	equals(t, "m", x.Seek("c").key)
+}
+
+func TestIndexHandlesManyKeys(t *testing.T) {
+	x := newKeyIndex()
+	for i := 999; i >= 0; i-- {
+		x.Insert(fmt.Sprintf("%04d", i))
+	}
+	keys := walk(x)
+	equals(t, 1000, len(keys))
+	for i, k := range keys {
+		equals(t, fmt.Sprintf("%04d", i), k)
+	}
+}
+
+// rangeKVS returns a KVS with a couple of namespaces of keys
+func rangeKVS() *KVS {
+	k := NewKVS()
+	for _, key := range []string{"users/bob", "users/alice", "users/carol", "users/dave", "groups/admin", "usersx"} {
+		k.Put(key, valone, time.Now(), map[string]int{})
+	}
+	k.Delete("users/carol", time.Now(), map[string]int{})
+	return k
+}
+
+func TestRangePrefixSkipsTombstones(t *testing.T) {
+	k := rangeKVS()
+	res := k.Range(rangeQuery{Prefix: "users/"}, map[string]int{})
+	equals(t, []string{"users/alice", "users/bob", "users/dave"}, res.Keys)
+	equals(t, "", res.Next)
+	assert(t, covers(res.Clock, k.db["users/bob"]), "Payload hasn't seen the keys listed")
+}
+
+func TestRangeStartEnd(t *testing.T) {
+	k := rangeKVS()
+	res := k.Range(rangeQuery{Start: "users/b", End: "users/d"}, map[string]int{})
+	equals(t, []string{"users/bob"}, res.Keys)
+}
+
+func TestRangePaginates(t *testing.T) {
+	k := rangeKVS()
+	res := k.Range(rangeQuery{Prefix: "users", Limit: 2}, map[string]int{})
+	equals(t, []string{"users/alice", "users/bob"}, res.Keys)
+	equals(t, "users/bob", res.Next)
+
+	res = k.Range(rangeQuery{Prefix: "users", After: res.Next, Limit: 2}, map[string]int{})
+	equals(t, []string{"users/dave", "usersx"}, res.Keys)
+	equals(t, "", res.Next)
+}
+
+func TestRangeStalePayload(t *testing.T) {
+	k := rangeKVS()
+
+	// The client has seen a write that we don't have, which could be in the range
+	res := k.Range(rangeQuery{Prefix: "users/"}, map[string]int{viewNotExist: 1})
+	assert(t, res.Stale, "Range didn't notice the stale payload")
+
+	// A payload we handed out ourselves is fine
+	res = k.Range(rangeQuery{Prefix: "users/"}, map[string]int{})
+	res = k.Range(rangeQuery{Prefix: "groups/"}, res.Clock)
+	assert(t, !res.Stale, "Range was stale for its own payload")
+}
+
+func TestRangeWithoutIndex(t *testing.T) {
+	k := rangeKVS()
+	k.index = nil
+	res := k.Range(rangeQuery{Prefix: "groups/"}, nil)
+	equals(t, []string{"groups/admin"}, res.Keys)
+}
+
+func TestPurgedKeyLeavesIndex(t *testing.T) {
+	k := rangeKVS()
+	k.CollectTombstones(nil, nil)
+	assert(t, k.index.Seek("users/carol").key != "users/carol", "Purged key still indexed")
+}
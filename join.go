@@ -0,0 +1,218 @@
+// join.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines how a new node joins the cluster through a seed. A node started with SEEDS
+// instead of VIEW opens a join session with one of the seeds over TCP. The seed adds
+// the node to its view, which spreads to the rest of the cluster like any other view
+// change, sends it the view, and then streams it every entry it holds as a series of
+// entryGlob chunks, ending with an empty one. The node takes the view and the entries
+// and then announces its own view.
+//
+// Until the transfer is done the node refuses key-value requests with a 503, since it
+// would be answering from a partial copy of the data, and doesn't push the entries it
+// receives on to its peers, since they came from the cluster in the first place.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A joinRequest opens a join session with a seed
+type joinRequest struct {
+	From string // Address of the node that's joining
+}
+
+// joining is 1 while the node is waiting on a state transfer from a seed
+var joining int32
+
+// isReady returns true once the node has its share of the data
+func isReady() bool {
+	return atomic.LoadInt32(&joining) == 0
+}
+
+// setReady marks whether the node has its share of the data
+func setReady(r bool) {
+	if r {
+		atomic.StoreInt32(&joining, 0)
+	} else {
+		atomic.StoreInt32(&joining, 1)
+	}
+}
+
+// whenReady refuses key-value requests with a 503 until the node is ready
+func whenReady(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() && strings.HasPrefix(r.URL.Path, rootURL) {
+			log.Println("Refusing request while joining")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable) // code 503
+			resp := map[string]interface{}{
+				"result": "Error",
+				"msg":    "Node is still joining",
+			}
+			body, err := json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+			w.Write(body)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Join tries the seeds in turn until one of them has taken us in and sent us its
+// data, then marks the node ready
+func (g *GossipVals) Join(seeds []string) {
+	for {
+		for _, seed := range seeds {
+			n, err := g.joinFrom(seed)
+			if err != nil {
+				log.Println("Error joining through "+seed+": ", err)
+				continue
+			}
+			log.Printf("Joined through %s, received %d keys\n", seed, n)
+			setReady(true)
+			return
+		}
+		time.Sleep(joinRetry)
+	}
+}
+
+// joinFrom runs a join session with a seed and returns the number of keys received
+func (g *GossipVals) joinFrom(seed string) (int, error) {
+	conn, rw, err := dial(seed, joinTimeout)
+	if err != nil {
+		return 0, errors.Wrap(err, "Client: Failed to open connection to "+seed)
+	}
+	defer conn.Close()
+	return g.join(rw)
+}
+
+// join runs a join session over an open connection and returns the number of keys
+// received
+func (g *GossipVals) join(rw *bufio.ReadWriter) (int, error) {
+	log.Println("Sending command initialization: 'join'")
+	n, err := rw.WriteString("join\n")
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	dec := gob.NewDecoder(rw)
+	err = enc.Encode(joinRequest{From: g.view.Primary()})
+	if err != nil {
+		return 0, errors.Wrap(err, "Encode failed for join request")
+	}
+	err = rw.Flush()
+	if err != nil {
+		return 0, errors.Wrap(err, "Flush failed.")
+	}
+
+	// The view comes first, and already has us in it
+	var v viewState
+	err = dec.Decode(&v)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error decoding view")
+	}
+	g.UpdateViews(v)
+
+	received := 0
+	for {
+		var chunk entryGlob
+		err = dec.Decode(&chunk)
+		if err != nil {
+			return received, errors.Wrap(err, "Error decoding entryGlob")
+		}
+		if len(chunk.Keys) == 0 {
+			break
+		}
+		g.Receive(chunk)
+		received += len(chunk.Keys)
+	}
+
+	// Let everyone else know about us too
+	viewChange = true
+	return received, nil
+}
+
+// handleJoin takes a new node into the view and sends it the view and every entry we hold
+func (e *Endpoint) handleJoin(rw *bufio.ReadWriter) {
+	var req joinRequest
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&req)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	log.Println("Node joining: " + req.From)
+	if !e.gossip.view.Contains(req.From) {
+		e.gossip.view.Add(req.From)
+	}
+
+	enc := gob.NewEncoder(rw)
+	send := func(data interface{}) bool {
+		err := enc.Encode(data)
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			log.Println("Error sending to joining node: ", err)
+			return false
+		}
+		return true
+	}
+	if !send(e.gossip.view.State()) {
+		return
+	}
+
+	// Entries are looked up a chunk at a time, so a key written during the transfer is
+	// sent as it is when its chunk goes out
+	all := e.gossip.kvs.GetTimeGlob()
+	chunk := timeGlob{List: make(map[string]time.Time)}
+	sent := 0
+	for key, t := range all.List {
+		chunk.List[key] = t
+		if len(chunk.List) < joinChunkSize {
+			continue
+		}
+		// Every key in the chunk may have been purged since, and an empty chunk would
+		// end the transfer early
+		eg := e.gossip.kvs.GetEntryGlob(chunk)
+		chunk = timeGlob{List: make(map[string]time.Time)}
+		if len(eg.Keys) == 0 {
+			continue
+		}
+		if !send(eg) {
+			return
+		}
+		sent += len(eg.Keys)
+	}
+	eg := e.gossip.kvs.GetEntryGlob(chunk)
+	if len(eg.Keys) > 0 && !send(eg) {
+		return
+	}
+	sent += len(eg.Keys)
+
+	// An empty chunk marks the end of the transfer
+	if send(entryGlob{}) {
+		log.Printf("Sent %d keys to %s\n", sent, req.From)
+	}
+}
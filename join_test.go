@@ -0,0 +1,120 @@
+// join_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for joining through a seed
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// joinThrough runs a join session for g with a seed answering from seed, without
+// going over the network
+func joinThrough(t *testing.T, g *GossipVals, seed GossipVals) int {
+	here, there := net.Pipe()
+	defer here.Close()
+	e := NewEndpoint()
+	e.gossip = seed
+	e.AddHandleFunc("join", e.handleJoin)
+	go e.handleMessages(there)
+
+	n, err := g.join(bufio.NewReadWriter(bufio.NewReader(here), bufio.NewWriter(here)))
+	ok(t, err)
+	return n
+}
+
+func TestJoinTransfersState(t *testing.T) {
+	// More keys than fit in a chunk, so the transfer takes several
+	seed := NewKVS()
+	now := time.Now()
+	n := 2*joinChunkSize + 10
+	for i := 0; i < n; i++ {
+		seed.Put(keyone+strconv.Itoa(i), valone, now, map[string]int{})
+	}
+	seed.Delete(keyone+"0", now.Add(time.Second), map[string]int{})
+
+	seedView := NewView(testMain, testMain)
+
+	joiner := NewKVS()
+	joinerView := NewView(viewExist, viewExist)
+	g := GossipVals{kvs: joiner, view: joinerView}
+
+	equals(t, n, joinThrough(t, &g, GossipVals{kvs: seed, view: seedView}))
+	assert(t, seedView.Contains(viewExist), "Seed didn't add the joining node to its view")
+	assert(t, joinerView.Contains(testMain), "Joining node didn't take the seed's view")
+	equals(t, seed.MerkleHashes([]int{1}), joiner.MerkleHashes([]int{1}))
+	alive, _ := joiner.Contains(keyone + "0")
+	assert(t, !alive, "Tombstone wasn't transferred")
+	v, _ := joiner.Get(keyone+strconv.Itoa(n-1), map[string]int{})
+	equals(t, valone, v)
+}
+
+// purgedKVS acts as if every key in the first chunk asked for was purged before it
+// was read
+type purgedKVS struct {
+	*KVS
+	chunks int
+}
+
+func (p *purgedKVS) GetEntryGlob(tg timeGlob) entryGlob {
+	p.chunks++
+	if p.chunks == 1 {
+		return entryGlob{Keys: map[string]Entry{}}
+	}
+	return p.KVS.GetEntryGlob(tg)
+}
+
+func TestJoinSkipsPurgedChunk(t *testing.T) {
+	seed := NewKVS()
+	now := time.Now()
+	n := 2*joinChunkSize + 10
+	for i := 0; i < n; i++ {
+		seed.Put(keyone+strconv.Itoa(i), valone, now, map[string]int{})
+	}
+
+	g := GossipVals{kvs: NewKVS(), view: NewView(viewExist, viewExist)}
+	seedGossip := GossipVals{kvs: &purgedKVS{KVS: seed}, view: NewView(testMain, testMain)}
+	equals(t, n-joinChunkSize, joinThrough(t, &g, seedGossip))
+}
+
+func TestJoiningNodeDoesntPushTransfer(t *testing.T) {
+	k := NewKVS()
+	setReady(false)
+	k.Put(keyone, valone, time.Now(), map[string]int{})
+	setReady(true)
+	equals(t, 0, len(k.deltas.Take().Keys))
+}
+
+func TestWhenReadyRefusesWhileJoining(t *testing.T) {
+	h := whenReady(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	setReady(false)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", rootURL+"/search", nil))
+	equals(t, http.StatusServiceUnavailable, rec.Code)
+
+	// The view can still be asked about while joining
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/view", nil))
+	equals(t, http.StatusOK, rec.Code)
+
+	setReady(true)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", rootURL+"/search", nil))
+	equals(t, http.StatusOK, rec.Code)
+}
@@ -18,12 +18,25 @@ import (
 	"log"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // KVS represents a key-value store and implements the dbAccess interface
 type KVS struct {
 	db    map[string]KeyEntry
 	mutex *sync.RWMutex
+	wal   *writeAheadLog // Durable log of mutations, nil if persistence is off
+	index *keyIndex      // Every key in the db in lexical order, see index.go
+	tree  *merkleTree    // Hashes of every key in the db for anti-entropy, see merkle.go
+
+	deltas *deltaBuffer // Recent mutations waiting to be pushed to peers, see delta.go
+
+	snapMutex sync.Mutex // Only one snapshot is taken at a time
+
+	acks      map[string]map[string]time.Time // Which peers have seen each tombstone, see tombstone.go
+	graveyard map[string]burial               // Purged tombstones, see tombstone.go
+	history   map[string][]revision           // Replaced versions of each key, see history.go
 }
 
 // KeyEntry interface defines methods to get the info associated with a key, and to update them accordingly
@@ -52,15 +65,38 @@ type KeyEntry interface {
 
 	// Set the version
 	SetVersion(int)
+
+	// Return the time the key expires at, zero if it never does
+	GetExpiry() time.Time
+
+	// Set the time the key expires at
+	SetExpiry(time.Time)
+
+	// Return the concurrent values of the key, nil if there's only one
+	GetSiblings() []sibling
+
+	// Return the typed value of the key, nil if it holds a plain string
+	GetCRDT() *crdtState
+
+	// Return the ID of the node that made the last write, it breaks timestamp ties
+	GetNode() string
+
+	// Return the counter of the last write on its node, the two together are its dot
+	GetDot() int
 }
 
 // Entry is the thing in the KVS and implements all the methods
 type Entry struct {
 	Version   int            // Monotonically increasing version numbers starting at 1
 	Timestamp time.Time      // this is set on writes
-	Clock     map[string]int // This is captured from the client payload on write
+	Clock     map[string]int // Causal context of the write, captured from the client payload, see dvv.go
 	Value     string         // This is the actual value
 	Tombstone bool           // Tombstone value showing that it was deleted
+	Expires   time.Time      // When the key expires, zero if it never does
+	Siblings  []sibling      // Concurrent values of the key, see siblings.go
+	CRDT      *crdtState     // Typed value of the key, nil for a plain string, see crdt.go
+	Node      string         // Node that made the last write, breaks ties between equal timestamps
+	Dot       int            // Counter of the last write on Node, the two together are its dot
 }
 
 // SetVersion the version
@@ -96,6 +132,10 @@ func NewEntry(time time.Time, clock map[string]int, val string, version int) *En
 	// Finally, set the value
 	e.Value = val
 
+	// This node is the one writing it, and gives the write its dot
+	e.Node = myIP
+	e.Dot = dots.Next()
+
 	// Return a pointer to the entry
 	return &e
 }
@@ -137,18 +177,68 @@ func (e *Entry) GetValue() string {
 	return ""
 }
 
-// Update writes a new value for the entry and updates the clock and version info
+// GetExpiry returns the time the entry expires at
+func (e *Entry) GetExpiry() time.Time {
+	if e != nil {
+		return e.Expires
+	}
+	return time.Time{}
+}
+
+// SetExpiry sets the time the entry expires at, the zero time means never
+func (e *Entry) SetExpiry(t time.Time) {
+	if e != nil {
+		e.Expires = t
+	}
+}
+
+// GetSiblings returns the concurrent values held by the entry
+func (e *Entry) GetSiblings() []sibling {
+	if e != nil {
+		return e.Siblings
+	}
+	return nil
+}
+
+// GetCRDT returns the typed value held by the entry
+func (e *Entry) GetCRDT() *crdtState {
+	if e != nil {
+		return e.CRDT
+	}
+	return nil
+}
+
+// GetNode returns the node that made the last write to the entry
+func (e *Entry) GetNode() string {
+	if e != nil {
+		return e.Node
+	}
+	return ""
+}
+
+// GetDot returns the counter of the last write to the entry on its node
+func (e *Entry) GetDot() int {
+	if e != nil {
+		return e.Dot
+	}
+	return 0
+}
+
+// Update writes a new value for the entry and updates the clock, dot and version info.
+// Any expiry on the old value is cleared.
 func (e *Entry) Update(key string, newTime time.Time, newClock map[string]int, newVal string) {
 	log.Println("Updating entry - old version: ", e)
 	e.Timestamp = newTime
 	e.Value = newVal
 	e.Clock = newClock
 	e.Tombstone = false
+	e.Expires = time.Time{}
+	e.Siblings = nil
+	e.CRDT = nil
+	e.Node = myIP
+	e.Dot = dots.Next()
 	e.Version++
-	e.Clock[key] = e.Version
 	log.Println("Updated entry: ", e)
-
-	wakeGossip = true
 }
 
 // Delete sets a tombstone that the key has been tombstone
@@ -158,10 +248,12 @@ func (e *Entry) Delete(key string, newTime time.Time, payload map[string]int) {
 	e.Value = ""
 	e.Clock = payload
 	e.Tombstone = true
+	e.Expires = time.Time{}
+	e.Siblings = nil
+	e.CRDT = nil
+	e.Node = myIP
+	e.Dot = dots.Next()
 	e.Version++
-	e.Clock[key] = e.Version
-
-	wakeGossip = true
 }
 
 // Alive returns true if the key exists and doesn't have a tombstone set
@@ -172,15 +264,164 @@ func (e *Entry) Alive() bool {
 	return false
 }
 
-// NewKVS initializes a KVS object and returns a pointer to it
+// NewKVS initializes a KVS object and returns a pointer to it. If a data directory
+// has been configured then the newest snapshot in it is loaded and the write-ahead
+// log after it is replayed into the db first.
 func NewKVS() *KVS {
 	var k KVS
 	k.db = make(map[string]KeyEntry)
 	var m sync.RWMutex
 	k.mutex = &m
+	k.index = newKeyIndex()
+	k.tree = newMerkleTree(merkleDepth)
+	k.deltas = newDeltaBuffer(deltaBufferSize)
+
+	if dataDir != "" {
+		snap, err := loadSnapshot(dataDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		k.restore(snap)
+
+		w, records, err := openWAL(dataDir, snap.Seq, walSync)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		k.replay(records)
+		k.wal = w
+
+		go k.snapshotLoop(snapshotInterval, snapshotThreshold)
+	}
 	return &k
 }
 
+// replay stores each record from the write-ahead log in order. Records hold the full
+// state of the key after the mutation so the last record for a key wins.
+func (k *KVS) replay(records []walRecord) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, rec := range records {
+		if rec.Op == walBatch {
+			for key, e := range rec.Batch {
+				entry := e
+				hlc.Observe(entry.Timestamp)
+				dots.ObserveEntry(&entry)
+				k.archive(key, entry.Timestamp)
+				k.db[key] = &entry
+				k.index.Insert(key)
+				k.rehash(key)
+				delete(k.graveyard, key)
+			}
+			continue
+		}
+		e := rec.Entry
+		hlc.Observe(e.Timestamp)
+		dots.ObserveEntry(&e)
+		if rec.Op == walForget {
+			delete(k.db, rec.Key)
+			delete(k.history, rec.Key)
+			k.index.Remove(rec.Key)
+			k.rehash(rec.Key)
+			continue
+		}
+		if rec.Op == walPurge {
+			k.bury(rec.Key, e, time.Now(), rec.Settled)
+			delete(k.db, rec.Key)
+			delete(k.history, rec.Key)
+			k.index.Remove(rec.Key)
+			k.rehash(rec.Key)
+			continue
+		}
+		k.archive(rec.Key, e.Timestamp)
+		k.db[rec.Key] = &e
+		k.index.Insert(rec.Key)
+		k.rehash(rec.Key)
+		delete(k.graveyard, rec.Key)
+	}
+	log.Printf("Replayed %d records, db has %d keys\n", len(records), len(k.db))
+}
+
+// errNotDurable is returned by a write that was applied but couldn't be logged
+var errNotDurable = errors.New("Write could not be logged")
+
+// logEntry appends the current state of the key to the write-ahead log, if there is one,
+// and pushes it to peers unless it's a purge or a migration. The caller must hold the write lock so
+// that records hit the log in the order they were applied. A write whose record couldn't be
+// appended isn't durable, so the error has to reach the client.
+func (k *KVS) logEntry(op walOp, key string) error {
+	if op != walPurge && op != walForget {
+		k.spread(key)
+	}
+	if k.wal == nil {
+		return nil
+	}
+	rec := walRecord{Op: op, Key: key, Entry: toEntry(k.db[key])}
+	if op == walPurge {
+		rec.Settled = k.graveyard[key].Settled
+	}
+	if err := k.wal.Append(rec); err != nil {
+		log.Println("Error appending to write-ahead log: ", err)
+		return errNotDurable
+	}
+	return nil
+}
+
+// logBatch appends the current state of every key in a batch to the write-ahead log as
+// a single record, and pushes them to peers. The caller must hold the write lock.
+func (k *KVS) logBatch(keys map[string]Entry) error {
+	for key := range keys {
+		k.spread(key)
+	}
+	if k.wal == nil {
+		return nil
+	}
+	rec := walRecord{Op: walBatch, Batch: make(map[string]Entry, len(keys))}
+	for key := range keys {
+		rec.Batch[key] = toEntry(k.db[key])
+	}
+	if err := k.wal.Append(rec); err != nil {
+		log.Println("Error appending to write-ahead log: ", err)
+		return errNotDurable
+	}
+	return nil
+}
+
+// Close flushes and closes the write-ahead log
+func (k *KVS) Close() error {
+	if k.wal != nil {
+		return k.wal.Close()
+	}
+	return nil
+}
+
+// toEntry copies a KeyEntry into an Entry struct so it can be encoded
+func toEntry(e KeyEntry) Entry {
+	clock := make(map[string]int)
+	for k, v := range e.GetClock() {
+		clock[k] = v
+	}
+	var sibs []sibling
+	for _, s := range e.GetSiblings() {
+		c := make(map[string]int, len(s.Clock))
+		for k, v := range s.Clock {
+			c[k] = v
+		}
+		sibs = append(sibs, sibling{Value: s.Value, Clock: c, Timestamp: s.Timestamp, Node: s.Node, Dot: s.Dot})
+	}
+	return Entry{
+		Timestamp: e.GetTimestamp(),
+		Clock:     clock,
+		Value:     e.GetValue(),
+		Version:   e.GetVersion(),
+		Tombstone: !e.Alive(),
+		Expires:   e.GetExpiry(),
+		Siblings:  sibs,
+		CRDT:      e.GetCRDT().copy(),
+		Node:      e.GetNode(),
+		Dot:       e.GetDot(),
+	}
+}
+
 // Contains returns true if the dbAccess object contains an object with key equal to the input, it checks the input payload to ensure proper version
 func (k *KVS) Contains(key string) (bool, int) {
 	log.Println("Checking to see if db contains key ")
@@ -193,15 +434,34 @@ func (k *KVS) Contains(key string) (bool, int) {
 	return alive, version
 }
 
-// contains is the unexported version of Contains() and does not hold a read lock
+// contains is the unexported version of Contains() and does not hold a read lock.
+// A purged tombstone still reports its version so causal checks keep working, and
+// a key past its expiry is reported as dead even if the reaper hasn't got to it yet.
 func (k *KVS) contains(key string) (bool, int) {
 	t := k.db[key]
 	if t != nil {
-		return t.Alive(), t.GetVersion()
+		return t.Alive() && !expired(t, time.Now()), t.GetVersion()
+	}
+	if b := k.buried(key); b != nil {
+		return false, b.GetVersion()
 	}
 	return false, 0
 }
 
+// Count returns the number of live keys in the db
+func (k *KVS) Count() int {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	n := 0
+	now := time.Now()
+	for _, e := range k.db {
+		if e.Alive() && !expired(e, now) {
+			n++
+		}
+	}
+	return n
+}
+
 // Get returns the value associated with a particular key. If the key does not exist it returns ""
 func (k *KVS) Get(key string, payload map[string]int) (val string, clock map[string]int) {
 	log.Println("Getting value associated with key ")
@@ -215,9 +475,9 @@ func (k *KVS) Get(key string, payload map[string]int) (val string, clock map[str
 	if version != 0 {
 		log.Println("Value found")
 
-		// Get the key and clock from the db
+		// Get the key and its causal history from the db
 		val = k.db[key].GetValue()
-		clock = k.db[key].GetClock()
+		clock = past(k.db[key])
 
 		// Add this key's causal history to the client's payload
 		clock = mergeClocks(payload, clock)
@@ -231,8 +491,9 @@ func (k *KVS) Get(key string, payload map[string]int) (val string, clock map[str
 	return "", payload
 }
 
-// Delete sets the tombstone associated with a particular key, updates its version and timestamp, so it appears dead
-func (k *KVS) Delete(key string, time time.Time, payload map[string]int) bool {
+// Delete sets the tombstone associated with a particular key, updates its version and timestamp, so it appears dead.
+// It returns an error if the delete couldn't be logged.
+func (k *KVS) Delete(key string, time time.Time, payload map[string]int) (bool, error) {
 	log.Println("Attempting to delete key ")
 	// Grab a write lock
 	k.mutex.Lock()
@@ -243,18 +504,23 @@ func (k *KVS) Delete(key string, time time.Time, payload map[string]int) bool {
 	// Call the nonlocking contains method
 	if doesExist {
 		log.Println("Key found, deleting key-value pair")
+		k.archive(key, time)
 		k.db[key].Delete(key, time, payload)
-
-		// Initiate Gossip
-		wakeGossip = true
-		return true
+		k.rehash(key)
+		return true, k.logEntry(walDelete, key)
 	}
 	log.Println("Key not found")
-	return false
+	return false, nil
 }
 
 // Put adds a key-value pair to the DB. If the key already exists, then it overwrites the existing value. If the key does not exist then it is added.
-func (k *KVS) Put(key string, val string, time time.Time, payload map[string]int) bool {
+// It returns an error if the write couldn't be logged.
+func (k *KVS) Put(key string, val string, timestamp time.Time, payload map[string]int) (bool, error) {
+	return k.PutWithExpiry(key, val, timestamp, payload, time.Time{})
+}
+
+// PutWithExpiry is Put for a key that expires at the given time. The zero time means the key never expires.
+func (k *KVS) PutWithExpiry(key string, val string, time time.Time, payload map[string]int, expires time.Time) (bool, error) {
 	maxVal := 1048576 // 1 megabyte
 	maxKey := 200     // 200 characters
 	keyLen := len(key)
@@ -268,26 +534,40 @@ func (k *KVS) Put(key string, val string, time time.Time, payload map[string]int
 		k.mutex.Lock()
 		defer k.mutex.Unlock()
 
-		doesExist, _ := k.contains(key)
-
-		// Check to see if the key exists
-		if doesExist {
-			// Update it
-			k.db[key].Update(key, time, payload, val)
-			log.Println("Overwriting existing key")
-			// Initiate Gossip
-			wakeGossip = true
-			return true
-		}
-		log.Println("Inserting new key")
-		// Use the constructor
-		k.db[key] = NewEntry(time, payload, val, 1)
-		// Initiate Gossip
-		wakeGossip = true
-		return true
+		return true, k.put(key, val, time, payload, expires)
 	}
 	log.Println("Invalid entry for key or value")
-	return false
+	return false, nil
+}
+
+// put is the unexported version of Put() and does not hold a write lock
+func (k *KVS) put(key string, val string, time time.Time, payload map[string]int, expires time.Time) error {
+	doesExist, _ := k.contains(key)
+
+	// In sibling mode a write whose payload hasn't seen the current value goes in next to it
+	if siblingsEnabled(key) && doesExist && !covers(payload, k.db[key]) {
+		log.Println("Write hasn't seen the current value, adding a sibling")
+		return k.addSibling(key, val, time, payload, expires)
+	}
+	k.archive(key, time)
+
+	// Check to see if the key exists
+	if doesExist {
+		// Update it
+		k.db[key].Update(key, time, payload, val)
+		k.db[key].SetExpiry(expires)
+		k.rehash(key)
+		log.Println("Overwriting existing key")
+		return k.logEntry(walPut, key)
+	}
+	log.Println("Inserting new key")
+	// Use the constructor
+	k.db[key] = NewEntry(time, payload, val, 1)
+	k.db[key].SetExpiry(expires)
+	k.index.Insert(key)
+	k.rehash(key)
+	delete(k.graveyard, key)
+	return k.logEntry(walPut, key)
 }
 
 // Add the server's keys to the clock if they don't already exist
@@ -308,7 +588,8 @@ func mergeClocks(client map[string]int, server map[string]int) map[string]int {
 	return client
 }
 
-// GetClock returns the clock associated with a key, it'll return an empty map for one that doesn't exist
+// GetClock returns the clock associated with a key, it'll return an empty map for one that doesn't exist.
+// Purged tombstones still report their clock so that stale copies of the key lose conflict resolution.
 func (k *KVS) GetClock(key string) map[string]int {
 	k.mutex.RLock()
 	defer k.mutex.RUnlock()
@@ -316,9 +597,25 @@ func (k *KVS) GetClock(key string) map[string]int {
 	if _, ok := k.db[key]; ok {
 		return k.db[key].GetClock()
 	}
+	if b := k.buried(key); b != nil {
+		return b.GetClock()
+	}
 	return map[string]int{}
 }
 
+// GetDot returns the counter of the last write to a key on the node that made it, otherwise 0
+func (k *KVS) GetDot(key string) int {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if _, ok := k.db[key]; ok {
+		return k.db[key].GetDot()
+	}
+	if b := k.buried(key); b != nil {
+		return b.GetDot()
+	}
+	return 0
+}
+
 // GetTimestamp returns the timestamp associated witha  key, otherwise an empty struct
 func (k *KVS) GetTimestamp(key string) time.Time {
 	k.mutex.RLock()
@@ -327,20 +624,95 @@ func (k *KVS) GetTimestamp(key string) time.Time {
 	if _, ok := k.db[key]; ok {
 		return k.db[key].GetTimestamp()
 	}
+	if b := k.buried(key); b != nil {
+		return b.GetTimestamp()
+	}
 	return time.Time{}
 }
 
+// GetNode returns the node that made the last write to a key, otherwise an empty string
+func (k *KVS) GetNode(key string) string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if _, ok := k.db[key]; ok {
+		return k.db[key].GetNode()
+	}
+	if b := k.buried(key); b != nil {
+		return b.GetNode()
+	}
+	return ""
+}
+
 // OverwriteEntry overwrites the entry associated with the given key using the given entry
 func (k *KVS) OverwriteEntry(key string, entry KeyEntry) {
 	if entry != nil {
 		log.Println("Overwriting entry: ", k.db[key])
 		k.mutex.Lock()
 		defer k.mutex.Unlock()
+		k.archive(key, entry.GetTimestamp())
 		k.db[key] = entry
+		k.index.Insert(key)
+		k.rehash(key)
+		delete(k.graveyard, key)
+		if err := k.logEntry(walOverwrite, key); err != nil {
+			log.Println("Error logging entry: ", err)
+		}
 		log.Println("New entry: ", entry)
 	}
 }
 
+// OverwriteEntries writes every key in the glob that wins against our copy under a
+// single write lock, so that a batch that arrives through gossip is never seen half
+// applied. Typed keys are joined with our copy. Other keys are settled by their
+// resolver against what we hold at the time of the write, not an earlier read, so a
+// write that lands in between can't be overwritten by an entry it would have beaten.
+func (k *KVS) OverwriteEntries(eg entryGlob) {
+	if len(eg.Keys) == 0 {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	written := make(map[string]Entry, len(eg.Keys))
+	for key, e := range eg.Keys {
+		entry := e
+		cur, ok := k.db[key]
+		if alive, _ := k.contains(key); alive && entry.Alive() && sameCRDT(cur, &entry) {
+			// Typed values are joined, and if ours already has everything there's nothing to write
+			var changed bool
+			if entry, changed = mergeCRDT(key, toEntry(cur), entry); !changed {
+				continue
+			}
+		} else {
+			// The key's resolver decides whether it's taken, and what's kept, like
+			// siblings for concurrent values
+			r := resolverFor(key)
+			var bob KeyEntry
+			if b := k.entry(key); b != nil {
+				bob = b
+			}
+			if !r.Resolve(key, &entry, bob) {
+				continue
+			}
+			if ok {
+				entry = r.Merge(key, entry, cur)
+			}
+		}
+		k.archive(key, entry.Timestamp)
+		k.db[key] = &entry
+		k.index.Insert(key)
+		k.rehash(key)
+		delete(k.graveyard, key)
+		written[key] = entry
+	}
+	if len(written) == 0 {
+		return
+	}
+	if err := k.logBatch(written); err != nil {
+		log.Println("Error logging entries: ", err)
+	}
+	log.Printf("Overwrote %d entries\n", len(written))
+}
+
 // GetTimeGlob returns a struct containing a map of keys to their timestamps
 func (k *KVS) GetTimeGlob() timeGlob {
 	if k != nil {
@@ -359,6 +731,33 @@ func (k *KVS) GetTimeGlob() timeGlob {
 	return timeGlob{}
 }
 
+// GetEntry returns a copy of a key's entry, or nil if we've never seen the key. It's
+// read under one lock, so it can't mix the fields of two writes. A purged tombstone
+// is returned as a tombstone, and an expired key as deleted.
+func (k *KVS) GetEntry(key string) *Entry {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.entry(key)
+}
+
+// entry is GetEntry for a caller that already holds a lock
+func (k *KVS) entry(key string) *Entry {
+	var t KeyEntry
+	if e := k.db[key]; e != nil {
+		t = e
+	} else if b := k.buried(key); b != nil {
+		t = b
+	} else {
+		return nil
+	}
+	e := toEntry(t)
+	if expired(t, time.Now()) {
+		e.Tombstone = true
+		e.Value, e.Siblings, e.CRDT = "", nil, nil
+	}
+	return &e
+}
+
 // GetEntryGlob returns a struct containing a map of keys to their entries
 func (k *KVS) GetEntryGlob(tg timeGlob) entryGlob {
 	if k != nil {
@@ -367,19 +766,10 @@ func (k *KVS) GetEntryGlob(tg timeGlob) entryGlob {
 		entries := make(map[string]Entry)
 		eg := entryGlob{Keys: entries}
 		for n := range tg.List {
-			time := k.db[n].GetTimestamp()
-			clock := k.db[n].GetClock()
-			value := k.db[n].GetValue()
-			version := k.db[n].GetVersion()
-			tombstone := !k.db[n].Alive()
-			e := Entry{
-				Timestamp: time,
-				Clock:     clock,
-				Value:     value,
-				Version:   version,
-				Tombstone: tombstone,
+			// The key may have been purged since the timeGlob was built
+			if e, ok := k.db[n]; ok {
+				eg.Keys[n] = toEntry(e)
 			}
-			eg.Keys[n] = e
 		}
 		log.Println("Built entryGlob: ", eg)
 		return eg
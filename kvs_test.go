@@ -47,6 +47,30 @@ func (e *testEntry) Delete(key string, time time.Time, payload map[string]int) {
 	// goes nowhere does nothing
 }
 
+func (e *testEntry) GetExpiry() time.Time {
+	return time.Time{}
+}
+
+func (e *testEntry) SetExpiry(t time.Time) {
+	// goes nowhere does nothing
+}
+
+func (e *testEntry) GetSiblings() []sibling {
+	return nil
+}
+
+func (e *testEntry) GetCRDT() *crdtState {
+	return nil
+}
+
+func (e *testEntry) GetNode() string {
+	return ""
+}
+
+func (e *testEntry) GetDot() int {
+	return 0
+}
+
 // This tests for a key that does not exist in the db, the KVS should return version -1 and alive == false
 func TestKVSContainsCheckIfDoesntExist(t *testing.T) {
 	db := map[string]KeyEntry{}
@@ -119,7 +143,9 @@ func TestKVSDeleteExistingKeyValPair(t *testing.T) {
 
 	var m sync.RWMutex
 	k := KVS{db: db, mutex: &m}
-	assert(t, k.Delete(keyExists, time.Now(), map[string]int{}), "Did not delete Key Val Pair")
+	wrote, err := k.Delete(keyExists, time.Now(), map[string]int{})
+	ok(t, err)
+	assert(t, wrote, "Did not delete Key Val Pair")
 }
 
 // Delete on a key that doesn't exist should return false
@@ -127,7 +153,9 @@ func TestKVSDeleteKeyDoesntExist(t *testing.T) {
 	db := map[string]KeyEntry{}
 	var m sync.RWMutex
 	k := KVS{db: db, mutex: &m}
-	assert(t, !k.Delete(keyNotHere, time.Now(), map[string]int{}), "Deleted a keyvalue pair not in data store prior")
+	wrote, err := k.Delete(keyNotHere, time.Now(), map[string]int{})
+	ok(t, err)
+	assert(t, !wrote, "Deleted a keyvalue pair not in data store prior")
 }
 
 // Put() with a new key should return true
@@ -135,7 +163,9 @@ func TestKVSPutNewKeyNewVal(t *testing.T) {
 	db := map[string]KeyEntry{}
 	var m sync.RWMutex
 	k := KVS{db: db, mutex: &m}
-	assert(t, k.Put(keyone, valone, time.Now(), nil), "New key and value were not added")
+	wrote, err := k.Put(keyone, valone, time.Now(), nil)
+	ok(t, err)
+	assert(t, wrote, "New key and value were not added")
 }
 
 // Overwriting a value should return true
@@ -151,7 +181,9 @@ func TestKVSPutExistKeyOverwriteVal(t *testing.T) {
 	}
 	var m sync.RWMutex
 	k := KVS{db: db, mutex: &m}
-	assert(t, k.Put(keyone, valtwo, time.Now(), nil), "Did not overwrite existing key's value")
+	wrote, err := k.Put(keyone, valtwo, time.Now(), nil)
+	ok(t, err)
+	assert(t, wrote, "Did not overwrite existing key's value")
 
 }
 
@@ -160,7 +192,9 @@ func TestKVSPutInvalidkey(t *testing.T) {
 	db := map[string]KeyEntry{}
 	var m sync.RWMutex
 	k := KVS{db: db, mutex: &m}
-	assert(t, !k.Put(invalidKey, valtwo, time.Now(), nil), "Invalid key added")
+	wrote, err := k.Put(invalidKey, valtwo, time.Now(), nil)
+	ok(t, err)
+	assert(t, !wrote, "Invalid key added")
 }
 
 // Put() with an invalid value should fail
@@ -172,7 +206,9 @@ func TestKVSPutInvalidVal(t *testing.T) {
 		b.WriteByte(0)
 	}
 	invalidVal := b.String()
-	assert(t, !k.Put(keyone, invalidVal, time.Now(), nil), "Invalid value added")
+	wrote, err := k.Put(keyone, invalidVal, time.Now(), nil)
+	ok(t, err)
+	assert(t, !wrote, "Invalid value added")
 }
 
 // GetVersion of an existing entry should return the version
@@ -421,7 +457,7 @@ func TestDeleteClearsValue(t *testing.T) {
 	equals(t, "", e.GetValue())
 }
 
-// Delete should set clock to the new version
+// Delete should set the clock to the payload and give the delete a new dot
 func TestDeleteUpdatesClock(t *testing.T) {
 	start := time.Now()
 	time.Sleep(1)
@@ -430,16 +466,18 @@ func TestDeleteUpdatesClock(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     map[string]int{viewExist: 1},
 		Value:     valone,
 		Tombstone: false,
+		Dot:       1,
 	}
 
-	e.Delete(keyExists, finish, map[string]int{})
-	equals(t, map[string]int{keyExists: 2}, e.GetClock())
+	e.Delete(keyExists, finish, map[string]int{viewExist: 3})
+	equals(t, map[string]int{viewExist: 3}, e.GetClock())
+	assert(t, e.GetDot() > 1, "Delete didn't get a new dot")
 }
 
-// Update should set the clock to include the key you've updated
+// Update should set the clock to the payload it was given
 func TestUpdateSetsInitialClock(t *testing.T) {
 	e := Entry{
 		Version:   1,
@@ -449,10 +487,11 @@ func TestUpdateSetsInitialClock(t *testing.T) {
 		Tombstone: false,
 	}
 	initialClock := map[string]int{
-		keyExists: 2,
+		viewExist: 2,
 	}
 	e.Update(keyExists, time.Now(), initialClock, valtwo)
-	equals(t, initialClock, e.GetClock())
+	equals(t, map[string]int{viewExist: 2}, e.GetClock())
+	equals(t, myIP, e.GetNode())
 }
 
 // NewEntry should set an initial clock value
@@ -572,6 +611,21 @@ func TestOverwriteEntryNotExists(t *testing.T) {
 	k.OverwriteEntry(keyExists, &second)
 	equals(t, &second, k.db[keyExists])
 }
+
+// A copy of a key read before a newer write landed doesn't replace that write
+func TestOverwriteEntriesResolvesAgainstCurrent(t *testing.T) {
+	k := NewKVS()
+	now := time.Now()
+	k.Put(keyExists, valone, now, map[string]int{})
+	stale := *k.GetEntry(keyExists)
+	_, clock := k.Get(keyExists, map[string]int{})
+	k.Put(keyExists, valtwo, now.Add(time.Second), clock)
+
+	k.OverwriteEntries(entryGlob{Keys: map[string]Entry{keyExists: stale}})
+	val, _ := k.Get(keyExists, map[string]int{})
+	equals(t, valtwo, val)
+}
+
 func TestGetTimeGlobKeyExists(t *testing.T) {
 	timestamp := time.Now()
 	initialClock := map[string]int{
@@ -626,6 +680,30 @@ func TestGetEntryGlobKeyExist(t *testing.T) {
 	equals(t, l, h)
 }
 
+func TestGetEntry(t *testing.T) {
+	k := NewKVS()
+	now := time.Now()
+	equals(t, (*Entry)(nil), k.GetEntry(keyExists))
+
+	k.Put(keyExists, valExists, now, map[string]int{})
+	e := k.GetEntry(keyExists)
+	equals(t, valExists, e.Value)
+	equals(t, 1, e.Version)
+	equals(t, now, e.Timestamp)
+	assert(t, !e.Tombstone, "Live key came back deleted")
+
+	k.Delete(keyExists, now.Add(time.Second), map[string]int{})
+	e = k.GetEntry(keyExists)
+	assert(t, e.Tombstone, "Deleted key came back live")
+	equals(t, 2, e.Version)
+
+	// An expired key is deleted as far as anyone else is concerned
+	k.PutWithExpiry(keyone, valone, now, map[string]int{}, now.Add(-time.Second))
+	e = k.GetEntry(keyone)
+	assert(t, e.Tombstone, "Expired key came back live")
+	equals(t, "", e.Value)
+}
+
 func TestSetVersionSetsVersion(t *testing.T) {
 	e := NewEntry(time.Now(), map[string]int{}, valExists, 1)
 	e.SetVersion(2)
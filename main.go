@@ -23,6 +23,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Versioning info defined via linker flags at compile time
@@ -53,30 +56,201 @@ func main() {
 	myIP = os.Getenv("IP_PORT")
 
 	log.Println("My IP is " + myIP)
+	replicaID = myIP + "@" + strconv.FormatInt(time.Now().UnixNano(), 36)
 
 	// VIEW is defined at runtime in the docker command as a string
 	str := os.Getenv("VIEW")
 	log.Println("My view is: " + str)
 
+	// SEEDS lists nodes to join through, it's only used if VIEW isn't set
+	var seeds []string
+	if str == "" {
+		for _, s := range strings.Split(os.Getenv("SEEDS"), ",") {
+			if s != "" && s != myIP {
+				seeds = append(seeds, s)
+			}
+		}
+		// Until we hear back from a seed we're the only node we know about
+		str = myIP
+		if len(seeds) > 0 {
+			log.Println("Joining through seeds: ", seeds)
+			setReady(false)
+		}
+	}
+
+	// SHARDS divides the view into shard groups, the view starts out with this many
+	if s := os.Getenv("SHARDS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			setNumShards(n)
+		} else {
+			log.Println("Ignoring invalid SHARDS: ", s)
+		}
+	}
+
 	// Create a viewlist and load the view into it
 	MyView := NewView(myIP, str)
 
-	// Make a KVS to use as the db
+	// DATA_DIR and WAL_SYNC control where and how the KVS persists its writes
+	dataDir = os.Getenv("DATA_DIR")
+	walSync = os.Getenv("WAL_SYNC")
+	switch walSync {
+	case walSyncAlways, walSyncInterval, walSyncNone:
+	default:
+		walSync = walSyncAlways
+	}
+	log.Println("Data directory: " + dataDir + ", WAL sync policy: " + walSync)
+
+	// SNAPSHOT_INTERVAL and SNAPSHOT_BYTES control how often the KVS snapshots itself
+	snapshotInterval = durationEnv("SNAPSHOT_INTERVAL", defaultSnapshotInterval)
+	snapshotThreshold = defaultSnapshotThreshold
+	if s := os.Getenv("SNAPSHOT_BYTES"); s != "" {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			snapshotThreshold = n
+		} else {
+			log.Println("Ignoring invalid SNAPSHOT_BYTES: ", err)
+		}
+	}
+	log.Printf("Snapshot interval: %v, threshold: %d bytes\n", snapshotInterval, snapshotThreshold)
+
+	// MAX_CLOCK_OFFSET bounds how far ahead of our wall clock a peer's timestamp can be
+	maxClockOffset = durationEnv("MAX_CLOCK_OFFSET", defaultMaxClockOffset)
+	log.Printf("Max clock offset: %v\n", maxClockOffset)
+
+	// TOMBSTONE_GRACE and TOMBSTONE_RETENTION control when deleted keys are purged
+	tombstoneGrace = durationEnv("TOMBSTONE_GRACE", defaultTombstoneGrace)
+	tombstoneRetention = durationEnv("TOMBSTONE_RETENTION", defaultTombstoneRetention)
+	log.Printf("Tombstone grace: %v, retention: %v\n", tombstoneGrace, tombstoneRetention)
+
+	// HISTORY_DEPTH and HISTORY_AGE bound how many replaced versions of each key are kept
+	if s := os.Getenv("HISTORY_DEPTH"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			historyDepth = n
+		} else {
+			log.Println("Ignoring invalid HISTORY_DEPTH: ", err)
+		}
+	}
+	historyMaxAge = durationEnv("HISTORY_AGE", 0)
+	log.Printf("History depth: %d, max age: %v\n", historyDepth, historyMaxAge)
+
+	// SIBLING_PREFIXES lists the key prefixes that keep concurrent writes as siblings
+	siblingPrefixes = parsePrefixes(os.Getenv("SIBLING_PREFIXES"))
+	log.Println("Sibling prefixes: ", siblingPrefixes)
+
+	// CONFLICT_POLICY and CONFLICT_POLICIES pick the conflict resolver for each key prefix
+	if s := os.Getenv("CONFLICT_POLICY"); s != "" {
+		if r, err := newResolver(s); err == nil {
+			defaultResolver = r
+		} else {
+			log.Println("Ignoring invalid CONFLICT_POLICY: ", err)
+		}
+	}
+	if policies, err := parsePolicies(os.Getenv("CONFLICT_POLICIES")); err == nil {
+		conflictPolicies = policies
+	} else {
+		log.Fatalln(err)
+	}
+	log.Printf("Conflict policies: %+v, default: %T\n", conflictPolicies, defaultResolver)
+
+	// GOSSIP_FANOUT, GOSSIP_INTERVAL, GOSSIP_JITTER and GOSSIP_PEERS control gossip rounds
+	if s := os.Getenv("GOSSIP_FANOUT"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			gossipFanout = n
+		} else {
+			log.Println("Ignoring invalid GOSSIP_FANOUT: ", s)
+		}
+	}
+	gossipInterval = durationEnv("GOSSIP_INTERVAL", defaultGossipInterval)
+	gossipJitter = durationEnv("GOSSIP_JITTER", 0)
+	if s := os.Getenv("GOSSIP_PEERS"); s != "" {
+		if p, err := newSelector(s); err == nil {
+			peerSelection = p
+		} else {
+			log.Println("Ignoring invalid GOSSIP_PEERS: ", err)
+		}
+	}
+	if s := os.Getenv("PHI_THRESHOLD"); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f >= 0 {
+			phiThreshold = f
+		} else {
+			log.Println("Ignoring invalid PHI_THRESHOLD: ", s)
+		}
+	}
+	log.Printf("Phi threshold: %v\n", phiThreshold)
+	if s := os.Getenv("REPLICAS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			replicas = n
+		} else {
+			log.Println("Ignoring invalid REPLICAS: ", s)
+		}
+	}
+	// Every member of a shard holds every key in it, so there's nothing for REPLICAS to do
+	if replicas > 0 && numShards() > 1 {
+		log.Println("Ignoring REPLICAS, it can't be combined with SHARDS")
+		replicas = 0
+	}
+	if s := os.Getenv("VNODES"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			virtualNodes = n
+		} else {
+			log.Println("Ignoring invalid VNODES: ", s)
+		}
+	}
+	log.Printf("Replicas per key: %d, virtual nodes per member: %d\n", replicas, virtualNodes)
+	log.Printf("Gossip fanout: %d, interval: %v, jitter: %v, peers: %T\n", gossipFanout, gossipInterval, gossipJitter, peerSelection)
+
+	// Make a KVS to use as the db, this replays the write-ahead log if there is one
 	k := NewKVS()
 
-	// The App object is the front end and has references to the KVS and viewList
-	a := App{db: k, view: *MyView}
+	// Start the reaper that turns expired keys into tombstones
+	go k.reapLoop(reapInterval)
 
 	log.Println("Starting server...")
 
 	// The gossip object controls communicating with other servers and has references to the viewlist and the kvs
 	gossip := GossipVals{
-		view: MyView,
-		kvs:  k,
+		view:   MyView,
+		kvs:    k,
+		deltas: k.deltas,
+		book:   newSyncBook(),
 	}
+
+	// The App object is the front end and has references to the KVS and viewList, and
+	// to gossip for handing off data when the node is decommissioned
+	a := App{db: k, view: *MyView, gossip: &gossip, stop: func() {
+		log.Println("Shutting down")
+		if err := k.Close(); err != nil {
+			log.Println("Error closing the KVS: ", err)
+		}
+		os.Exit(0)
+	}}
 	// Start the heartbeat loop
 	go gossip.GossipHeartbeat() // goroutines
+	// Start pushing writes to peers as they're made
+	go gossip.PushLoop()
+	// Start the failure detector
+	go gossip.ProbeLoop()
+	// Start handing keys off to their new owners when the view changes
+	go gossip.RebalanceLoop()
+	// Join the cluster through a seed if we weren't given a view
+	if len(seeds) > 0 {
+		go gossip.Join(seeds)
+	}
 
 	// Start the servers with references to the REST app and the gossip module
 	server(a, gossip)
 }
+
+// durationEnv reads a duration like "30s" from the environment, falling back to def
+// if the variable isn't set or can't be parsed
+func durationEnv(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Println("Ignoring invalid "+name+": ", err)
+		return def
+	}
+	return d
+}
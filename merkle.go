@@ -0,0 +1,264 @@
+// merkle.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the Merkle tree each replica keeps over its key space for anti-entropy. Keys
+// hash into a fixed number of leaves and every node of the tree holds a hash of the
+// keys under it, so two replicas holding the same keys at the same timestamps have the
+// same root. A gossip round starts by comparing roots, and is done after a single hash
+// if they match. Otherwise the initiator asks for the children of every node that
+// differs, down to the leaves, and only the keys in the leaves that differ go into the
+// timeGlob it sends.
+//
+// A node's hash is the XOR of the hashes of the keys under it, and a key's hash covers
+// its name and timestamp, so a write only updates the nodes on the path from its leaf
+// to the root. A typed key's hash also covers the digest of its state, since merges on
+// two replicas can leave different states at the same timestamp. The tree covers tombstones, since they're in the db, but not the
+// graveyard.
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+// merkleTree holds the hashes of a replica's keys. It isn't safe for concurrent use,
+// the KVS guards it with its own lock.
+type merkleTree struct {
+	nodes  []uint64               // Hashes in heap order, the root is 1 and the children of n are 2n and 2n+1
+	leaves []map[string]merkleKey // The keys under each leaf
+	dead   []int                  // Number of tombstones under each leaf
+}
+
+// merkleKey is a key in a leaf of the tree
+type merkleKey struct {
+	hash uint64
+	dead bool // The key is a tombstone
+}
+
+// merkleDiff is what a comparison of our tree with a peer's found
+type merkleDiff struct {
+	Leaves   []int          // Leaf nodes whose hashes differ
+	Matched  map[int]uint64 // Nodes whose hashes matched, and the hash they had
+	Frontier map[string]int // Dots the peer had seen before it hashed its tree
+}
+
+// newMerkleTree creates an empty tree with 1<<depth leaves
+func newMerkleTree(depth int) *merkleTree {
+	return &merkleTree{
+		nodes:  make([]uint64, 2<<uint(depth)),
+		leaves: make([]map[string]merkleKey, 1<<uint(depth)),
+		dead:   make([]int, 1<<uint(depth)),
+	}
+}
+
+// keyHash returns the hash of a key at a timestamp with the digest of its typed state
+func keyHash(key string, ts time.Time, digest uint64) uint64 {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], digest)
+	h := fnv.New64a()
+	h.Write(b[:])
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// leafOf returns the index of the leaf a key is under
+func (t *merkleTree) leafOf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() & uint64(len(t.leaves)-1))
+}
+
+// isLeaf returns true if the node is a leaf
+func (t *merkleTree) isLeaf(n int) bool {
+	return n >= len(t.leaves)
+}
+
+// flip XORs a change to a leaf into it and every node above it
+func (t *merkleTree) flip(leaf int, delta uint64) {
+	for n := len(t.leaves) + leaf; n > 0; n /= 2 {
+		t.nodes[n] ^= delta
+	}
+}
+
+// Update sets the timestamp and digest of a key and whether it's a tombstone, adding
+// it if it isn't in the tree
+func (t *merkleTree) Update(key string, ts time.Time, digest uint64, dead bool) {
+	if t == nil {
+		return
+	}
+	t.Remove(key)
+	l := t.leafOf(key)
+	if t.leaves[l] == nil {
+		t.leaves[l] = make(map[string]merkleKey)
+	}
+	mk := merkleKey{hash: keyHash(key, ts, digest), dead: dead}
+	t.flip(l, mk.hash)
+	t.leaves[l][key] = mk
+	if dead {
+		t.dead[l]++
+	}
+}
+
+// Remove takes a key out of the tree
+func (t *merkleTree) Remove(key string) {
+	if t == nil {
+		return
+	}
+	l := t.leafOf(key)
+	if mk, ok := t.leaves[l][key]; ok {
+		t.flip(l, mk.hash)
+		delete(t.leaves[l], key)
+		if mk.dead {
+			t.dead[l]--
+		}
+	}
+}
+
+// Hashes returns the hash of each of the given nodes, 0 for a node outside the tree
+func (t *merkleTree) Hashes(nodes []int) []uint64 {
+	out := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		if n > 0 && n < len(t.nodes) {
+			out[i] = t.nodes[n]
+		}
+	}
+	return out
+}
+
+// Keys calls f for every key under a node
+func (t *merkleTree) Keys(n int, f func(key string)) {
+	t.walk(n, false, f)
+}
+
+// Tombstones calls f for every tombstone under a node. Leaves without any are
+// skipped, so it's cheap once tombstones have been collected.
+func (t *merkleTree) Tombstones(n int, f func(key string)) {
+	t.walk(n, true, f)
+}
+
+// walk calls f for the keys under a node, or only the tombstones if dead is set
+func (t *merkleTree) walk(n int, dead bool, f func(key string)) {
+	if n <= 0 || n >= len(t.nodes) {
+		return
+	}
+	lo, hi := n, n+1
+	for !t.isLeaf(lo) {
+		lo, hi = 2*lo, 2*hi
+	}
+	for l := lo - len(t.leaves); l < hi-len(t.leaves); l++ {
+		if dead && t.dead[l] == 0 {
+			continue
+		}
+		for key, mk := range t.leaves[l] {
+			if mk.dead || !dead {
+				f(key)
+			}
+		}
+	}
+}
+
+// compareMerkle compares our tree with a peer's, starting from the root and only
+// descending into nodes that differ. ask returns the peer's hashes for a set of nodes.
+func compareMerkle(db dbAccess, ask func([]int) ([]uint64, error)) (merkleDiff, error) {
+	diff := merkleDiff{Matched: make(map[int]uint64)}
+	leaves := 1 << merkleDepth
+	level := []int{1}
+	for len(level) > 0 {
+		theirs, err := ask(level)
+		if err != nil {
+			return diff, err
+		}
+		ours := db.MerkleHashes(level)
+
+		var next []int
+		for i, n := range level {
+			switch {
+			case i < len(theirs) && ours[i] == theirs[i]:
+				diff.Matched[n] = ours[i]
+			case n >= leaves:
+				diff.Leaves = append(diff.Leaves, n)
+			default:
+				next = append(next, 2*n, 2*n+1)
+			}
+		}
+		level = next
+	}
+	return diff, nil
+}
+
+// merkle returns the KVS's tree. A KVS that was built without NewKVS has none, so a
+// throwaway one is made. The caller must hold a lock.
+func (k *KVS) merkle() *merkleTree {
+	if k.tree != nil {
+		return k.tree
+	}
+	t := newMerkleTree(merkleDepth)
+	for key, e := range k.db {
+		t.Update(key, e.GetTimestamp(), e.GetCRDT().digest(), !e.Alive())
+	}
+	return t
+}
+
+// rehash brings a key's place in the Merkle tree up to date after it's been written
+// or purged. The caller must hold the write lock.
+func (k *KVS) rehash(key string) {
+	if e, ok := k.db[key]; ok {
+		k.tree.Update(key, e.GetTimestamp(), e.GetCRDT().digest(), !e.Alive())
+	} else {
+		k.tree.Remove(key)
+	}
+}
+
+// MerkleHashes returns the hashes of the given nodes of our Merkle tree
+func (k *KVS) MerkleHashes(nodes []int) []uint64 {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.merkle().Hashes(nodes)
+}
+
+// GetLeafGlob is GetTimeGlob for only the keys under the given nodes of our Merkle tree
+func (k *KVS) GetLeafGlob(nodes []int) timeGlob {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	t := k.merkle()
+	tg := timeGlob{List: make(map[string]time.Time)}
+	for _, n := range nodes {
+		t.Keys(n, func(key string) {
+			tg.List[key] = k.db[key].GetTimestamp()
+			if d := k.db[key].GetCRDT().digest(); d != 0 {
+				if tg.Digests == nil {
+					tg.Digests = make(map[string]uint64)
+				}
+				tg.Digests[key] = d
+			}
+		})
+	}
+	return tg
+}
+
+// AckMerkle records that peer holds every tombstone under the nodes of our Merkle tree
+// that matched its own. A node whose hash has changed since is skipped, since what's
+// under it now might not have reached the peer.
+func (k *KVS) AckMerkle(peer string, matched map[int]uint64) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	t := k.merkle()
+	for n, h := range matched {
+		if t.Hashes([]int{n})[0] != h {
+			continue
+		}
+		t.Tombstones(n, func(key string) {
+			k.ack(peer, key, k.db[key].GetTimestamp())
+		})
+	}
+}
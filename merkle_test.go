@@ -0,0 +1,110 @@
+// merkle_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for Merkle tree anti-entropy
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// twinKVS returns two KVSs holding the same n keys at the same timestamps
+func twinKVS(n int) (*KVS, *KVS) {
+	a, b := NewKVS(), NewKVS()
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		key := keyone + strconv.Itoa(i)
+		a.Put(key, valone, now, map[string]int{})
+		b.Put(key, valone, now, map[string]int{})
+	}
+	return a, b
+}
+
+// counting wraps a KVS's hashes so a test can see how many nodes were asked for
+func counting(k *KVS, asked *int) func([]int) ([]uint64, error) {
+	return func(nodes []int) ([]uint64, error) {
+		*asked += len(nodes)
+		return k.MerkleHashes(nodes), nil
+	}
+}
+
+func TestMerkleTreeIsIncremental(t *testing.T) {
+	k := NewKVS()
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		k.Put(keyone+strconv.Itoa(i), valone, now, map[string]int{})
+	}
+	k.Put(keyone+"3", valtwo, now.Add(time.Second), map[string]int{})
+	k.Delete(keyone+"4", now.Add(time.Second), map[string]int{})
+	k.Delete(keyone+"5", now.Add(time.Second), map[string]int{})
+	k.CollectTombstones(nil, nil)
+
+	// A tree rebuilt from the db matches the one kept up to date write by write
+	tree := k.tree
+	k.tree = nil
+	equals(t, k.merkle().nodes, tree.nodes)
+	equals(t, k.merkle().dead, tree.dead)
+}
+
+func TestCompareMerkleInSync(t *testing.T) {
+	a, b := twinKVS(100)
+
+	asked := 0
+	diff, err := compareMerkle(a, counting(b, &asked))
+	ok(t, err)
+	equals(t, 0, len(diff.Leaves))
+	equals(t, 1, asked)
+}
+
+func TestCompareMerkleFindsDifferingLeaf(t *testing.T) {
+	a, b := twinKVS(100)
+	a.Put(keyone+"7", valtwo, time.Now().Add(time.Second), map[string]int{})
+
+	asked := 0
+	diff, err := compareMerkle(a, counting(b, &asked))
+	ok(t, err)
+	equals(t, 1, len(diff.Leaves))
+	equals(t, 2*merkleDepth+1, asked)
+
+	// Only the keys under the leaf that differs need to be sent
+	glob := a.GetLeafGlob(diff.Leaves)
+	_, found := glob.List[keyone+"7"]
+	assert(t, found, "Changed key isn't in the leaf glob")
+	assert(t, len(glob.List) < 100, "Leaf glob holds every key")
+}
+
+func TestAckMerkle(t *testing.T) {
+	a, b := twinKVS(10)
+	now := time.Now().Add(time.Second)
+	a.Delete(keyone+"1", now, map[string]int{})
+	b.Delete(keyone+"1", now, map[string]int{})
+
+	diff, err := compareMerkle(a, counting(b, new(int)))
+	ok(t, err)
+	a.AckMerkle(peerOne, diff.Matched)
+	equals(t, 1, a.CollectTombstones([]string{peerOne}, nil))
+}
+
+func TestAckMerkleSkipsChangedNodes(t *testing.T) {
+	a, b := twinKVS(10)
+	now := time.Now().Add(time.Second)
+	a.Delete(keyone+"1", now, map[string]int{})
+	b.Delete(keyone+"1", now, map[string]int{})
+
+	diff, err := compareMerkle(a, counting(b, new(int)))
+	ok(t, err)
+
+	// A tombstone written after the comparison can't be acknowledged by it
+	a.Delete(keyone+"2", now, map[string]int{})
+	a.AckMerkle(peerOne, diff.Matched)
+	equals(t, 0, a.CollectTombstones([]string{peerOne}, nil))
+}
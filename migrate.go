@@ -0,0 +1,241 @@
+// migrate.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines how keys are streamed to a new owner. The sender opens a migrate session
+// and sends the keys as entries, with the clock and dot they were written with, so
+// a client's causal payload means the same thing at the new owner as it did at the
+// old one. The first chunk carries the view, so an owner that hadn't heard of the
+// change yet takes it before deciding what it owns.
+//
+// The owner answers every chunk with the keys it took. The sender keeps at most
+// migrateWindow chunks unanswered, so a slow owner slows the stream down instead of
+// piling chunks up in its buffers. An empty chunk ends the session. Which keys go
+// where is decided in rebalance.go, and in decommission.go for a node that's leaving,
+// whose keys are taken by their owners in the view without it.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A migrateRequest carries keys to their new owner, along with the view they're sent
+// under and the address of the sender if it's leaving the view
+type migrateRequest struct {
+	View    viewState
+	Entries entryGlob
+	Leaving string
+}
+
+// A migrateAck lists the keys the owner took from a chunk, or ends the session
+type migrateAck struct {
+	Keys []string
+	Done bool
+}
+
+// Forget drops every key in the timeGlob that's still at the given timestamp, without
+// leaving a tombstone, and returns the number dropped. It's used once a key has moved
+// to its new owners, and a key written since it was sent is kept to be sent again.
+func (k *KVS) Forget(tg timeGlob) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	n := 0
+	for key, ts := range tg.List {
+		e, ok := k.db[key]
+		if !ok || !e.GetTimestamp().Equal(ts) {
+			continue
+		}
+		if err := k.logEntry(walForget, key); err != nil {
+			log.Println("Error logging forgotten key: ", err)
+		}
+		delete(k.db, key)
+		delete(k.history, key)
+		delete(k.acks, key)
+		k.index.Remove(key)
+		k.rehash(key)
+		n++
+	}
+	return n
+}
+
+// chunks splits a timeGlob into pieces of at most n keys
+func chunks(tg timeGlob, n int) []timeGlob {
+	var out []timeGlob
+	cur := timeGlob{List: make(map[string]time.Time)}
+	for k, t := range tg.List {
+		cur.List[k] = t
+		if len(cur.List) == n {
+			out = append(out, cur)
+			cur = timeGlob{List: make(map[string]time.Time)}
+		}
+	}
+	if len(cur.List) > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// sendMigrate streams keys to a new owner and calls taken with the keys it took from
+// each chunk
+func (g *GossipVals) sendMigrate(ip string, tg timeGlob, taken func(map[string]time.Time)) error {
+	conn, rw, err := dial(ip, migrateTimeout)
+	if err != nil {
+		return errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+	return g.migrate(conn, rw, tg, taken)
+}
+
+// migrate is the sender's half of a migrate session. The connection's deadline is
+// pushed back with every chunk sent and every answer read, so migrateTimeout bounds
+// how long the owner takes over one chunk rather than the whole stream.
+func (g *GossipVals) migrate(conn net.Conn, rw *bufio.ReadWriter, tg timeGlob, taken func(map[string]time.Time)) error {
+	log.Println("Sending command initialization: 'migrate'")
+	_, err := rw.WriteString("migrate\n")
+	if err != nil {
+		return errors.Wrap(err, "Starting migrate session failed")
+	}
+
+	// Answers are read as they come, and every one frees up a place in the window
+	window := make(chan struct{}, migrateWindow)
+	done := make(chan error, 1)
+	go func() {
+		dec := gob.NewDecoder(rw)
+		for {
+			var ack migrateAck
+			err := dec.Decode(&ack)
+			if err != nil {
+				done <- errors.Wrap(err, "Error decoding migrateAck")
+				return
+			}
+			if ack.Done {
+				done <- nil
+				return
+			}
+			err = conn.SetReadDeadline(time.Now().Add(migrateTimeout))
+			if err != nil {
+				done <- errors.Wrap(err, "Extending the deadline failed")
+				return
+			}
+			select {
+			case <-window:
+			default:
+			}
+			acked := make(map[string]time.Time, len(ack.Keys))
+			for _, k := range ack.Keys {
+				acked[k] = tg.List[k]
+			}
+			taken(acked)
+		}
+	}()
+
+	enc := gob.NewEncoder(rw)
+	view := g.view.State()
+	var leaving string
+	if isLeaving() {
+		leaving = g.view.Primary()
+	}
+	for _, chunk := range chunks(tg, migrateChunkSize) {
+		// An empty chunk would end the session, and keys can be gone by now
+		eg := g.kvs.GetEntryGlob(chunk)
+		if len(eg.Keys) == 0 {
+			continue
+		}
+		select {
+		case window <- struct{}{}:
+		case err := <-done:
+			if err == nil {
+				err = errors.New("Owner ended the session early")
+			}
+			return err
+		}
+		err = conn.SetDeadline(time.Now().Add(migrateTimeout))
+		if err != nil {
+			return errors.Wrap(err, "Extending the deadline failed")
+		}
+		err = enc.Encode(migrateRequest{View: view, Entries: eg, Leaving: leaving})
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			return errors.Wrap(err, "Sending migrated keys failed")
+		}
+		// Only the first chunk needs the view
+		view = viewState{}
+	}
+
+	err = conn.SetDeadline(time.Now().Add(migrateTimeout))
+	if err == nil {
+		err = enc.Encode(migrateRequest{})
+	}
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Ending migrate session failed")
+	}
+	return <-done
+}
+
+// handleMigrate takes chunks of keys moved to us until the sender is done, answering
+// each with the keys we own
+func (e *Endpoint) handleMigrate(rw *bufio.ReadWriter) {
+	dec := gob.NewDecoder(rw)
+	enc := gob.NewEncoder(rw)
+	for {
+		var req migrateRequest
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Println("Error decoding GOB data:", err)
+			return
+		}
+		ack := migrateAck{Done: len(req.Entries.Keys) == 0}
+		if !ack.Done {
+			ack = e.gossip.take(req)
+		}
+		err = enc.Encode(ack)
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			log.Println("Error sending migrateAck: ", err)
+			return
+		}
+		if ack.Done {
+			return
+		}
+	}
+}
+
+// take stores a chunk of migrated keys and returns the ones we took
+func (g *GossipVals) take(req migrateRequest) migrateAck {
+	// The sender may know about a change to the view that we don't yet
+	g.UpdateViews(req.View)
+
+	// A sender that's leaving hands keys off to their owners in the view without it
+	members := g.view.List()
+	if req.Leaving != "" {
+		members = without(members, req.Leaving)
+	}
+
+	// Only the keys we stored are acked, the sender keeps the rest
+	var ack migrateAck
+	for key := range g.receiveAs(req.Entries, members).Keys {
+		ack.Keys = append(ack.Keys, key)
+	}
+	log.Printf("Took %d migrated keys\n", len(ack.Keys))
+	return ack
+}
@@ -0,0 +1,235 @@
+// peers.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines how gossip picks the peers it syncs with each round, and the bookkeeping it
+// keeps on every peer to do so. The strategy is set with GOSSIP_PEERS:
+//
+//   random  - a uniformly random sample of the view
+//   round   - the view in order, picking up where the last round left off
+//   oldest  - the peers we've gone longest without syncing with
+//   latency - a random sample weighted towards peers that answer quickly
+//
+// GOSSIP_FANOUT sets how many peers are picked, and GOSSIP_INTERVAL and GOSSIP_JITTER
+// how long gossip waits between rounds when nothing wakes it.
+//
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// These are the names the peer selection strategies are configured by
+const (
+	selectRandom  = "random"
+	selectRound   = "round"
+	selectOldest  = "oldest"
+	selectLatency = "latency"
+)
+
+// peerSync is what we know about syncing with a peer
+type peerSync struct {
+	LastSync time.Time     // When the last round with the peer succeeded
+	Latency  time.Duration // Moving average of how long a round with the peer takes
+	Failures int           // Rounds with the peer that have failed in a row
+}
+
+// syncBook keeps a peerSync for every peer we've gossiped with
+type syncBook struct {
+	mutex sync.Mutex
+	peers map[string]peerSync
+}
+
+// newSyncBook creates an empty book
+func newSyncBook() *syncBook {
+	return &syncBook{peers: make(map[string]peerSync)}
+}
+
+// Record notes a round of gossip with a peer, how long it took and whether it failed
+func (b *syncBook) Record(peer string, took time.Duration, err error) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	p := b.peers[peer]
+	if err != nil {
+		p.Failures++
+		b.peers[peer] = p
+		return
+	}
+	p.LastSync = time.Now()
+	p.Failures = 0
+	if p.Latency == 0 {
+		p.Latency = took
+	} else {
+		// Recent rounds count for a fifth, so one slow round doesn't swing it
+		p.Latency = (4*p.Latency + took) / 5
+	}
+	b.peers[peer] = p
+}
+
+// Get returns what we know about a peer, the zero peerSync if we've never gossiped with it
+func (b *syncBook) Get(peer string) peerSync {
+	if b == nil {
+		return peerSync{}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.peers[peer]
+}
+
+// peerSelector picks which peers gossip syncs with in a round
+type peerSelector interface {
+	// Select returns up to n of the peers
+	Select(peers []string, n int, book *syncBook) []string
+}
+
+// newSelector returns the peer selection strategy with the given name
+func newSelector(name string) (peerSelector, error) {
+	switch name {
+	case selectRandom:
+		return randomSelector{}, nil
+	case selectRound:
+		return &roundSelector{}, nil
+	case selectOldest:
+		return oldestSelector{}, nil
+	case selectLatency:
+		return latencySelector{}, nil
+	}
+	return nil, errors.New("Unknown peer selection " + name)
+}
+
+// shuffled returns the peers in a random order
+func shuffled(peers []string) []string {
+	out := make([]string, len(peers))
+	for i, j := range rand.Perm(len(peers)) {
+		out[i] = peers[j]
+	}
+	return out
+}
+
+// first returns up to n of the peers from the start of the slice
+func first(peers []string, n int) []string {
+	if n < len(peers) {
+		return peers[:n]
+	}
+	return peers
+}
+
+// randomSelector picks a uniformly random sample of the peers
+type randomSelector struct{}
+
+// Select picks n peers at random
+func (randomSelector) Select(peers []string, n int, book *syncBook) []string {
+	return first(shuffled(peers), n)
+}
+
+// roundSelector goes through the peers in order, so every peer is synced with once
+// every len(peers)/n rounds
+type roundSelector struct {
+	mutex sync.Mutex
+	next  int // Where the next round starts
+}
+
+// Select picks the n peers after the ones picked last round
+func (r *roundSelector) Select(peers []string, n int, book *syncBook) []string {
+	if len(peers) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), peers...)
+	sort.Strings(sorted)
+	if n > len(sorted) {
+		n = len(sorted)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var out []string
+	for i := 0; i < n; i++ {
+		out = append(out, sorted[(r.next+i)%len(sorted)])
+	}
+	r.next = (r.next + n) % len(sorted)
+	return out
+}
+
+// oldestSelector picks the peers we've gone longest without syncing with, so a peer
+// that's behind is caught up first
+type oldestSelector struct{}
+
+// Select picks the n peers synced with least recently, ties are broken at random
+func (oldestSelector) Select(peers []string, n int, book *syncBook) []string {
+	out := shuffled(peers)
+	sort.SliceStable(out, func(i, j int) bool {
+		return book.Get(out[i]).LastSync.Before(book.Get(out[j]).LastSync)
+	})
+	return first(out, n)
+}
+
+// latencySelector picks peers at random, with a peer's chance of being picked going
+// down as the time it takes to sync with it and the rounds it has failed go up
+type latencySelector struct{}
+
+// Select picks n peers, weighted by how quickly they answer
+func (latencySelector) Select(peers []string, n int, book *syncBook) []string {
+	// Peers we haven't timed yet are treated like the fastest one, so they get tried
+	fastest := time.Duration(0)
+	for _, p := range peers {
+		if l := book.Get(p).Latency; l > 0 && (fastest == 0 || l < fastest) {
+			fastest = l
+		}
+	}
+	if fastest == 0 {
+		fastest = time.Millisecond
+	}
+
+	weights := make([]float64, len(peers))
+	for i, p := range peers {
+		s := book.Get(p)
+		l := s.Latency
+		if l == 0 {
+			l = fastest
+		}
+		weights[i] = 1 / (float64(l) * float64(1+s.Failures))
+	}
+
+	// Draw without replacement
+	left := append([]string(nil), peers...)
+	var out []string
+	for len(out) < n && len(left) > 0 {
+		total := 0.0
+		for _, w := range weights {
+			total += w
+		}
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(left)-1 && r >= weights[i]; i++ {
+			r -= weights[i]
+		}
+		out = append(out, left[i])
+		left = append(left[:i], left[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return out
+}
+
+// roundDeadline returns how long gossip waits before its next round, the interval plus
+// a random amount of jitter so that replicas don't all gossip at the same moment
+func roundDeadline() time.Duration {
+	d := gossipInterval
+	if gossipJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(gossipJitter)))
+	}
+	return d
+}
@@ -0,0 +1,86 @@
+// peers_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for gossip peer selection
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testPeers = []string{testMain, viewExist, viewNotExist}
+
+func TestNewSelector(t *testing.T) {
+	for _, name := range []string{selectRandom, selectRound, selectOldest, selectLatency} {
+		s, err := newSelector(name)
+		ok(t, err)
+		equals(t, 2, len(s.Select(testPeers, 2, newSyncBook())))
+		equals(t, 3, len(s.Select(testPeers, 5, newSyncBook())))
+		equals(t, 0, len(s.Select(nil, 2, newSyncBook())))
+	}
+	_, err := newSelector("nearest")
+	assert(t, err != nil, "Unknown selection was accepted")
+}
+
+func TestRoundSelectorCycles(t *testing.T) {
+	s := &roundSelector{}
+	equals(t, []string{testMain, viewExist}, s.Select(testPeers, 2, nil))
+	equals(t, []string{viewNotExist, testMain}, s.Select(testPeers, 2, nil))
+	equals(t, []string{viewExist, viewNotExist}, s.Select(testPeers, 2, nil))
+}
+
+func TestOldestSelectorPrefersUnsynced(t *testing.T) {
+	book := newSyncBook()
+	book.Record(testMain, time.Millisecond, nil)
+	time.Sleep(time.Millisecond)
+	book.Record(viewExist, time.Millisecond, nil)
+
+	equals(t, []string{viewNotExist, testMain}, oldestSelector{}.Select(testPeers, 2, book))
+}
+
+func TestLatencySelectorPrefersFastPeers(t *testing.T) {
+	book := newSyncBook()
+	book.Record(testMain, time.Millisecond, nil)
+	book.Record(viewExist, time.Second, nil)
+	book.Record(viewNotExist, time.Millisecond, errors.New("timed out"))
+	book.Record(viewNotExist, time.Millisecond, errors.New("timed out"))
+
+	picked := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		picked[latencySelector{}.Select(testPeers, 1, book)[0]]++
+	}
+	assert(t, picked[testMain] > picked[viewNotExist], "Failing peer picked as often as a healthy one")
+	assert(t, picked[viewNotExist] > picked[viewExist], "Slow peer picked as often as a fast one")
+}
+
+func TestSyncBookRecord(t *testing.T) {
+	book := newSyncBook()
+	book.Record(testMain, 10*time.Millisecond, nil)
+	book.Record(testMain, 20*time.Millisecond, nil)
+	equals(t, 12*time.Millisecond, book.Get(testMain).Latency)
+
+	book.Record(testMain, 0, errors.New("refused"))
+	equals(t, 1, book.Get(testMain).Failures)
+	book.Record(testMain, 10*time.Millisecond, nil)
+	equals(t, 0, book.Get(testMain).Failures)
+	assert(t, book.Get(viewExist).LastSync.IsZero(), "Unknown peer has been synced")
+}
+
+func TestRoundDeadlineJitter(t *testing.T) {
+	gossipJitter = time.Second
+	defer func() { gossipJitter = 0 }()
+
+	for i := 0; i < 100; i++ {
+		d := roundDeadline()
+		assert(t, d >= gossipInterval && d < gossipInterval+gossipJitter, "Deadline outside the jitter")
+	}
+}
@@ -0,0 +1,139 @@
+// phi.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a phi accrual failure detector. Every time we hear from a peer, whether
+// it's a probe, a sync session or a round of gossip, the time since we last heard
+// from it is added to a window of recent gaps. Phi is how unlikely it is that the
+// current silence is just another gap from that window, on a log scale: a phi of 1
+// means about a 10% chance, 2 means 1%, and so on. Since the window tracks what's
+// normal for each peer, a slow host raises the bar instead of tripping a fixed
+// timeout.
+//
+// Peers with a phi above the threshold, set with PHI_THRESHOLD, are skipped by
+// gossip. The same detector runs over contact from any peer at all, and a replica
+// whose phi for that goes above the threshold asks its peers for help.
+//
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// anyPeer is the window that hearing from any peer at all is recorded in
+const anyPeer = ""
+
+// arrivalWindow holds the most recent gaps between hearing from a peer, in seconds
+type arrivalWindow struct {
+	last time.Time
+	gaps []float64
+	next int // Where the next gap goes once the window is full
+}
+
+// add records hearing from the peer at the given time
+func (w *arrivalWindow) add(at time.Time) {
+	if !w.last.IsZero() {
+		gap := at.Sub(w.last).Seconds()
+		if len(w.gaps) < phiWindow {
+			w.gaps = append(w.gaps, gap)
+		} else {
+			w.gaps[w.next] = gap
+			w.next = (w.next + 1) % phiWindow
+		}
+	}
+	w.last = at
+}
+
+// phi returns how suspicious it is not to have heard from the peer by now
+func (w *arrivalWindow) phi(now time.Time) float64 {
+	if len(w.gaps) == 0 {
+		return 0
+	}
+	mean := 0.0
+	for _, g := range w.gaps {
+		mean += g
+	}
+	mean /= float64(len(w.gaps))
+	variance := 0.0
+	for _, g := range w.gaps {
+		variance += (g - mean) * (g - mean)
+	}
+	std := math.Max(math.Sqrt(variance/float64(len(w.gaps))), phiMinStdDev.Seconds())
+	return phi(now.Sub(w.last).Seconds(), mean, std)
+}
+
+// phi returns -log10 of the chance that a gap drawn from a normal distribution with
+// the given mean and standard deviation is longer than elapsed. It uses the logistic
+// approximation of the normal distribution, and is capped at phiMax.
+func phi(elapsed float64, mean float64, std float64) float64 {
+	y := (elapsed - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	var p float64
+	if elapsed > mean {
+		p = -math.Log10(e / (1 + e))
+	} else {
+		p = -math.Log10(1 - 1/(1+e))
+	}
+	if math.IsNaN(p) || p > phiMax {
+		return phiMax
+	}
+	return p
+}
+
+// phiDetector keeps an arrival window for every peer we've heard from
+type phiDetector struct {
+	mutex   sync.Mutex
+	windows map[string]*arrivalWindow
+}
+
+// heartbeats records when we've heard from each peer
+var heartbeats phiDetector
+
+// Heard records hearing from a peer just now
+func (d *phiDetector) Heard(peer string) {
+	d.heardAt(peer, time.Now())
+}
+
+// heardAt records hearing from a peer at the given time, and from any peer
+func (d *phiDetector) heardAt(peer string, at time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.windows == nil {
+		d.windows = make(map[string]*arrivalWindow)
+	}
+	for _, p := range []string{peer, anyPeer} {
+		if d.windows[p] == nil {
+			d.windows[p] = &arrivalWindow{}
+		}
+		d.windows[p].add(at)
+	}
+}
+
+// Phi returns how suspicious the silence from a peer is right now, 0 if we haven't
+// heard from it enough to tell
+func (d *phiDetector) Phi(peer string) float64 {
+	return d.phiAt(peer, time.Now())
+}
+
+// phiAt returns how suspicious the silence from a peer is at the given time
+func (d *phiDetector) phiAt(peer string, now time.Time) float64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if w := d.windows[peer]; w != nil {
+		return w.phi(now)
+	}
+	return 0
+}
+
+// Suspicious returns true if the silence from a peer is past the threshold
+func (d *phiDetector) Suspicious(peer string) bool {
+	return phiThreshold > 0 && d.Phi(peer) > phiThreshold
+}
@@ -0,0 +1,68 @@
+// phi_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for phi accrual failure detection
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// beat records hearing from a peer n times, gap apart, ending at last
+func beat(d *phiDetector, peer string, n int, gap time.Duration, last time.Time) {
+	for i := n - 1; i >= 0; i-- {
+		d.heardAt(peer, last.Add(-time.Duration(i)*gap))
+	}
+}
+
+func TestPhiGrowsWithSilence(t *testing.T) {
+	var d phiDetector
+	last := time.Now()
+	beat(&d, viewExist, 10, time.Second, last)
+
+	assert(t, d.phiAt(viewExist, last.Add(time.Second)) < 1, "Usual gap is suspicious")
+	assert(t, d.phiAt(viewExist, last.Add(3*time.Second)) > defaultPhiThreshold, "Long silence isn't suspicious")
+	equals(t, 0.0, d.phiAt(viewNotExist, last))
+}
+
+func TestPhiAdaptsToSlowPeers(t *testing.T) {
+	var d phiDetector
+	last := time.Now()
+	beat(&d, viewExist, 10, time.Second, last)
+	beat(&d, viewNotExist, 10, 5*time.Second, last)
+
+	// The same silence means different things for peers that are heard from at different rates
+	assert(t, d.phiAt(viewExist, last.Add(3*time.Second)) > d.phiAt(viewNotExist, last.Add(3*time.Second)), "Slow peer is as suspicious as a fast one")
+	assert(t, d.phiAt(viewNotExist, last.Add(3*time.Second)) < 1, "Slow peer is suspicious within its usual gap")
+}
+
+func TestPhiIsCapped(t *testing.T) {
+	var d phiDetector
+	last := time.Now()
+	beat(&d, viewExist, 10, time.Second, last)
+
+	p := d.phiAt(viewExist, last.Add(time.Hour))
+	equals(t, phiMax, p)
+	_, err := json.Marshal(p)
+	ok(t, err)
+}
+
+func TestReachableSkipsSuspicious(t *testing.T) {
+	beat(&heartbeats, viewExist, 10, time.Second, time.Now().Add(-time.Minute))
+	beat(&heartbeats, "176.32.164.10:8084", 10, time.Second, time.Now())
+	defer func() { heartbeats = phiDetector{} }()
+
+	g := GossipVals{view: NewView(testMain, testView)}
+	equals(t, []string{"176.32.164.10:8084"}, g.reachable())
+	equals(t, 2, len(g.live()))
+	assert(t, !heartbeats.Suspicious(anyPeer), "Replica that just heard from a peer is starved")
+}
@@ -0,0 +1,447 @@
+// rebalance.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines how data moves when the owners of keys change. Every node remembers the
+// layout of the view, its members and number of shards, from before the last change.
+// When the view changes it compares the owners of every key it holds under the old and
+// new layouts. A key goes to each owner it gained, sent by the first old owner that
+// still owns it, and a key we no longer own goes to all of its new owners. The keys
+// are streamed over the TCP endpoint, see migrate.go, and a key we no longer own is
+// only dropped once every new owner has taken it, as long as it hasn't been written
+// again since it was sent. Anything left over is sent again on the next pass.
+//
+// Once a node has handed off everything it has to, it tells the rest of the view. A
+// new owner keeps reading keys it hasn't been sent yet from their old owners until
+// every live member of the old layout has told it that it's done, so a key is never
+// missing while it moves. Writes go to the new owners from the start.
+//
+// GET /node/rebalance reports how far along the hand-off is.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A layout is what decides who owns a key
+type layout struct {
+	members []string
+	shards  int
+	ring    *hashRing // Every layout gets its own ring, so comparing two doesn't rebuild them
+}
+
+// newLayout returns the current layout of a view
+func newLayout(v View) *layout {
+	m := v.List()
+	sort.Strings(m)
+	return &layout{members: m, shards: v.Shards(), ring: &hashRing{}}
+}
+
+// partitioned returns true if keys are divided between the members under the layout
+func (l *layout) partitioned() bool {
+	return replicas > 0 || l.shards > 1
+}
+
+// owners returns the members that own a key under the layout
+func (l *layout) owners(key string) []string {
+	if !l.partitioned() {
+		return l.members
+	}
+	return l.ring.ownersWith(key, l.members, l.shards)
+}
+
+// A rebalanceDone tells the other members that a node has handed off everything it
+// had to for a view
+type rebalanceDone struct {
+	From  string
+	Epoch int
+}
+
+// rebalancer tracks the hand-off from one layout to the next
+type rebalancer struct {
+	mutex   sync.Mutex
+	me      string
+	from    *layout                         // The layout before the change, nil when there's nothing to do
+	to      *layout                         // The layout being moved to
+	epoch   int                             // The epoch of the view being moved to
+	started time.Time                       // When the change was noticed
+	sent    bool                            // True once we've handed off everything we have to
+	moved   int                             // Keys new owners have taken
+	taken   map[string]map[string]time.Time // The keys each new owner has taken, at the timestamp sent
+	left    map[string]int                  // The keys each new owner still has to take
+	done    map[string]int                  // The newest epoch each member has said it's done with
+}
+
+// rebalance is the hand-off every change to the view goes through
+var rebalance rebalancer
+
+// begin starts handing off to a new layout. If the last hand-off hadn't finished, the
+// layout before it is kept, since its old owners may still be holding keys.
+func (r *rebalancer) begin(me string, from *layout, to *layout, epoch int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.finished() {
+		r.from = from
+	}
+	r.me = me
+	r.to = to
+	r.epoch = epoch
+	r.started = time.Now()
+	r.sent = false
+	r.moved = 0
+	r.taken = make(map[string]map[string]time.Time)
+	r.left = make(map[string]int)
+	log.Printf("Rebalancing for epoch %d\n", epoch)
+}
+
+// waiting returns the live members of the old layout that haven't said they're done.
+// The caller must hold the lock.
+func (r *rebalancer) waiting() []string {
+	var w []string
+	if r.from == nil {
+		return w
+	}
+	for _, m := range r.from.members {
+		if m != r.me && r.done[m] < r.epoch && members.Get(m).Status != statusDead {
+			w = append(w, m)
+		}
+	}
+	return w
+}
+
+// finished returns true if there's nothing left to hand off either way. The caller
+// must hold the lock.
+func (r *rebalancer) finished() bool {
+	return r.from == nil || r.sent && len(r.waiting()) == 0
+}
+
+// sending returns true until we've handed off everything we have to
+func (r *rebalancer) sending() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.from != nil && !r.sent
+}
+
+// plan works out which keys each new owner has to be sent, and which of the keys we
+// hold we don't own any more
+func (r *rebalancer) plan(tg timeGlob) (map[string]timeGlob, timeGlob) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	targets := make(map[string]timeGlob)
+	leaving := timeGlob{List: make(map[string]time.Time)}
+	if r.from == nil || !r.from.partitioned() && !r.to.partitioned() {
+		// Every node holds every key, and anti-entropy brings new members up to date
+		return targets, leaving
+	}
+
+	for key, t := range tg.List {
+		owners := r.to.owners(key)
+		old := r.from.owners(key)
+		keep := contains(owners, r.me)
+		if !keep {
+			leaving.List[key] = t
+		} else if sender(old, owners) != r.me {
+			// Another old owner sends this one
+			continue
+		}
+		for _, o := range owners {
+			if o == r.me || keep && contains(old, o) {
+				continue
+			}
+			if ts, ok := r.taken[o][key]; ok && ts.Equal(t) {
+				continue
+			}
+			if _, ok := targets[o]; !ok {
+				targets[o] = timeGlob{List: make(map[string]time.Time)}
+			}
+			targets[o].List[key] = t
+		}
+	}
+
+	r.left = make(map[string]int, len(targets))
+	for o, keys := range targets {
+		r.left[o] = len(keys.List)
+	}
+	return targets, leaving
+}
+
+// sender returns the first old owner that's still an owner, or the first old owner if
+// none are
+func sender(old []string, owners []string) string {
+	for _, o := range old {
+		if contains(owners, o) {
+			return o
+		}
+	}
+	if len(old) > 0 {
+		return old[0]
+	}
+	return ""
+}
+
+// record notes the keys a new owner took
+func (r *rebalancer) record(owner string, keys map[string]time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.taken[owner] == nil {
+		r.taken[owner] = make(map[string]time.Time)
+	}
+	for k, t := range keys {
+		r.taken[owner][k] = t
+	}
+	r.moved += len(keys)
+	r.left[owner] -= len(keys)
+}
+
+// handedOff returns the keys we're leaving that every new owner has taken
+func (r *rebalancer) handedOff(leaving timeGlob) timeGlob {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	out := timeGlob{List: make(map[string]time.Time)}
+	for key, t := range leaving.List {
+		owners := r.to.owners(key)
+		all := len(owners) > 0
+		for _, o := range owners {
+			if ts, ok := r.taken[o][key]; !ok || !ts.Equal(t) {
+				all = false
+			}
+		}
+		if all {
+			out.List[key] = t
+		}
+	}
+	return out
+}
+
+// finish marks our own hand-off as done and returns the epoch it was for
+func (r *rebalancer) finish() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sent = true
+	log.Printf("Handed off everything for epoch %d after %v\n", r.epoch, time.Since(r.started))
+	return r.epoch
+}
+
+// heard records that a member is done handing off for an epoch
+func (r *rebalancer) heard(d rebalanceDone) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.done == nil {
+		r.done = make(map[string]int)
+	}
+	if d.Epoch > r.done[d.From] {
+		r.done[d.From] = d.Epoch
+	}
+}
+
+// readFrom returns the old owners of a key that a read should go to, or nil if the
+// read can be served by the current owners. Only a new owner that may not have been
+// sent the key yet has to read it from the old ones.
+func (r *rebalancer) readFrom(key string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.from == nil || !r.from.partitioned() && !r.to.partitioned() {
+		return nil
+	}
+	if len(r.waiting()) == 0 || !contains(r.to.owners(key), r.me) {
+		return nil
+	}
+	old := r.from.owners(key)
+	if contains(old, r.me) {
+		return nil
+	}
+	return old
+}
+
+// progress reports how far along the hand-off is
+func (r *rebalancer) progress() map[string]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := "idle"
+	if !r.finished() {
+		status = "receiving"
+		if !r.sent {
+			status = "sending"
+		}
+	}
+	left := 0
+	owners := make(map[string]int)
+	for o, n := range r.left {
+		if n > 0 {
+			owners[o] = n
+			left += n
+		}
+	}
+	resp := map[string]interface{}{
+		"result":      "Success",
+		"status":      status,
+		"epoch":       r.epoch,
+		"keys_moved":  r.moved,
+		"keys_left":   left,
+		"owners":      owners,
+		"waiting_for": strings.Join(r.waiting(), ","),
+	}
+	if !r.started.IsZero() {
+		resp["started"] = r.started.Format(time.RFC3339)
+	}
+	return resp
+}
+
+// contains returns true if s is in list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns a copy of list with s left out
+func without(list []string, s string) []string {
+	var out []string
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// RebalanceLoop hands keys off to their new owners after every change to the view
+func (g *GossipVals) RebalanceLoop() {
+	log.Println("Rebalance loop starts...")
+	last := newLayout(g.view)
+	epoch := g.view.Epoch()
+	for {
+		time.Sleep(rebalancePoll)
+		if e := g.view.Epoch(); e != epoch {
+			next := newLayout(g.view)
+			rebalance.begin(g.view.Primary(), last, next, e)
+			last, epoch = next, e
+		}
+		if rebalance.sending() {
+			g.rebalance()
+		}
+	}
+}
+
+// rebalance runs one pass of the hand-off, and tells the view once nothing is left
+// to send
+func (g *GossipVals) rebalance() {
+	targets, leaving := rebalance.plan(g.kvs.GetTimeGlob())
+
+	left := 0
+	for owner, tg := range targets {
+		if members.Get(owner).Status == statusDead {
+			// Its keys stay here until the view changes again
+			log.Println("Not handing off to " + owner + ", it's down")
+			continue
+		}
+		left += len(tg.List)
+		log.Printf("Handing off %d keys to %s\n", len(tg.List), owner)
+		err := g.sendMigrate(owner, tg, func(keys map[string]time.Time) {
+			rebalance.record(owner, keys)
+		})
+		if err != nil {
+			log.Println("Error handing off to "+owner+": ", err)
+		}
+	}
+	if n := g.kvs.Forget(rebalance.handedOff(leaving)); n > 0 {
+		log.Printf("Dropped %d keys we don't own any more\n", n)
+	}
+
+	// Keys that were sent have to be checked on the next pass, so we're only done
+	// once a pass finds nothing to send
+	if left > 0 {
+		return
+	}
+	d := rebalanceDone{From: g.view.Primary(), Epoch: rebalance.finish()}
+	for _, bob := range g.others() {
+		err := sendRebalanced(bob, d)
+		if err != nil {
+			log.Println("Error telling "+bob+" we're done handing off: ", err)
+		}
+	}
+}
+
+// sendRebalanced tells a member we're done handing off
+func sendRebalanced(ip string, d rebalanceDone) error {
+	rw, err := Open(ip)
+	if err != nil {
+		return errors.Wrap(err, "Client: failed to open connection to "+ip)
+	}
+	log.Println("Sending command initialization: 'rebalanced'")
+	_, err = rw.WriteString("rebalanced\n")
+	if err == nil {
+		err = gob.NewEncoder(rw).Encode(d)
+	}
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Sending rebalanceDone failed")
+	}
+	return nil
+}
+
+// handleRebalanced records that a member is done handing off
+func (e *Endpoint) handleRebalanced(rw *bufio.ReadWriter) {
+	var d rebalanceDone
+	err := gob.NewDecoder(rw).Decode(&d)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	rebalance.heard(d)
+}
+
+// RebalanceHandler responds to GET requests on /node/rebalance with the progress of
+// the hand-off
+func (app *App) RebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /node/rebalance GET request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) // code 200
+	body, err := json.Marshal(rebalance.progress())
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// readOld sends a read for a key that's still being handed off to its old owners, if
+// we don't have it yet. It returns false if the read should be served as usual.
+func (app *App) readOld(w http.ResponseWriter, r *http.Request, key string) bool {
+	if r.Method != http.MethodGet || r.Header.Get(handoffHeader) != "" {
+		return false
+	}
+	old := rebalance.readFrom(key)
+	if len(old) == 0 {
+		return false
+	}
+	if _, version := app.db.Contains(key); version > 0 {
+		return false
+	}
+	log.Println("Reading " + key + " from its old owners " + strings.Join(old, ","))
+	r.Header.Set(handoffHeader, app.view.Primary())
+	app.forward(w, r, old)
+	return true
+}
@@ -0,0 +1,177 @@
+// rebalance_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for handing keys off when the view changes
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// grownLayouts returns the layouts before and after a fourth member joins
+func grownLayouts() (*layout, *layout) {
+	return newLayout(NewView(testMain, testView)), newLayout(NewView(testMain, shardView))
+}
+
+func TestRebalancePlan(t *testing.T) {
+	defer withReplicas(1)()
+	defer func() { rebalance = rebalancer{} }()
+	from, to := grownLayouts()
+	rebalance.begin(testMain, from, to, 1)
+
+	tg := timeGlob{List: make(map[string]time.Time)}
+	now := time.Now()
+	for i := 0; i < 300; i++ {
+		key := "subject" + strconv.Itoa(i)
+		if from.owners(key)[0] == testMain {
+			tg.List[key] = now
+		}
+	}
+	targets, leaving := rebalance.plan(tg)
+
+	// Only the new member gains keys, and they're exactly the ones we lose
+	equals(t, 1, len(targets))
+	assert(t, len(leaving.List) > 0, "No keys moved to the new member")
+	equals(t, leaving, targets[viewNotExist])
+	for key := range leaving.List {
+		equals(t, []string{viewNotExist}, to.owners(key))
+	}
+}
+
+func TestRebalanceDropsHandedOffKeys(t *testing.T) {
+	defer withReplicas(2)()
+	defer func() { rebalance = rebalancer{} }()
+	from, to := grownLayouts()
+	rebalance.begin(testMain, from, to, 1)
+
+	// Find a key we lose, which two new owners have to take
+	var key string
+	for i := 0; key == ""; i++ {
+		k := "subject" + strconv.Itoa(i)
+		if contains(from.owners(k), testMain) && !contains(to.owners(k), testMain) {
+			key = k
+		}
+	}
+	now := time.Now()
+	leaving := timeGlob{List: map[string]time.Time{key: now}}
+	owners := to.owners(key)
+
+	rebalance.record(owners[0], map[string]time.Time{key: now})
+	equals(t, 0, len(rebalance.handedOff(leaving).List))
+	rebalance.record(owners[1], map[string]time.Time{key: now})
+	equals(t, leaving, rebalance.handedOff(leaving))
+
+	// A key written since it was sent stays
+	rewritten := timeGlob{List: map[string]time.Time{key: now.Add(time.Second)}}
+	equals(t, 0, len(rebalance.handedOff(rewritten).List))
+}
+
+func TestMigrateStreamsEveryChunk(t *testing.T) {
+	sender := NewKVS()
+	now := time.Now()
+	n := (migrateWindow+2)*migrateChunkSize + 10
+	for i := 0; i < n; i++ {
+		sender.Put("subject"+strconv.Itoa(i), valone, now, map[string]int{})
+	}
+	g := GossipVals{kvs: sender, view: NewView(testMain, testView)}
+
+	receiver := NewKVS()
+	here, there := net.Pipe()
+	defer here.Close()
+	e := NewEndpoint()
+	e.gossip = GossipVals{kvs: receiver, view: NewView(viewExist, testView)}
+	e.AddHandleFunc("migrate", e.handleMigrate)
+	go e.handleMessages(there)
+
+	taken := 0
+	err := g.migrate(here, bufio.NewReadWriter(bufio.NewReader(here), bufio.NewWriter(here)), sender.GetTimeGlob(), func(keys map[string]time.Time) {
+		taken += len(keys)
+	})
+	ok(t, err)
+	equals(t, n, taken)
+	equals(t, sender.MerkleHashes([]int{1}), receiver.MerkleHashes([]int{1}))
+}
+
+func TestReadsGoToOldOwnersUntilHandedOff(t *testing.T) {
+	defer withReplicas(1)()
+	defer func() { rebalance = rebalancer{} }()
+
+	// The old owner answers every read it's sent
+	var handoffBy string
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handoffBy = r.Header.Get(handoffHeader)
+		w.Write([]byte(valone))
+	}))
+	defer old.Close()
+	oldAddr := strings.TrimPrefix(old.URL, "http://")
+
+	// We join a view of one, and find a key that moves to us
+	before := []string{oldAddr}
+	after := []string{oldAddr, testMain}
+	key := ownedKey(testMain, after)
+	v := NewView(testMain, strings.Join(after, ","))
+	rebalance.begin(testMain, &layout{members: before, ring: &hashRing{}}, newLayout(v), 1)
+
+	app := App{db: NewKVS(), view: *v}
+	local := false
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+keySuffix, app.routed(func(w http.ResponseWriter, r *http.Request) {
+		local = true
+	}))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, rootURL+"/"+key, nil))
+	equals(t, valone, rec.Body.String())
+	equals(t, testMain, handoffBy)
+	assert(t, !local, "Read of a key being handed off was served here")
+
+	// Writes go to us straight away
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, rootURL+"/"+key, strings.NewReader("val="+valtwo)))
+	assert(t, local, "Write of a key being handed off wasn't served here")
+
+	// Once the old owner is done, reads are served here too
+	local = false
+	rebalance.heard(rebalanceDone{From: oldAddr, Epoch: 1})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, rootURL+"/"+key, nil))
+	assert(t, local, "Read wasn't served here after the hand-off")
+}
+
+func TestRebalanceHandlerReportsProgress(t *testing.T) {
+	defer withReplicas(1)()
+	defer func() { rebalance = rebalancer{} }()
+	app := App{db: NewKVS(), view: *NewView(testMain, testView)}
+	router := mux.NewRouter()
+	router.HandleFunc(node+rebalanceSuffix, app.RebalanceHandler).Methods(http.MethodGet)
+
+	_, resp := shardRequest(t, router, httptest.NewRequest(http.MethodGet, node+rebalanceSuffix, nil))
+	equals(t, "idle", resp["status"])
+
+	from, to := grownLayouts()
+	rebalance.begin(testMain, from, to, 3)
+	rebalance.plan(timeGlob{List: map[string]time.Time{ownedKey(viewNotExist, to.members): time.Now()}})
+	_, resp = shardRequest(t, router, httptest.NewRequest(http.MethodGet, node+rebalanceSuffix, nil))
+	equals(t, "sending", resp["status"])
+	equals(t, 3.0, resp["epoch"])
+	equals(t, 1.0, resp["keys_left"])
+	equals(t, viewExist+","+"176.32.164.10:8084", resp["waiting_for"])
+
+	rebalance.finish()
+	_, resp = shardRequest(t, router, httptest.NewRequest(http.MethodGet, node+rebalanceSuffix, nil))
+	equals(t, "receiving", resp["status"])
+}
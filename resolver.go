@@ -0,0 +1,208 @@
+// resolver.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the conflict resolvers gossip uses to decide between our copy of a key and
+// one sent by a peer. Which resolver is used depends on the key: the policy with the
+// longest prefix of the key wins, and keys that don't match any policy fall back to
+// the default. Policies are set with CONFLICT_POLICIES, like "cart/=siblings,cfg/=lww",
+// and the default with CONFLICT_POLICY.
+//
+// Typed values are always joined, whatever the policy, see crdt.go.
+//
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ConflictResolver decides what happens when a peer sends us a copy of a key
+type ConflictResolver interface {
+	// Resolve returns true if we should take Alice's entry over Bob's, our own.
+	// Bob is nil if we don't have the key at all.
+	Resolve(key string, alice KeyEntry, bob KeyEntry) bool
+
+	// Merge returns the entry to store once Alice's has been taken
+	Merge(key string, alice Entry, bob KeyEntry) Entry
+}
+
+// These are the names the built-in resolvers are configured by
+const (
+	policyVectorClock = "vclock"   // The write that has seen the other wins, then the later timestamp
+	policyLWW         = "lww"      // Later timestamp wins regardless of the clocks
+	policySiblings    = "siblings" // Concurrent values are kept as siblings
+	policyLexical     = "lexical"  // The write that has seen the other wins, then the larger value
+)
+
+// resolverPolicy is a resolver and the prefix of the keys it applies to
+type resolverPolicy struct {
+	Prefix   string
+	Resolver ConflictResolver
+}
+
+// newResolver returns the built-in resolver with the given name
+func newResolver(name string) (ConflictResolver, error) {
+	switch name {
+	case policyVectorClock:
+		return vectorClockResolver{}, nil
+	case policyLWW:
+		return lwwResolver{}, nil
+	case policySiblings:
+		return siblingResolver{}, nil
+	case policyLexical:
+		return lexicalResolver{}, nil
+	}
+	return nil, errors.New("Unknown conflict policy " + name)
+}
+
+// parsePolicies reads a comma separated list of prefix=policy pairs
+func parsePolicies(s string) ([]resolverPolicy, error) {
+	var policies []resolverPolicy
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		i := strings.LastIndex(p, "=")
+		if i < 0 {
+			return nil, errors.New("Conflict policy " + p + " must look like prefix=policy")
+		}
+		r, err := newResolver(p[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, resolverPolicy{Prefix: p[:i], Resolver: r})
+	}
+	return policies, nil
+}
+
+// resolverFor returns the resolver for a key, from the policy with the longest matching prefix
+func resolverFor(key string) ConflictResolver {
+	best := -1
+	r := defaultResolver
+	for _, p := range conflictPolicies {
+		if strings.HasPrefix(key, p.Prefix) && len(p.Prefix) > best {
+			best, r = len(p.Prefix), p.Resolver
+		}
+	}
+	// SIBLING_PREFIXES is shorthand for a siblings policy on each prefix
+	for _, p := range siblingPrefixes {
+		if strings.HasPrefix(key, p) && len(p) > best {
+			best, r = len(p), siblingResolver{}
+		}
+	}
+	return r
+}
+
+// vectorClockResolver is the original resolver: Alice wins if her write has seen Bob's,
+// and if neither has seen the other the later timestamp wins
+type vectorClockResolver struct{}
+
+// Resolve implements ConflictResolver
+func (vectorClockResolver) Resolve(key string, alice KeyEntry, bob KeyEntry) bool {
+	log.Printf("Comparing Alice's version '%#v'\n", alice)
+
+	// if bob does NOT have the key, we definitely update w/ Alice's stuff
+	if bob == nil {
+		log.Println("Bob doesn't have the entry: ", key)
+		return true // Bob can't possibly beat Alice's key with no corresponding key of it's own
+	}
+	// else if Bob DOES have the key, we compare causal history & timestamps
+	ab, ba := seen(alice, bob), seen(bob, alice)
+	log.Println("Alice has seen Bob: ", ab, " Bob has seen Alice: ", ba)
+
+	if ab == ba {
+		// concurrent or identical writes, later timestamp wins and the node ID breaks ties
+		if laterWrite(alice.GetTimestamp(), alice.GetNode(), bob.GetTimestamp(), bob.GetNode()) {
+			log.Println("Alice wins with the later timestamp")
+			return true // alice wins
+		}
+		log.Println("Bob wins with a later timestamp")
+		return false // bob wins
+	} else if ab {
+		log.Println("Alice wins with an entry that has seen Bob's")
+		return true // alice wins
+	}
+	log.Println("Bob wins with an entry that has seen Alice's")
+	return false // bob wins
+}
+
+// Merge implements ConflictResolver
+func (vectorClockResolver) Merge(key string, alice Entry, bob KeyEntry) Entry {
+	return alice
+}
+
+// lwwResolver ignores the clocks and keeps whichever write has the later timestamp
+type lwwResolver struct{}
+
+// Resolve implements ConflictResolver
+func (lwwResolver) Resolve(key string, alice KeyEntry, bob KeyEntry) bool {
+	if bob == nil {
+		return true
+	}
+	return laterWrite(alice.GetTimestamp(), alice.GetNode(), bob.GetTimestamp(), bob.GetNode())
+}
+
+// Merge implements ConflictResolver
+func (lwwResolver) Merge(key string, alice Entry, bob KeyEntry) Entry {
+	return alice
+}
+
+// siblingResolver keeps concurrent values as siblings, see siblings.go
+type siblingResolver struct{}
+
+// Resolve implements ConflictResolver. Alice's entry is taken if it has seen Bob's,
+// and also if the two are concurrent so that Merge can keep both.
+func (siblingResolver) Resolve(key string, alice KeyEntry, bob KeyEntry) bool {
+	if bob == nil || !bob.Alive() || !alice.Alive() {
+		// Deletes aren't kept as siblings
+		return vectorClockResolver{}.Resolve(key, alice, bob)
+	}
+	if concurrent(alice, bob) {
+		log.Println("Alice is concurrent with Bob, keeping both")
+		return true
+	}
+	return seen(alice, bob) && !seen(bob, alice)
+}
+
+// Merge implements ConflictResolver
+func (siblingResolver) Merge(key string, alice Entry, bob KeyEntry) Entry {
+	if bob != nil && bob.Alive() && alice.Alive() && concurrent(&alice, bob) {
+		return mergeSiblings(key, toEntry(bob), alice)
+	}
+	return alice
+}
+
+// lexicalResolver lets the write that has seen the other win like the vector clock
+// resolver, but settles concurrent writes by keeping the larger value, so the outcome
+// doesn't depend on timestamps at all. A delete counts as the empty value.
+type lexicalResolver struct{}
+
+// Resolve implements ConflictResolver
+func (lexicalResolver) Resolve(key string, alice KeyEntry, bob KeyEntry) bool {
+	if bob == nil {
+		return true
+	}
+	ab, ba := seen(alice, bob), seen(bob, alice)
+	if ab != ba {
+		// One write has seen the other, so they aren't concurrent
+		return ab
+	}
+	if alice.GetValue() != bob.GetValue() {
+		return alice.GetValue() > bob.GetValue()
+	}
+	return laterWrite(alice.GetTimestamp(), alice.GetNode(), bob.GetTimestamp(), bob.GetNode())
+}
+
+// Merge implements ConflictResolver
+func (lexicalResolver) Merge(key string, alice Entry, bob KeyEntry) Entry {
+	return alice
+}
@@ -0,0 +1,86 @@
+// resolver_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the conflict resolvers
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePolicies(t *testing.T) {
+	p, err := parsePolicies("cart/=siblings, cfg/=lww,,=lexical")
+	ok(t, err)
+	equals(t, []resolverPolicy{
+		{Prefix: "cart/", Resolver: siblingResolver{}},
+		{Prefix: "cfg/", Resolver: lwwResolver{}},
+		{Prefix: "", Resolver: lexicalResolver{}},
+	}, p)
+
+	_, err = parsePolicies("cart/")
+	assert(t, err != nil, "Policy without a resolver accepted")
+	_, err = parsePolicies("cart/=magic")
+	assert(t, err != nil, "Unknown resolver accepted")
+}
+
+func TestResolverForLongestPrefix(t *testing.T) {
+	conflictPolicies = []resolverPolicy{
+		{Prefix: "cfg/", Resolver: lwwResolver{}},
+		{Prefix: "cfg/names/", Resolver: lexicalResolver{}},
+	}
+	defer func() { conflictPolicies = nil }()
+
+	equals(t, lwwResolver{}, resolverFor("cfg/port"))
+	equals(t, lexicalResolver{}, resolverFor("cfg/names/a"))
+	equals(t, defaultResolver, resolverFor(keyExists))
+}
+
+// Alice has seen Bob's write but has the earlier timestamp
+func TestResolversDisagree(t *testing.T) {
+	now := time.Now()
+	bob := &Entry{Version: 1, Timestamp: now, Clock: map[string]int{}, Value: valtwo, Node: viewExist, Dot: 1}
+	alice := &Entry{Version: 2, Timestamp: now.Add(-time.Second), Clock: map[string]int{viewExist: 1}, Value: valone, Node: testMain, Dot: 1}
+
+	assert(t, vectorClockResolver{}.Resolve(keyExists, alice, bob), "Causally newer write lost")
+	assert(t, !lwwResolver{}.Resolve(keyExists, alice, bob), "Earlier write won")
+	assert(t, lexicalResolver{}.Resolve(keyExists, alice, bob), "Causally newer write lost")
+
+	// With concurrent writes the lexical resolver goes by value
+	alice.Clock = map[string]int{}
+	assert(t, !lexicalResolver{}.Resolve(keyExists, alice, bob), "Smaller value won")
+	assert(t, lexicalResolver{}.Resolve(keyExists, bob, alice), "Larger value lost")
+
+	// Anything beats nothing
+	for _, r := range []ConflictResolver{vectorClockResolver{}, lwwResolver{}, siblingResolver{}, lexicalResolver{}} {
+		assert(t, r.Resolve(keyExists, alice, nil), "Entry lost to a missing key")
+	}
+}
+
+func TestUpdateKVSUsesPolicy(t *testing.T) {
+	conflictPolicies = []resolverPolicy{{Prefix: "cfg/", Resolver: lwwResolver{}}}
+	defer func() { conflictPolicies = nil }()
+
+	k := NewKVS()
+	g := GossipVals{kvs: k, view: &TestView{view: testMain}}
+	now := time.Now()
+	k.OverwriteEntry("cfg/a", &Entry{Version: 1, Timestamp: now, Clock: map[string]int{}, Value: valtwo, Node: viewExist, Dot: 1})
+	k.OverwriteEntry(keyExists, &Entry{Version: 1, Timestamp: now, Clock: map[string]int{}, Value: valtwo, Node: viewExist, Dot: 2})
+
+	// A causally newer but older timestamped write only wins outside the lww prefix
+	g.UpdateKVS(entryGlob{Keys: map[string]Entry{
+		"cfg/a":   {Version: 2, Timestamp: now.Add(-time.Second), Clock: map[string]int{viewExist: 1}, Value: valone, Node: testMain, Dot: 1},
+		keyExists: {Version: 2, Timestamp: now.Add(-time.Second), Clock: map[string]int{viewExist: 2}, Value: valone, Node: testMain, Dot: 2},
+	}})
+	val, _ := k.Get("cfg/a", map[string]int{})
+	equals(t, valtwo, val)
+	val, _ = k.Get(keyExists, map[string]int{})
+	equals(t, valone, val)
+}
@@ -32,4 +32,10 @@ type Restful interface {
 	ViewPutHandler(http.ResponseWriter, *http.Request)
 	ViewGetHandler(http.ResponseWriter, *http.Request)
 	ViewDeleteHandler(http.ResponseWriter, *http.Request)
+
+	// RangeHandler responds to GET requests on the root by listing keys in order
+	RangeHandler(http.ResponseWriter, *http.Request)
+
+	// SnapshotHandler responds to /admin/snapshot requests by snapshotting the data store
+	SnapshotHandler(http.ResponseWriter, *http.Request)
 }
@@ -0,0 +1,330 @@
+// ring.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines how keys are partitioned across the view. Every member of the view is
+// hashed onto a ring at VNODES points, and a key belongs to the first REPLICAS
+// distinct members found going clockwise from the key's own hash. Virtual nodes keep
+// the share of the ring each member gets close to even, and when a member joins or
+// leaves only the keys next to its points change hands.
+//
+// A node only stores the keys it owns. A request for a key it doesn't own is
+// forwarded to the owners, and gossip only sends a peer the keys that peer owns. Every
+// response to a key request names the owners in the X-Key-Owners header. With
+// REPLICAS unset every node owns every key, as before.
+//
+// If the view is divided into shards, the shards are placed on the ring instead of
+// the members, and a key belongs to every member of its shard. See shard.go.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A ringPoint is one of a member's virtual nodes
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// hashRing maps keys to the members that own them. It's rebuilt whenever it's asked
+// about a different set of members than last time.
+type hashRing struct {
+	mutex   sync.Mutex
+	members string      // The members the points were built from, sorted and joined
+	vnodes  int         // The virtual nodes per member the points were built with
+	points  []ringPoint // Sorted by hash
+}
+
+// partitioned returns true if keys are divided between the members of the view
+func partitioned() bool {
+	return replicas > 0 || numShards() > 1
+}
+
+// ring is the partitioner every key request and gossip round goes through
+var ring hashRing
+
+// ringHash places a string on the ring. FNV on its own leaves strings that only differ
+// at the end, like the points of one member, close together, so the bits are mixed
+// again with the MurmurHash3 finalizer.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// build places every member on the ring at vnodes points. The caller must hold the lock.
+func (r *hashRing) build(members []string, vnodes int) {
+	r.points = make([]ringPoint, 0, len(members)*vnodes)
+	for _, m := range members {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(m + "#" + strconv.Itoa(i)), member: m})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].member < r.points[j].member
+	})
+}
+
+// Owners returns the members that own a key, nearest first. Every member owns every
+// key if the cluster isn't partitioned.
+func (r *hashRing) Owners(key string, members []string) []string {
+	return r.ownersWith(key, members, numShards())
+}
+
+// ownersWith returns the members that own a key when the view is divided into the
+// given number of shards
+func (r *hashRing) ownersWith(key string, members []string, shards int) []string {
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+
+	if shards > 1 {
+		groups := shardGroups(sorted, shards)
+		ids := make([]string, len(groups))
+		for i := range groups {
+			ids[i] = strconv.Itoa(i)
+		}
+		found := r.walk(key, ids, 1)
+		if len(found) == 0 {
+			return nil
+		}
+		id, _ := strconv.Atoi(found[0])
+		return append([]string(nil), groups[id]...)
+	}
+
+	n := replicas
+	if n <= 0 || n > len(sorted) {
+		n = len(sorted)
+	}
+	return r.walk(key, sorted, n)
+}
+
+// walk returns the first n distinct points found going clockwise from a key
+func (r *hashRing) walk(key string, sorted []string, n int) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if joined := strings.Join(sorted, ","); joined != r.members || virtualNodes != r.vnodes {
+		r.build(sorted, virtualNodes)
+		r.members = joined
+		r.vnodes = virtualNodes
+	}
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	var owners []string
+	seen := make(map[string]bool, n)
+	for j := 0; len(owners) < n && j < len(r.points); j++ {
+		p := r.points[(i+j)%len(r.points)]
+		if !seen[p.member] {
+			seen[p.member] = true
+			owners = append(owners, p.member)
+		}
+	}
+	return owners
+}
+
+// Owns returns true if member is one of the owners of a key
+func (r *hashRing) Owns(member string, key string, members []string) bool {
+	if !partitioned() {
+		return true
+	}
+	for _, o := range r.Owners(key, members) {
+		if o == member {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedBy returns the part of a timeGlob that member owns
+func ownedBy(member string, members []string, tg timeGlob) timeGlob {
+	if !partitioned() {
+		return tg
+	}
+	out := timeGlob{List: make(map[string]time.Time), Digests: tg.Digests}
+	for k, t := range tg.List {
+		if ring.Owns(member, k, members) {
+			out.List[k] = t
+		}
+	}
+	return out
+}
+
+// owners returns the replicas whose writes to a key a client's payload is checked
+// against, which is every replica if keys aren't partitioned
+func (app *App) owners(key string) []string {
+	if !partitioned() {
+		return nil
+	}
+	return ring.Owners(key, app.view.List())
+}
+
+// routed wraps a key handler so that requests for keys we don't own are forwarded to
+// an owner. A request that has already been forwarded is always handled here, so two
+// nodes whose views disagree can't pass it back and forth.
+func (app *App) routed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["subject"]
+		owners := ring.Owners(key, app.view.List())
+		w.Header().Set(ownersHeader, strings.Join(owners, ","))
+
+		// Keys being handed off are read from their old owners until they get here
+		if app.readOld(w, r, key) {
+			return
+		}
+
+		me := app.view.Primary()
+		if r.Header.Get(forwardedHeader) != "" || ring.Owns(me, key, app.view.List()) {
+			h(w, r)
+			return
+		}
+		app.forward(w, r, owners)
+	}
+}
+
+// routedBatch wraps the batch handler so that a batch is sent to the owners of its
+// keys. A batch is applied at once on a single node, so every key in it has to belong
+// to the same owners, and a batch that spans partitions is refused.
+func (app *App) routedBatch(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !partitioned() || r.Header.Get(forwardedHeader) != "" || r.Body == nil {
+			h(w, r)
+			return
+		}
+
+		// The body is put back so the handler or the owner can read it again
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error reading batch to route: ", err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// A batch that won't parse is left for the handler to refuse
+		var req batchRequest
+		if err := json.Unmarshal(body, &req); err != nil || len(req.Ops) == 0 {
+			h(w, r)
+			return
+		}
+
+		view := app.view.List()
+		owners := ring.Owners(req.Ops[0].Key, view)
+		for _, op := range req.Ops[1:] {
+			if strings.Join(ring.Owners(op.Key, view), ",") != strings.Join(owners, ",") {
+				log.Println("ERROR: Batch spans partitions")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest) // code 400
+				resp := map[string]interface{}{
+					"result":  "Error",
+					"msg":     "Every key in a batch must belong to the same owners",
+					"payload": req.Payload,
+				}
+				respBody, err := json.Marshal(resp)
+				if err != nil {
+					log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+				}
+				w.Write(respBody)
+				return
+			}
+		}
+		w.Header().Set(ownersHeader, strings.Join(owners, ","))
+
+		if contains(owners, app.view.Primary()) {
+			h(w, r)
+			return
+		}
+		app.forward(w, r, owners)
+	}
+}
+
+// forward sends a request on to the owners of its key in turn, and relays the first
+// answer from an owner that is available back to the client
+func (app *App) forward(w http.ResponseWriter, r *http.Request, owners []string) {
+	// The body is read once so it can be sent again if an owner doesn't answer
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request to forward: ", err)
+	}
+	client := http.Client{Timeout: forwardTimeout}
+
+	for _, o := range owners {
+		req, err := http.NewRequest(r.Method, "http://"+o+r.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			log.Println("Error building forwarded request: ", err)
+			continue
+		}
+		for k, v := range r.Header {
+			req.Header[k] = v
+		}
+		req.Header.Set(forwardedHeader, app.view.Primary())
+
+		log.Println("Forwarding " + r.Method + " " + r.URL.Path + " to " + o)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Println("Error forwarding to "+o+": ", err)
+			continue
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Println("Error reading answer from "+o+": ", err)
+			continue
+		}
+		// An owner that's decommissioning or not ready yet can't serve it, but the
+		// next one might
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			log.Println("Owner " + o + " is unavailable")
+			continue
+		}
+		for k, v := range resp.Header {
+			if k != ownersHeader {
+				w.Header()[k] = v
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBody)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable) // code 503
+	resp := map[string]interface{}{
+		"result": "Error",
+		"msg":    "Unable to reach any owner of the key",
+	}
+	respBody, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(respBody)
+}
@@ -0,0 +1,260 @@
+// ring_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for partitioning keys across the view
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var ringMembers = strings.Split(testView, ",")
+
+// withReplicas turns partitioning on for a test
+func withReplicas(n int) func() {
+	replicas = n
+	return func() { replicas = 0 }
+}
+
+// ownedKey returns a key that the ring gives to member first
+func ownedKey(member string, members []string) string {
+	for i := 0; ; i++ {
+		key := "subject" + strconv.Itoa(i)
+		if ring.Owners(key, members)[0] == member {
+			return key
+		}
+	}
+}
+
+func TestRingOwners(t *testing.T) {
+	defer withReplicas(2)()
+	owners := ring.Owners(keyone, ringMembers)
+	equals(t, 2, len(owners))
+	assert(t, owners[0] != owners[1], "Member owns a key twice")
+
+	// The order of the view doesn't matter
+	reversed := []string{ringMembers[2], ringMembers[1], ringMembers[0]}
+	equals(t, owners, ring.Owners(keyone, reversed))
+
+	replicas = 5
+	equals(t, 3, len(ring.Owners(keyone, ringMembers)))
+	equals(t, 0, len(ring.Owners(keyone, nil)))
+}
+
+func TestRingUnpartitionedOwnsEverything(t *testing.T) {
+	for _, m := range ringMembers {
+		assert(t, ring.Owns(m, keyone, ringMembers), "Member doesn't own a key while unpartitioned")
+	}
+	tg := timeGlob{List: map[string]time.Time{keyone: time.Now()}}
+	equals(t, tg, ownedBy(testMain, ringMembers, tg))
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	defer withReplicas(1)()
+	count := map[string]int{}
+	n := 3000
+	for i := 0; i < n; i++ {
+		count[ring.Owners("subject"+strconv.Itoa(i), ringMembers)[0]]++
+	}
+	for _, m := range ringMembers {
+		assert(t, count[m] > n/5 && count[m] < n/2, "Uneven share for "+m+": "+strconv.Itoa(count[m]))
+	}
+}
+
+func TestRingMovesFewKeys(t *testing.T) {
+	defer withReplicas(1)()
+	grown := append(append([]string(nil), ringMembers...), viewNotExist)
+	moved := 0
+	n := 3000
+	for i := 0; i < n; i++ {
+		key := "subject" + strconv.Itoa(i)
+		before := ring.Owners(key, ringMembers)[0]
+		after := ring.Owners(key, grown)[0]
+		if before != after {
+			// Keys only ever move to the new member
+			equals(t, viewNotExist, after)
+			moved++
+		}
+	}
+	assert(t, moved > 0 && moved < n/2, "Moved "+strconv.Itoa(moved)+" of "+strconv.Itoa(n)+" keys")
+}
+
+func TestReceiveDropsKeysWeDontOwn(t *testing.T) {
+	defer withReplicas(1)()
+	k := NewKVS()
+	g := GossipVals{kvs: k, view: NewView(testMain, testView)}
+	mine := ownedKey(testMain, ringMembers)
+	theirs := ownedKey(viewExist, ringMembers)
+
+	now := time.Now()
+	g.Receive(entryGlob{Keys: map[string]Entry{
+		mine:   {Version: 1, Timestamp: now, Value: valone, Clock: map[string]int{}},
+		theirs: {Version: 1, Timestamp: now, Value: valone, Clock: map[string]int{}},
+	}})
+	alive, _ := k.Contains(mine)
+	assert(t, alive, "Owned key wasn't stored")
+	alive, _ = k.Contains(theirs)
+	assert(t, !alive, "Key owned by another member was stored")
+}
+
+func TestRoutedForwardsToOwner(t *testing.T) {
+	defer withReplicas(1)()
+
+	// The owner echoes back who forwarded the request and what it was sent
+	var forwardedBy string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy = r.Header.Get(forwardedHeader)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer owner.Close()
+	ownerAddr := strings.TrimPrefix(owner.URL, "http://")
+
+	members := []string{testMain, ownerAddr}
+	app := App{view: *NewView(testMain, strings.Join(members, ","))}
+	local := false
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+keySuffix, app.routed(func(w http.ResponseWriter, r *http.Request) {
+		local = true
+	}))
+
+	key := ownedKey(ownerAddr, members)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, rootURL+"/"+key, strings.NewReader("val="+valone)))
+	equals(t, http.StatusCreated, rec.Code)
+	equals(t, "val="+valone, rec.Body.String())
+	equals(t, testMain, forwardedBy)
+	equals(t, ownerAddr, rec.Header().Get(ownersHeader))
+	assert(t, !local, "Request for another member's key was handled here")
+
+	// Our own keys, and anything already forwarded, are handled here
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, rootURL+"/"+ownedKey(testMain, members), nil))
+	assert(t, local, "Request for our own key was forwarded")
+	equals(t, testMain, rec.Header().Get(ownersHeader))
+
+	local = false
+	req := httptest.NewRequest(http.MethodGet, rootURL+"/"+key, nil)
+	req.Header.Set(forwardedHeader, ownerAddr)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert(t, local, "Forwarded request was forwarded again")
+}
+
+func TestRoutedFailsWhenOwnersAreDown(t *testing.T) {
+	defer withReplicas(1)()
+
+	// Nothing listens here once the server is closed
+	gone := httptest.NewServer(http.NotFoundHandler())
+	goneAddr := strings.TrimPrefix(gone.URL, "http://")
+	gone.Close()
+
+	members := []string{testMain, goneAddr}
+	app := App{view: *NewView(testMain, strings.Join(members, ","))}
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+keySuffix, app.routed(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, rootURL+"/"+ownedKey(goneAddr, members), nil))
+	equals(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestRoutedBatchGoesToOwners(t *testing.T) {
+	defer withReplicas(1)()
+
+	var forwarded string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		forwarded = string(body)
+	}))
+	defer owner.Close()
+	ownerAddr := strings.TrimPrefix(owner.URL, "http://")
+
+	members := []string{testMain, ownerAddr}
+	app := App{view: *NewView(testMain, strings.Join(members, ","))}
+	local := ""
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+batchSuffix, app.routedBatch(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		local = string(body)
+	}))
+	batch := func(keys ...string) string {
+		ops := []string{}
+		for _, k := range keys {
+			ops = append(ops, `{"op":"delete","key":"`+k+`"}`)
+		}
+		return `{"ops":[` + strings.Join(ops, ",") + `]}`
+	}
+
+	// A batch of our own keys is applied here with its body intact
+	mine := batch(ownedKey(testMain, members))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, rootURL+batchSuffix, strings.NewReader(mine)))
+	equals(t, mine, local)
+	equals(t, testMain, rec.Header().Get(ownersHeader))
+
+	// A batch of another member's keys is sent to it
+	theirs := batch(ownedKey(ownerAddr, members))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, rootURL+batchSuffix, strings.NewReader(theirs)))
+	equals(t, theirs, forwarded)
+
+	// A batch with keys on both is refused
+	local, forwarded = "", ""
+	both := batch(ownedKey(testMain, members), ownedKey(ownerAddr, members))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, rootURL+batchSuffix, strings.NewReader(both)))
+	equals(t, http.StatusBadRequest, rec.Code)
+	equals(t, "", local)
+	equals(t, "", forwarded)
+}
+
+func TestForwardPassesOverUnavailableOwner(t *testing.T) {
+	defer withReplicas(2)()
+
+	// Whichever owner is asked first answers that it's unavailable
+	var busy string
+	answer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == busy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.Host))
+	})
+	one, two := httptest.NewServer(answer), httptest.NewServer(answer)
+	defer one.Close()
+	defer two.Close()
+	oneAddr, twoAddr := strings.TrimPrefix(one.URL, "http://"), strings.TrimPrefix(two.URL, "http://")
+
+	members := []string{testMain, oneAddr, twoAddr}
+	app := App{view: *NewView(testMain, strings.Join(members, ","))}
+	var key string
+	for i := 0; ; i++ {
+		key = "subject" + strconv.Itoa(i)
+		if !ring.Owns(testMain, key, members) {
+			break
+		}
+	}
+	owners := ring.Owners(key, members)
+	busy = owners[0]
+
+	rec := httptest.NewRecorder()
+	app.forward(rec, httptest.NewRequest(http.MethodGet, rootURL+"/"+key, nil), owners)
+	equals(t, http.StatusOK, rec.Code)
+	equals(t, owners[1], rec.Body.String())
+}
@@ -0,0 +1,257 @@
+// shard.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines shard groups. The view can be divided into a number of shards, set with
+// SHARDS and changed with PUT /shard/changeShardNumber. The members of the view are
+// dealt out to the shards in address order, so with n members every shard has n/S or
+// n/S+1 of them, and those are the replicas of every key in the shard. Which shard a
+// key is in is decided by the hash ring, see ring.go. Gossip only runs between the
+// members of a shard, apart from view changes, which go to everyone.
+//
+// When the number of shards changes, every key a node holds but no longer owns is
+// moved to its new owners, see rebalance.go.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// numShards returns the number of shards keys are divided into. The view changes it
+// from the gossip goroutines while requests read it, so it's only touched atomically.
+func numShards() int {
+	return int(atomic.LoadInt32(&shardCount))
+}
+
+// setNumShards sets the number of shards keys are divided into
+func setNumShards(n int) {
+	atomic.StoreInt32(&shardCount, int32(n))
+}
+
+// shardGroups deals the members out to n shards. The members have to be sorted, so
+// that every node builds the same groups.
+func shardGroups(sorted []string, n int) [][]string {
+	if n > len(sorted) {
+		n = len(sorted)
+	}
+	if n < 1 {
+		n = 1
+	}
+	groups := make([][]string, n)
+	for i, m := range sorted {
+		groups[i%n] = append(groups[i%n], m)
+	}
+	return groups
+}
+
+// shardsOf returns the shards the view is divided into
+func shardsOf(v View) [][]string {
+	members := v.List()
+	sort.Strings(members)
+	return shardGroups(members, v.Shards())
+}
+
+// shardOf returns the shard a member of the view is in, -1 if it isn't in the view
+func shardOf(v View, member string) int {
+	for id, group := range shardsOf(v) {
+		for _, m := range group {
+			if m == member {
+				return id
+			}
+		}
+	}
+	return -1
+}
+
+// shardIDs returns the ids of the shards as a comma-separated string
+func shardIDs(v View) string {
+	var ids []string
+	for id := range shardsOf(v) {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return strings.Join(ids, ",")
+}
+
+// shardParam returns the members of the shard named in the URL, or false if there's
+// no such shard
+func shardParam(v View, r *http.Request) ([]string, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	groups := shardsOf(v)
+	if err != nil || id < 0 || id >= len(groups) {
+		return nil, false
+	}
+	return groups[id], true
+}
+
+// ShardIDHandler responds to GET requests on /shard/my_id with the shard this node is in
+func (app *App) ShardIDHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /shard/my_id GET request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) // code 200
+	resp := map[string]interface{}{
+		"result": "Success",
+		"id":     shardOf(&app.view, app.view.Primary()),
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// ShardAllHandler responds to GET requests on /shard/all_ids with the ids of every shard
+func (app *App) ShardAllHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /shard/all_ids GET request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) // code 200
+	resp := map[string]interface{}{
+		"result":    "Success",
+		"shard_ids": shardIDs(&app.view),
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// ShardMembersHandler responds to GET requests on /shard/members/{id} with the members
+// of the shard
+func (app *App) ShardMembersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /shard/members GET request")
+
+	var resp map[string]interface{}
+	w.Header().Set("Content-Type", "application/json")
+
+	if group, ok := shardParam(&app.view, r); !ok {
+		w.WriteHeader(http.StatusNotFound) // code 404
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    "No shard with id " + mux.Vars(r)["id"],
+		}
+	} else {
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result":  "Success",
+			"members": strings.Join(group, ","),
+		}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// ShardCountHandler responds to GET requests on /shard/count/{id} with the number of
+// keys in the shard. Only the members of a shard hold its keys, so the request is
+// forwarded to one of them if we aren't.
+func (app *App) ShardCountHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /shard/count GET request")
+
+	group, ok := shardParam(&app.view, r)
+	mine := r.Header.Get(forwardedHeader) != ""
+	for _, m := range group {
+		if m == app.view.Primary() {
+			mine = true
+		}
+	}
+	if ok && !mine {
+		app.forward(w, r, group)
+		return
+	}
+
+	var resp map[string]interface{}
+	w.Header().Set("Content-Type", "application/json")
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound) // code 404
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    "No shard with id " + mux.Vars(r)["id"],
+		}
+	} else {
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result": "Success",
+			"Count":  app.db.Count(),
+		}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// ShardChangeHandler responds to PUT requests on /shard/changeShardNumber. It divides
+// the view into num shards, as long as every shard ends up with at least two members.
+// Every member of a shard holds every key in it, so shards can't be combined with
+// REPLICAS.
+func (app *App) ShardChangeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /shard/changeShardNumber PUT request")
+	r.ParseForm()
+
+	var resp map[string]interface{}
+	w.Header().Set("Content-Type", "application/json")
+
+	n, err := strconv.Atoi(r.Form.Get("num"))
+	count := app.view.Count()
+	if err != nil || n < 1 {
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    "Number of shards must be a positive integer",
+		}
+	} else if n > 1 && replicas > 0 {
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    "Shards can't be combined with REPLICAS",
+		}
+	} else if n > count {
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    "Not enough nodes for " + strconv.Itoa(n) + " shards",
+		}
+	} else if n > 1 && count/n < 2 {
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		resp = map[string]interface{}{
+			"result": "Error",
+			"msg":    "Not enough nodes. " + strconv.Itoa(n) + " shards result in a nonfault tolerant shard",
+		}
+	} else {
+		if n != app.view.Shards() {
+			log.Printf("Changing number of shards from %d to %d\n", app.view.Shards(), n)
+			app.view.SetShards(n)
+		}
+		w.WriteHeader(http.StatusOK) // code 200
+		resp = map[string]interface{}{
+			"result":    "Success",
+			"shard_ids": shardIDs(&app.view),
+		}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
@@ -0,0 +1,191 @@
+// shard_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for shard groups and migrating keys between them
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// shardView is four members, enough for two fault tolerant shards
+var shardView = testView + "," + viewNotExist
+
+// shardRouter serves the /shard endpoints for an App
+func shardRouter(app *App) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc(shard+myIDSuffix, app.ShardIDHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+allIDsSuffix, app.ShardAllHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+membersSuffix, app.ShardMembersHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+countSuffix, app.ShardCountHandler).Methods(http.MethodGet)
+	r.HandleFunc(shard+changeShardSuffix, app.ShardChangeHandler).Methods(http.MethodPut)
+	return r
+}
+
+// shardRequest serves a request and decodes the JSON response
+func shardRequest(t *testing.T, r *mux.Router, req *http.Request) (int, map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var resp map[string]interface{}
+	ok(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return rec.Code, resp
+}
+
+func TestShardGroups(t *testing.T) {
+	members := []string{"a", "b", "c", "d", "e"}
+	equals(t, [][]string{{"a", "c", "e"}, {"b", "d"}}, shardGroups(members, 2))
+	equals(t, [][]string{members}, shardGroups(members, 1))
+	equals(t, 2, len(shardGroups(members[:2], 3)))
+}
+
+func TestShardHandlers(t *testing.T) {
+	defer func() { setNumShards(1) }()
+	app := App{db: NewKVS(), view: *NewView(testMain, shardView)}
+	app.view.SetShards(2)
+	r := shardRouter(&app)
+
+	code, resp := shardRequest(t, r, httptest.NewRequest(http.MethodGet, shard+myIDSuffix, nil))
+	equals(t, http.StatusOK, code)
+	equals(t, "Success", resp["result"])
+	equals(t, 0.0, resp["id"])
+
+	_, resp = shardRequest(t, r, httptest.NewRequest(http.MethodGet, shard+allIDsSuffix, nil))
+	equals(t, "0,1", resp["shard_ids"])
+
+	_, resp = shardRequest(t, r, httptest.NewRequest(http.MethodGet, shard+"/members/1", nil))
+	equals(t, viewExist+","+viewNotExist, resp["members"])
+
+	code, _ = shardRequest(t, r, httptest.NewRequest(http.MethodGet, shard+"/members/2", nil))
+	equals(t, http.StatusNotFound, code)
+
+	app.db.Put("subject", valone, time.Now(), map[string]int{})
+	code, resp = shardRequest(t, r, httptest.NewRequest(http.MethodGet, shard+"/count/0", nil))
+	equals(t, http.StatusOK, code)
+	equals(t, 1.0, resp["Count"])
+}
+
+func TestShardChangeNumber(t *testing.T) {
+	defer func() { setNumShards(1) }()
+	app := App{db: NewKVS(), view: *NewView(testMain, shardView)}
+	r := shardRouter(&app)
+
+	change := func(num string) (int, map[string]interface{}) {
+		body := url.Values{"num": {num}}.Encode()
+		req := httptest.NewRequest(http.MethodPut, shard+changeShardSuffix, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return shardRequest(t, r, req)
+	}
+
+	for _, num := range []string{"zero", "0", "5", "3"} {
+		code, _ := change(num)
+		equals(t, http.StatusBadRequest, code)
+	}
+	equals(t, 1, app.view.Shards())
+
+	// Shards already replicate every key, so they aren't combined with REPLICAS
+	restore := withReplicas(2)
+	code, _ := change("2")
+	restore()
+	equals(t, http.StatusBadRequest, code)
+	equals(t, 1, app.view.Shards())
+
+	code, resp := change("2")
+	equals(t, http.StatusOK, code)
+	equals(t, "0,1", resp["shard_ids"])
+	equals(t, 2, app.view.Shards())
+	equals(t, 2, numShards())
+}
+
+func TestMergeTakesNewerShards(t *testing.T) {
+	defer func() { setNumShards(1) }()
+	a := NewView(testMain, shardView)
+	b := NewView(viewExist, shardView)
+
+	a.SetShards(2)
+	assert(t, b.Merge(a.State()), "Merge didn't take the new shard count")
+	equals(t, 2, b.Shards())
+
+	// A change made since wins over the one it was made after
+	b.SetShards(1)
+	a.Merge(b.State())
+	equals(t, 1, a.Shards())
+	equals(t, false, b.Merge(viewState{Members: map[string]viewStamp{}, Shards: shardStamp{Count: 2}}))
+	equals(t, 1, b.Shards())
+}
+
+func TestShardOwnersAreTheShard(t *testing.T) {
+	defer func() { setNumShards(1) }()
+	members := strings.Split(shardView, ",")
+	setNumShards(2)
+	groups := shardGroups(members, 2)
+	seen := map[string]bool{}
+	for _, key := range []string{"subject0", "subject1", "subject2", "subject3", "subject4", "subject5"} {
+		owners := ring.Owners(key, members)
+		assert(t, strings.Join(owners, ",") == strings.Join(groups[0], ",") || strings.Join(owners, ",") == strings.Join(groups[1], ","), "Key isn't owned by a whole shard")
+		seen[owners[0]] = true
+	}
+	equals(t, 2, len(seen))
+}
+
+func TestForgetKeepsRewrittenKeys(t *testing.T) {
+	k := NewKVS()
+	now := time.Now()
+	k.Put("moved", valone, now, map[string]int{})
+	k.Put("rewritten", valone, now, map[string]int{})
+	tg := k.GetTimeGlob()
+	k.Put("rewritten", valtwo, now.Add(time.Second), map[string]int{})
+
+	equals(t, 1, k.Forget(tg))
+	alive, _ := k.Contains("moved")
+	assert(t, !alive, "Moved key wasn't forgotten")
+	alive, _ = k.Contains("rewritten")
+	assert(t, alive, "Key written after it was sent was forgotten")
+}
+
+func TestTakeAcksOwnedKeys(t *testing.T) {
+	defer func() { setNumShards(1) }()
+	k := NewKVS()
+	g := GossipVals{kvs: k, view: NewView(testMain, shardView)}
+
+	// The sender knows about the change to two shards, we don't yet
+	sender := NewView(viewExist, shardView)
+	sender.SetShards(2)
+	members := strings.Split(shardView, ",")
+
+	var mine, theirs string
+	for i := 0; mine == "" || theirs == ""; i++ {
+		key := "subject" + strconv.Itoa(i)
+		if ring.Owns(testMain, key, members) {
+			mine = key
+		} else {
+			theirs = key
+		}
+	}
+	setNumShards(1)
+
+	now := time.Now()
+	ack := g.take(migrateRequest{View: sender.State(), Entries: entryGlob{Keys: map[string]Entry{
+		mine:   {Version: 1, Timestamp: now, Value: valone, Clock: map[string]int{}},
+		theirs: {Version: 1, Timestamp: now, Value: valone, Clock: map[string]int{}},
+	}}})
+	equals(t, []string{mine}, ack.Keys)
+	equals(t, 2, g.view.Shards())
+	alive, _ := k.Contains(mine)
+	assert(t, alive, "Migrated key wasn't stored")
+}
@@ -0,0 +1,181 @@
+// siblings.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines sibling values for keys under the siblings conflict policy, see resolver.go. For
+// those keys, writes that are concurrent aren't settled by timestamp. Both values are
+// kept as siblings, GET returns all of them, and the next write whose payload shows it
+// has seen all of them replaces them with a single value, Dynamo-style.
+//
+// An entry with siblings stores each of them with its own clock, dot and timestamp.
+// The entry's own clock is the join of their causal histories, so a client that reads
+// the key and writes it back with the payload it was given has seen every sibling. The
+// entry's value, dot and timestamp come from the newest sibling, except that the
+// timestamp is nudged forward by a nanosecond so gossip can tell the merged entry apart
+// from the one it came from.
+//
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// sibling is one of several concurrent values of a key
+type sibling struct {
+	Value     string
+	Clock     map[string]int // Causal context the value was written with
+	Timestamp time.Time
+	Node      string // Node the value was written on
+	Dot       int    // Counter of the write on Node, see dvv.go
+}
+
+// past returns the causal history of the sibling: its context joined with its own dot
+func (s sibling) past() map[string]int {
+	clock := copyClock(s.Clock)
+	if clock[s.Node] < s.Dot {
+		clock[s.Node] = s.Dot
+	}
+	return clock
+}
+
+// siblingsEnabled returns true if the key's conflict policy keeps siblings
+func siblingsEnabled(key string) bool {
+	_, ok := resolverFor(key).(siblingResolver)
+	return ok
+}
+
+// parsePrefixes splits a comma separated list of key prefixes, dropping empty ones
+func parsePrefixes(s string) []string {
+	var prefixes []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// descends returns true if clock a has seen everything clock b has, treating missing
+// components as zero
+func descends(a map[string]int, b map[string]int) bool {
+	for k, v := range b {
+		if a[k] < v {
+			return false
+		}
+	}
+	return true
+}
+
+// concurrent returns true if neither entry has seen the other. Two entries that have
+// seen each other but have different timestamps are concurrent too, which only happens
+// to entries written before they carried dots.
+func concurrent(a KeyEntry, b KeyEntry) bool {
+	ab, ba := seen(a, b), seen(b, a)
+	if ab && ba {
+		return !a.GetTimestamp().Equal(b.GetTimestamp())
+	}
+	return !ab && !ba
+}
+
+// siblingsOf returns the siblings of an entry, an entry without any is its own sibling
+func siblingsOf(e Entry) []sibling {
+	if len(e.Siblings) > 0 {
+		return e.Siblings
+	}
+	return []sibling{{Value: e.Value, Clock: e.Clock, Timestamp: e.Timestamp, Node: e.Node, Dot: e.Dot}}
+}
+
+// withSiblings builds an entry out of a set of siblings, dropping duplicates first.
+// Only a client payload replaces a sibling. The result only depends on the set, so two
+// replicas merging the same siblings build the same entry.
+func withSiblings(key string, version int, expires time.Time, sibs []sibling) Entry {
+	var kept []sibling
+	for i, s := range sibs {
+		dup := false
+		for _, t := range sibs[:i] {
+			if t.Timestamp.Equal(s.Timestamp) && t.Value == s.Value {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			kept = append(kept, s)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if !kept[i].Timestamp.Equal(kept[j].Timestamp) {
+			return kept[i].Timestamp.Before(kept[j].Timestamp)
+		}
+		return kept[i].Value < kept[j].Value
+	})
+
+	newest := kept[len(kept)-1]
+	clock := make(map[string]int)
+	for _, s := range kept {
+		for c, v := range s.past() {
+			if clock[c] < v {
+				clock[c] = v
+			}
+		}
+	}
+	e := Entry{Version: version, Timestamp: newest.Timestamp, Clock: clock, Value: newest.Value, Expires: expires, Node: newest.Node, Dot: newest.Dot}
+	if len(kept) > 1 {
+		e.Siblings = kept
+		e.Timestamp = newest.Timestamp.Add(time.Nanosecond)
+	}
+	return e
+}
+
+// mergeSiblings is the join of two concurrent entries for the same key
+func mergeSiblings(key string, a Entry, b Entry) Entry {
+	version := a.Version
+	if b.Version > version {
+		version = b.Version
+	}
+	expires := a.Expires
+	if b.Timestamp.After(a.Timestamp) {
+		expires = b.Expires
+	}
+	sibs := append(append([]sibling(nil), siblingsOf(a)...), siblingsOf(b)...)
+	return withSiblings(key, version, expires, sibs)
+}
+
+// addSibling stores a write whose payload hasn't seen the current value of the key.
+// Whatever the payload has seen is replaced and the rest is kept alongside the new
+// value. The caller must hold the write lock.
+func (k *KVS) addSibling(key string, val string, timestamp time.Time, payload map[string]int, expires time.Time) error {
+	cur := toEntry(k.db[key])
+	version := cur.Version + 1
+
+	var sibs []sibling
+	for _, s := range siblingsOf(cur) {
+		if payload[s.Node] < s.Dot {
+			sibs = append(sibs, s)
+		}
+	}
+	sibs = append(sibs, sibling{Value: val, Clock: copyClock(payload), Timestamp: timestamp, Node: myIP, Dot: dots.Next()})
+
+	e := withSiblings(key, version, expires, sibs)
+	k.archive(key, timestamp)
+	k.db[key] = &e
+	k.rehash(key)
+	return k.logEntry(walPut, key)
+}
+
+// GetSiblings returns the concurrent values of a key, or nil if it only has one
+func (k *KVS) GetSiblings(key string) []sibling {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if alive, _ := k.contains(key); !alive {
+		return nil
+	}
+	return k.db[key].GetSiblings()
+}
@@ -0,0 +1,116 @@
+// siblings_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for sibling values
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const siblingKey = "cart/" + keyExists
+
+// withSiblingPrefix turns sibling mode on for the test
+func withSiblingPrefix(t *testing.T) {
+	siblingPrefixes = []string{"cart/"}
+	t.Cleanup(func() { siblingPrefixes = nil })
+}
+
+func TestParsePrefixes(t *testing.T) {
+	equals(t, []string{"cart/", "session/"}, parsePrefixes(" cart/,,session/ "))
+	equals(t, []string(nil), parsePrefixes(""))
+}
+
+func TestConcurrent(t *testing.T) {
+	now := time.Now()
+	a := NewEntry(now, map[string]int{viewExist: 1}, valone, 1)
+
+	// Two blind writes on the same replica get different dots and haven't seen each other
+	b := NewEntry(now, map[string]int{viewExist: 1}, valtwo, 1)
+	assert(t, concurrent(a, b), "Blind writes on one replica aren't concurrent")
+
+	c := NewEntry(now, past(a), valtwo, 2)
+	assert(t, !concurrent(a, c), "Write that has seen the other is concurrent")
+
+	// Entries from before dots with the same clock are only told apart by their timestamps
+	d := &Entry{Timestamp: now, Clock: map[string]int{viewExist: 1}}
+	e := &Entry{Timestamp: now.Add(time.Second), Clock: map[string]int{viewExist: 1}}
+	assert(t, concurrent(d, e), "Same clock written at different times isn't concurrent")
+	assert(t, !concurrent(a, a), "Entry is concurrent with itself")
+}
+
+func TestBlindWriteAddsSibling(t *testing.T) {
+	withSiblingPrefix(t)
+	k := NewKVS()
+	k.Put(siblingKey, valone, time.Now(), map[string]int{})
+	k.Put(siblingKey, valtwo, time.Now(), map[string]int{})
+
+	sibs := k.GetSiblings(siblingKey)
+	equals(t, 2, len(sibs))
+	equals(t, valone, sibs[0].Value)
+	equals(t, valtwo, sibs[1].Value)
+
+	// A key outside the prefix is still last-writer-wins
+	k.Put(keyExists, valone, time.Now(), map[string]int{})
+	k.Put(keyExists, valtwo, time.Now(), map[string]int{})
+	equals(t, 0, len(k.GetSiblings(keyExists)))
+}
+
+func TestWriteWithContextCollapsesSiblings(t *testing.T) {
+	withSiblingPrefix(t)
+	k := NewKVS()
+	k.Put(siblingKey, valone, time.Now(), map[string]int{})
+	k.Put(siblingKey, valtwo, time.Now(), map[string]int{})
+
+	// The client reads both values and writes back with the payload it was given
+	_, payload := k.Get(siblingKey, map[string]int{})
+	k.Put(siblingKey, valExists, time.Now(), payload)
+
+	equals(t, 0, len(k.GetSiblings(siblingKey)))
+	val, _ := k.Get(siblingKey, map[string]int{})
+	equals(t, valExists, val)
+}
+
+func TestGossipKeepsConcurrentWrites(t *testing.T) {
+	withSiblingPrefix(t)
+	a, b := NewKVS(), NewKVS()
+	a.Put(siblingKey, valone, time.Now(), map[string]int{})
+	b.Put(siblingKey, valtwo, time.Now(), map[string]int{})
+
+	ga := GossipVals{kvs: a, view: &TestView{view: testMain}}
+	gb := GossipVals{kvs: b, view: &TestView{view: testMain}}
+	fromA := a.GetEntryGlob(a.GetTimeGlob())
+	gb.UpdateKVS(a.GetEntryGlob(a.GetTimeGlob()))
+	ga.UpdateKVS(b.GetEntryGlob(b.GetTimeGlob()))
+	equals(t, 2, len(a.GetSiblings(siblingKey)))
+
+	// Sending the merged entry back and forth changes nothing, both sides agree
+	gb.UpdateKVS(fromA)
+	ga.UpdateKVS(b.GetEntryGlob(b.GetTimeGlob()))
+	gb.UpdateKVS(a.GetEntryGlob(a.GetTimeGlob()))
+	equals(t, a.GetEntryGlob(a.GetTimeGlob()), b.GetEntryGlob(b.GetTimeGlob()))
+}
+
+func TestSiblingsSurviveRestart(t *testing.T) {
+	withSiblingPrefix(t)
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	k.Put(siblingKey, valone, time.Now(), map[string]int{})
+	k.Put(siblingKey, valtwo, time.Now(), map[string]int{})
+	ok(t, k.Close())
+
+	r := NewKVS()
+	defer r.Close()
+	equals(t, 2, len(r.GetSiblings(siblingKey)))
+}
@@ -0,0 +1,249 @@
+// snapshot.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines point-in-time snapshots of the KVS and the compaction of the write-ahead
+// log behind them. Taking a snapshot rotates the log to a new segment while holding
+// the db lock, copies the db into an entryGlob, and then writes it out without the
+// lock held. A snapshot numbered N holds every mutation in segments 1 through N, so
+// on startup the newest snapshot that passes its checksum is loaded and only the
+// segments after it are replayed.
+//
+// The previous snapshot and the segments after it are kept around as a fallback in
+// case the newest one turns out to be unreadable.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshot is a point-in-time copy of the db covering the log up to segment Seq
+type snapshot struct {
+	Seq       uint64                // Last log segment included in the snapshot
+	Glob      entryGlob             // Every key in the db, encoded the same way gossip sends them
+	Graveyard map[string]burial     // Purged tombstones that still guard against resurrection
+	History   map[string][]revision // Replaced versions of each key
+}
+
+// snapshotPath returns the path of the snapshot with the given sequence number
+func snapshotPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%08d", snapFile, seq))
+}
+
+// writeSnapshot writes the snapshot to a temp file with a checksum in front of it,
+// syncs it, and renames it into place so a crash never leaves a partial snapshot.
+func writeSnapshot(dir string, s snapshot) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return errors.Wrap(err, "Encoding snapshot failed")
+	}
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(buf.Bytes()))
+
+	tmp, err := ioutil.TempFile(dir, snapFile+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Creating snapshot file failed")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(sum); err == nil {
+		_, err = tmp.Write(buf.Bytes())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "Writing snapshot file failed")
+	}
+
+	path := snapshotPath(dir, s.Seq)
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "Renaming snapshot file failed")
+	}
+
+	// Sync the directory so the rename itself is durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	log.Printf("Wrote snapshot %s with %d keys\n", path, len(s.Glob.Keys))
+	return nil
+}
+
+// readSnapshot reads and verifies a single snapshot file
+func readSnapshot(path string) (snapshot, error) {
+	var s snapshot
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, errors.Wrap(err, "Reading snapshot "+path+" failed")
+	}
+	if len(b) < 4 {
+		return s, errors.New("Snapshot " + path + " is truncated")
+	}
+	if crc32.ChecksumIEEE(b[4:]) != binary.BigEndian.Uint32(b[:4]) {
+		return s, errors.New("Snapshot " + path + " failed its checksum")
+	}
+	if err = gob.NewDecoder(bytes.NewReader(b[4:])).Decode(&s); err != nil {
+		return s, errors.Wrap(err, "Decoding snapshot "+path+" failed")
+	}
+	return s, nil
+}
+
+// loadSnapshot returns the newest valid snapshot in dir. If there isn't one it returns
+// an empty snapshot with Seq 0, which means the whole log has to be replayed.
+func loadSnapshot(dir string) (snapshot, error) {
+	seqs, err := listSequences(dir, snapFile)
+	if err != nil {
+		return snapshot{}, err
+	}
+	for i := len(seqs) - 1; i >= 0; i-- {
+		s, err := readSnapshot(snapshotPath(dir, seqs[i]))
+		if err != nil {
+			log.Println("Skipping snapshot: ", err)
+			continue
+		}
+		log.Printf("Loaded snapshot %d with %d keys\n", s.Seq, len(s.Glob.Keys))
+		return s, nil
+	}
+	return snapshot{}, nil
+}
+
+// compactLog deletes everything that is no longer needed once snapshot seq has been
+// written. The snapshot before it is kept along with the segments after it, so
+// that it can still be used if the newest one can't be read.
+func compactLog(dir string, seq uint64) error {
+	seqs, err := listSequences(dir, snapFile)
+	if err != nil {
+		return err
+	}
+	var prev uint64
+	for _, s := range seqs {
+		if s < seq {
+			prev = s
+		}
+	}
+	if prev == 0 {
+		// Without an older snapshot the fallback is the whole log
+		return nil
+	}
+	for _, s := range seqs {
+		if s < prev {
+			if err = os.Remove(snapshotPath(dir, s)); err != nil {
+				return errors.Wrap(err, "Removing snapshot failed")
+			}
+		}
+	}
+	return removeSegments(dir, prev)
+}
+
+// restore loads the contents of a snapshot into the db
+func (k *KVS) restore(s snapshot) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for key, e := range s.Glob.Keys {
+		entry := e
+		hlc.Observe(entry.Timestamp)
+		dots.ObserveEntry(&entry)
+		k.db[key] = &entry
+		k.index.Insert(key)
+		k.rehash(key)
+	}
+	if len(s.Graveyard) > 0 && k.graveyard == nil {
+		k.graveyard = make(map[string]burial, len(s.Graveyard))
+	}
+	for key, b := range s.Graveyard {
+		dots.ObserveEntry(&b.Entry)
+		k.graveyard[key] = b
+	}
+	if len(s.History) > 0 && k.history == nil {
+		k.history = make(map[string][]revision, len(s.History))
+	}
+	for key, revs := range s.History {
+		k.history[key] = revs
+	}
+}
+
+// Snapshot writes a point-in-time copy of the db to the data directory and
+// compacts the write-ahead log behind it
+func (k *KVS) Snapshot() error {
+	if k.wal == nil {
+		return errors.New("Persistence is disabled")
+	}
+
+	// Only one snapshot runs at a time
+	k.snapMutex.Lock()
+	defer k.snapMutex.Unlock()
+
+	// A read lock is enough to keep writers, and therefore appends, out while the
+	// log is rotated and the db is copied
+	k.mutex.RLock()
+	seq, err := k.wal.Rotate()
+	if err != nil {
+		k.mutex.RUnlock()
+		return err
+	}
+	glob := entryGlob{Keys: make(map[string]Entry, len(k.db))}
+	for key, e := range k.db {
+		glob.Keys[key] = toEntry(e)
+	}
+	graveyard := make(map[string]burial, len(k.graveyard))
+	for key, b := range k.graveyard {
+		graveyard[key] = b
+	}
+	history := make(map[string][]revision, len(k.history))
+	for key, revs := range k.history {
+		history[key] = append([]revision(nil), revs...)
+	}
+	k.mutex.RUnlock()
+
+	if err = writeSnapshot(k.wal.dir, snapshot{Seq: seq, Glob: glob, Graveyard: graveyard, History: history}); err != nil {
+		return err
+	}
+	return compactLog(k.wal.dir, seq)
+}
+
+// snapshotLoop takes a snapshot whenever the interval has passed or the current log
+// segment has grown past the threshold. A value of zero disables either trigger.
+func (k *KVS) snapshotLoop(interval time.Duration, threshold int64) {
+	t := time.NewTicker(snapshotPoll)
+	defer t.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-t.C:
+			due := interval > 0 && time.Since(last) >= interval
+			big := threshold > 0 && k.wal.Size() >= threshold
+			if due || big {
+				log.Println("Taking a scheduled snapshot")
+				if err := k.Snapshot(); err != nil {
+					log.Println("Error taking snapshot: ", err)
+				}
+				last = time.Now()
+			}
+		case <-k.wal.done:
+			return
+		}
+	}
+}
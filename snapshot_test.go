@@ -0,0 +1,110 @@
+// snapshot_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for KVS snapshots and log compaction
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSnapshotWithoutPersistenceFails(t *testing.T) {
+	k := NewKVS()
+	assert(t, k.Snapshot() != nil, "Snapshot succeeded without a data directory")
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s := snapshot{
+		Seq: 3,
+		Glob: entryGlob{Keys: map[string]Entry{
+			keyExists: *NewEntry(time.Now().UTC(), map[string]int{keyExists: 1}, valExists, 1),
+		}},
+	}
+	ok(t, writeSnapshot(dir, s))
+
+	got, err := loadSnapshot(dir)
+	ok(t, err)
+	equals(t, s, got)
+}
+
+func TestLoadSnapshotSkipsCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	ok(t, writeSnapshot(dir, snapshot{Seq: 1, Glob: entryGlob{Keys: map[string]Entry{keyone: {Version: 1, Value: valone}}}}))
+	ok(t, writeSnapshot(dir, snapshot{Seq: 2, Glob: entryGlob{Keys: map[string]Entry{keyone: {Version: 2, Value: valtwo}}}}))
+
+	// Damage the newest snapshot
+	b, err := ioutil.ReadFile(snapshotPath(dir, 2))
+	ok(t, err)
+	b[len(b)-1] ^= 0xff
+	ok(t, ioutil.WriteFile(snapshotPath(dir, 2), b, 0666))
+
+	got, err := loadSnapshot(dir)
+	ok(t, err)
+	equals(t, uint64(1), got.Seq)
+	equals(t, valone, got.Glob.Keys[keyone].Value)
+}
+
+func TestSnapshotCompactsLogAndRecovers(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	k.Put(keyone, valone, time.Now(), map[string]int{})
+	ok(t, k.Snapshot())
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	ok(t, k.Snapshot())
+	k.Put(keyone, valtwo, time.Now(), map[string]int{})
+	ok(t, k.Snapshot())
+	k.Delete(keyExists, time.Now(), map[string]int{})
+	ok(t, k.Close())
+
+	// Two snapshots are kept, and only the segments after the older one
+	snaps, err := listSequences(dataDir, snapFile)
+	ok(t, err)
+	equals(t, []uint64{2, 3}, snaps)
+	segs, err := listSequences(dataDir, walFile)
+	ok(t, err)
+	equals(t, []uint64{3, 4}, segs)
+
+	r := NewKVS()
+	defer r.Close()
+	val, _ := r.Get(keyone, map[string]int{})
+	equals(t, valtwo, val)
+	alive, version := r.Contains(keyExists)
+	assert(t, !alive, "Deleted key came back alive")
+	equals(t, 2, version)
+}
+
+func TestRecoverFallsBackToOlderSnapshot(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	k.Put(keyone, valone, time.Now(), map[string]int{})
+	ok(t, k.Snapshot())
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	ok(t, k.Snapshot())
+	ok(t, k.Close())
+
+	// Without the newest snapshot the older one plus the log still has everything
+	ok(t, os.Remove(snapshotPath(dataDir, 2)))
+	r := NewKVS()
+	defer r.Close()
+	alive, _ := r.Contains(keyone)
+	assert(t, alive, "Key from the older snapshot is missing")
+	alive, _ = r.Contains(keyExists)
+	assert(t, alive, "Key from the log is missing")
+}
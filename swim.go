@@ -0,0 +1,315 @@
+// swim.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a SWIM style failure detector for the members of the view. Every probe
+// interval a replica pings the next member in a shuffled round of the view. If the
+// member doesn't answer in time, a few other members are asked to ping it for us, in
+// case the problem is only between the two of us. If none of them get an answer
+// either the member is suspected, and a suspect that hasn't shown it's alive by the
+// end of the suspicion timeout is declared dead. Gossip doesn't pick dead members.
+//
+// Every member has an incarnation number that only it can raise. A member that hears
+// it's suspected or dead raises its incarnation and announces it's alive, which
+// overrides what was said about it before. Of two statements about a member the one
+// with the higher incarnation wins, and at the same incarnation dead beats suspect
+// beats alive. Pings and their acks carry the whole membership table, so news spreads
+// along with the probes.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// memberStatus is what the failure detector thinks of a member
+type memberStatus int
+
+// These are the statuses a member can have, in the order they override each other
+const (
+	statusAlive memberStatus = iota
+	statusSuspect
+	statusDead
+)
+
+// String returns the name of the status
+func (s memberStatus) String() string {
+	switch s {
+	case statusSuspect:
+		return "suspect"
+	case statusDead:
+		return "dead"
+	}
+	return "alive"
+}
+
+// memberState is a member's status along with the incarnation it was declared at
+type memberState struct {
+	Status      memberStatus
+	Incarnation int
+	Since       time.Time // When the status changed here, suspicion times out from then
+}
+
+// overrides returns true if s is newer news about a member than o
+func (s memberState) overrides(o memberState) bool {
+	if s.Incarnation != o.Incarnation {
+		return s.Incarnation > o.Incarnation
+	}
+	return s.Status > o.Status
+}
+
+// memberList holds the state of every member we've heard about
+type memberList struct {
+	mutex       sync.Mutex
+	states      map[string]memberState
+	incarnation int // Our own incarnation
+}
+
+// members is the failure detector's view of the cluster
+var members memberList
+
+// Get returns the state of a member, alive at incarnation 0 if we've heard nothing
+func (m *memberList) Get(member string) memberState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if member == myIP {
+		return memberState{Status: statusAlive, Incarnation: m.incarnation}
+	}
+	return m.states[member]
+}
+
+// Snapshot returns the whole table, ourselves included, to send to another member
+func (m *memberList) Snapshot() map[string]memberState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	out := make(map[string]memberState, len(m.states)+1)
+	for member, s := range m.states {
+		out[member] = s
+	}
+	out[myIP] = memberState{Status: statusAlive, Incarnation: m.incarnation}
+	return out
+}
+
+// Merge applies every statement in a table sent by another member
+func (m *memberList) Merge(table map[string]memberState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for member, s := range table {
+		m.apply(member, s)
+	}
+}
+
+// Suspect marks a member that didn't answer a probe as suspect, unless we've already
+// heard worse
+func (m *memberList) Suspect(member string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.states[member]
+	m.apply(member, memberState{Status: statusSuspect, Incarnation: s.Incarnation})
+}
+
+// Expire declares dead every suspect whose suspicion has timed out
+func (m *memberList) Expire(now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for member, s := range m.states {
+		if s.Status == statusSuspect && now.Sub(s.Since) > swimSuspectTimeout {
+			m.apply(member, memberState{Status: statusDead, Incarnation: s.Incarnation})
+		}
+	}
+}
+
+// apply takes a statement about a member if it overrides what we know. A statement
+// that we're suspect or dead is refuted by raising our incarnation past it. The caller
+// must hold the lock.
+func (m *memberList) apply(member string, s memberState) {
+	if member == myIP {
+		if s.Status != statusAlive && s.Incarnation >= m.incarnation {
+			m.incarnation = s.Incarnation + 1
+			log.Printf("Refuting %v at incarnation %d\n", s.Status, m.incarnation)
+		}
+		return
+	}
+	if m.states == nil {
+		m.states = make(map[string]memberState)
+	}
+	cur := m.states[member]
+	if !s.overrides(cur) {
+		return
+	}
+	if s.Status != cur.Status {
+		log.Printf("Member %s is %v at incarnation %d\n", member, s.Status, s.Incarnation)
+	}
+	s.Since = time.Now()
+	m.states[member] = s
+}
+
+// A pingMsg asks a member whether it's alive and carries our membership table
+type pingMsg struct {
+	From    string
+	Members map[string]memberState
+}
+
+// A pingReqMsg asks a member to ping Target for us
+type pingReqMsg struct {
+	From    string
+	Target  string
+	Members map[string]memberState
+}
+
+// An ackMsg answers a ping or ping-req with whether the member, or the target, is
+// alive, and the answering member's membership table
+type ackMsg struct {
+	OK      bool
+	Members map[string]memberState
+}
+
+// ProbeLoop probes a member of the view every probe interval, going through the view
+// in a random order each round
+func (g *GossipVals) ProbeLoop() {
+	log.Println("Failure detector starts...")
+	var order []string
+	for {
+		time.Sleep(swimProbeInterval)
+		if len(order) == 0 {
+			order = shuffled(g.peers())
+		}
+		if len(order) > 0 {
+			target := order[0]
+			order = order[1:]
+			if g.view.Contains(target) {
+				g.probe(target)
+			}
+		}
+		members.Expire(time.Now())
+	}
+}
+
+// probe pings a member directly, then through other members if it doesn't answer,
+// and suspects it if nobody gets an answer
+func (g *GossipVals) probe(target string) {
+	err := ping(target)
+	if err == nil {
+		return
+	}
+	log.Println("Direct probe failed: ", err)
+
+	var helpers []string
+	for _, p := range shuffled(g.reachable()) {
+		if p != target && len(helpers) < swimIndirect {
+			helpers = append(helpers, p)
+		}
+	}
+	acked := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(h string) {
+			err := pingReq(h, target)
+			if err != nil {
+				log.Println("Indirect probe failed: ", err)
+			}
+			acked <- err == nil
+		}(h)
+	}
+	for range helpers {
+		if <-acked {
+			return
+		}
+	}
+	members.Suspect(target)
+}
+
+// ping asks a member whether it's alive
+func ping(ip string) error {
+	return exchange(ip, "ping", swimPingTimeout, pingMsg{From: myIP, Members: members.Snapshot()})
+}
+
+// pingReq asks helper to ping target for us. The helper gets time for its own ping.
+func pingReq(helper string, target string) error {
+	msg := pingReqMsg{From: myIP, Target: target, Members: members.Snapshot()}
+	return exchange(helper, "ping-req", 2*swimPingTimeout, msg)
+}
+
+// exchange sends a probe command and merges the table in the ack
+func exchange(ip string, cmd string, timeout time.Duration, msg interface{}) error {
+	conn, rw, err := dial(ip, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = rw.WriteString(cmd + "\n")
+	if err == nil {
+		err = gob.NewEncoder(rw).Encode(msg)
+	}
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Sending "+cmd+" to "+ip+" failed")
+	}
+
+	var ack ackMsg
+	err = gob.NewDecoder(rw).Decode(&ack)
+	if err != nil {
+		return errors.Wrap(err, "Reading ack from "+ip+" failed")
+	}
+	members.Merge(ack.Members)
+	heartbeats.Heard(ip)
+	if !ack.OK {
+		return errors.New(ip + " got no answer")
+	}
+	return nil
+}
+
+// handlePing answers a ping
+func (e *Endpoint) handlePing(rw *bufio.ReadWriter) {
+	var msg pingMsg
+	err := gob.NewDecoder(rw).Decode(&msg)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	members.Merge(msg.Members)
+	heartbeats.Heard(msg.From)
+	sendAck(rw, true)
+}
+
+// handlePingReq pings a member for someone who couldn't reach it, and passes on the answer
+func (e *Endpoint) handlePingReq(rw *bufio.ReadWriter) {
+	var msg pingReqMsg
+	err := gob.NewDecoder(rw).Decode(&msg)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	members.Merge(msg.Members)
+	heartbeats.Heard(msg.From)
+	err = ping(msg.Target)
+	if err != nil {
+		log.Println("Probe for "+msg.From+" failed: ", err)
+	}
+	sendAck(rw, err == nil)
+}
+
+// sendAck writes an ack carrying our membership table
+func sendAck(rw *bufio.ReadWriter, ok bool) {
+	err := gob.NewEncoder(rw).Encode(ackMsg{OK: ok, Members: members.Snapshot()})
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		log.Println("Error sending ack: ", err)
+	}
+}
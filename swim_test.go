@@ -0,0 +1,71 @@
+// swim_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the failure detector
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemberStateOverrides(t *testing.T) {
+	alive := memberState{Status: statusAlive, Incarnation: 1}
+	suspect := memberState{Status: statusSuspect, Incarnation: 1}
+	dead := memberState{Status: statusDead, Incarnation: 1}
+	refuted := memberState{Status: statusAlive, Incarnation: 2}
+
+	assert(t, suspect.overrides(alive), "Suspicion doesn't override alive at the same incarnation")
+	assert(t, dead.overrides(suspect), "Dead doesn't override suspect at the same incarnation")
+	assert(t, !alive.overrides(suspect), "Alive overrides suspicion at the same incarnation")
+	assert(t, refuted.overrides(dead), "Higher incarnation doesn't override dead")
+	assert(t, !suspect.overrides(suspect), "Statement overrides itself")
+}
+
+func TestSuspectExpires(t *testing.T) {
+	var m memberList
+	m.Suspect(viewExist)
+	equals(t, statusSuspect, m.Get(viewExist).Status)
+
+	m.Expire(time.Now())
+	equals(t, statusSuspect, m.Get(viewExist).Status)
+	m.Expire(time.Now().Add(swimSuspectTimeout + time.Second))
+	equals(t, statusDead, m.Get(viewExist).Status)
+}
+
+func TestAliveRefutesSuspicion(t *testing.T) {
+	var m memberList
+	m.Suspect(viewExist)
+	m.Merge(map[string]memberState{viewExist: {Status: statusAlive, Incarnation: 1}})
+	equals(t, statusAlive, m.Get(viewExist).Status)
+
+	// News from an older incarnation is ignored
+	m.Merge(map[string]memberState{viewExist: {Status: statusDead, Incarnation: 0}})
+	equals(t, statusAlive, m.Get(viewExist).Status)
+}
+
+func TestRefuteOwnSuspicion(t *testing.T) {
+	var m memberList
+	m.Merge(map[string]memberState{myIP: {Status: statusDead, Incarnation: 3}})
+
+	// We never take news of our own death, we outlive it
+	s := m.Snapshot()[myIP]
+	equals(t, statusAlive, s.Status)
+	equals(t, 4, s.Incarnation)
+}
+
+func TestReachableSkipsDead(t *testing.T) {
+	members.Merge(map[string]memberState{viewExist: {Status: statusDead}})
+	defer func() { members = memberList{} }()
+
+	g := GossipVals{view: NewView(testMain, testView)}
+	equals(t, []string{"176.32.164.10:8084"}, g.reachable())
+	equals(t, 2, len(g.peers()))
+}
@@ -31,7 +31,35 @@ import (
 
 // A timeGlob is a map of keys to timestamps and lets the gossip module figure out which ones need to be updated
 type timeGlob struct {
-	List map[string]time.Time
+	List    map[string]time.Time
+	Digests map[string]uint64 // Digests of the typed keys in List, see crdt.go
+}
+
+// A merkleRequest asks a peer for the hashes of nodes of its Merkle tree, an empty one ends the session
+type merkleRequest struct {
+	Nodes []int
+}
+
+// A merkleResponse holds the hashes of the nodes that were asked for, in the same order.
+// The first one of a session also holds the dots the peer had seen before hashing.
+type merkleResponse struct {
+	Hashes   []uint64
+	Frontier map[string]int
+}
+
+// A syncRequest opens a push-pull session. It holds the keys under the leaves where our
+// Merkle trees differ and their timestamps, and the address of the initiator.
+type syncRequest struct {
+	From   string
+	Leaves []int
+	Times  timeGlob
+}
+
+// A syncResponse holds the keys the peer wants from the initiator, and the peer's
+// entries under the same leaves that the initiator doesn't hold at the same timestamp
+type syncResponse struct {
+	Want    timeGlob
+	Entries entryGlob
 }
 
 // An entryGlob is a map of keys to entries which allowes the gossip module to enter into conflict resolution and update the required keys
@@ -54,6 +82,22 @@ func Open(addr string) (*bufio.ReadWriter, error) {
 	return bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
 }
 
+// dial connects to a TCP address like Open, but gives up if the whole conversation
+// takes longer than timeout. The caller closes the connection.
+func dial(addr string, timeout time.Duration) (net.Conn, *bufio.ReadWriter, error) {
+	s := strings.Split(addr, ":")[0] + port
+	conn, err := net.DialTimeout("tcp", s, timeout)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Dialing "+addr+" failed")
+	}
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "Setting deadline for "+addr+" failed")
+	}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
 // HandleFunc is a function that handles an incoming command.
 // It receives the open connection wrapped in a `ReadWriter` interface.
 type HandleFunc func(*bufio.ReadWriter)
@@ -138,44 +182,45 @@ func (e *Endpoint) handleMessages(conn net.Conn) {
 	}
 }
 
-// handleTimeGob reads the timeGob out of the request and passes it to the gossip
-// module, then returns the result to the client
-func (e *Endpoint) handleTimeGob(rw *bufio.ReadWriter) {
-	log.Print("Receive Time Gob data:")
-
-	// Create an empty timeGlob
-	var data timeGlob
-
-	// Create a decoder that decodes directly into the empty glob
+// handleSync answers a push-pull session. It sends back the keys we want from the
+// initiator along with our entries it doesn't have, then takes the entries the
+// initiator sends back.
+func (e *Endpoint) handleSync(rw *bufio.ReadWriter) {
+	log.Println("Receive sync session")
 	dec := gob.NewDecoder(rw)
-	err := dec.Decode(&data)
+	enc := gob.NewEncoder(rw)
+
+	var req syncRequest
+	err := dec.Decode(&req)
 	if err != nil {
 		log.Println("Error decoding GOB data:", err)
 		return
 	}
+	log.Printf("Decoding syncRequest: %#v\n", req)
+	if req.From != "" {
+		heartbeats.Heard(req.From)
+	}
 
-	log.Printf("Decoding timeGlob: %#v\n", data)
-
-	// Pass the data glob to the gossip module and get the result
-	data = e.gossip.ClockPrune(data)
-
-	// Create an encoder on the stream
-	enc := gob.NewEncoder(rw)
-	log.Printf("Encoding response timeGlob back to buffer: %#v\n", data)
-	// Encode the response back to the client
-	err = enc.Encode(data)
+	resp := e.gossip.Answer(req)
+	log.Printf("Encoding syncResponse: %#v\n", resp)
+	err = enc.Encode(resp)
 	if err != nil {
-		log.Println("Encode failed for struct: ", data)
+		log.Println("Encode failed for struct: ", resp)
+		return
 	}
-
-	// Flush the buffer to ensure it has all been read before closing it
-	log.Println("Flushing buffer")
 	err = rw.Flush()
 	if err != nil {
 		log.Println("Flush failed.")
+		return
 	}
 
-	log.Printf("timeGlob struct: \n%v", data)
+	var data entryGlob
+	err = dec.Decode(&data)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	e.gossip.Receive(data)
 }
 
 func (e *Endpoint) handleEntryGob(rw *bufio.ReadWriter) {
@@ -190,15 +235,53 @@ func (e *Endpoint) handleEntryGob(rw *bufio.ReadWriter) {
 	}
 
 	log.Println("Decoding entryGlob: ", data)
-	log.Println("Updating KVS")
-	e.gossip.UpdateKVS(data)
+	e.gossip.Receive(data)
 	// Print the complexData struct and the nested one, too, to prove
 	// that both travelled across the wire.
 	log.Printf("Outer complexData struct: \n%#v\n", data)
 }
 
+// handleMerkle answers requests for the hashes of nodes of our Merkle tree until the
+// client sends an empty one
+func (e *Endpoint) handleMerkle(rw *bufio.ReadWriter) {
+	log.Println("Receive Merkle session")
+	dec := gob.NewDecoder(rw)
+	enc := gob.NewEncoder(rw)
+	first := true
+	for {
+		var req merkleRequest
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Println("Error decoding GOB data:", err)
+			return
+		}
+		if len(req.Nodes) == 0 {
+			log.Println("Merkle session done")
+			return
+		}
+
+		// The dots are read first, so every one of them is in the tree we hash
+		var resp merkleResponse
+		if first {
+			resp.Frontier = dots.Frontier()
+			first = false
+		}
+		resp.Hashes = e.gossip.kvs.MerkleHashes(req.Nodes)
+		err = enc.Encode(resp)
+		if err != nil {
+			log.Println("Encode failed for struct: ", resp)
+			return
+		}
+		err = rw.Flush()
+		if err != nil {
+			log.Println("Flush failed.")
+			return
+		}
+	}
+}
+
 func (e *Endpoint) handleViewGob(rw *bufio.ReadWriter) {
-	var data []string
+	var data viewState
 	dec := gob.NewDecoder(rw)
 	log.Println("Decoding viewGob data")
 	err := dec.Decode(&data)
@@ -217,45 +300,100 @@ func (e *Endpoint) handleHelp(rw *bufio.ReadWriter) {
 	wakeGossip = true
 }
 
-// client is called if the app is called with -connect=`ip addr`.
-func sendTimeGlob(ip string, tg timeGlob) (*timeGlob, error) {
-	// Open a connection to the server.
-	var out timeGlob
-
+// sendSync runs a push-pull session with ip. It sends the request, and reply gets the
+// response and returns the entries to send back.
+func sendSync(ip string, req syncRequest, reply func(syncResponse) entryGlob) error {
 	rw, err := Open(ip)
 	if err != nil {
-		return nil, errors.Wrap(err, "Client: Failed to open connection to "+ip)
+		return errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+
+	log.Println("Sending command initialization: 'sync'")
+	n, err := rw.WriteString("sync\n")
+	if err != nil {
+		return errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
 	}
 
 	enc := gob.NewEncoder(rw)
-	log.Println("Sending command initialization: 'time'")
-	n, err := rw.WriteString("time\n")
+	dec := gob.NewDecoder(rw)
+	log.Println("Encoding syncRequest")
+	err = enc.Encode(req)
+	if err != nil {
+		return errors.Wrapf(err, "Encode failed for struct: %#v", req)
+	}
+	err = rw.Flush()
+	if err != nil {
+		return errors.Wrap(err, "Flush failed.")
+	}
 
+	var resp syncResponse
+	log.Println("Reading syncResponse")
+	err = dec.Decode(&resp)
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+		return errors.Wrap(err, "Error decoding GOB data")
 	}
 
-	log.Println("Encoding timeGlob")
-	err = enc.Encode(tg)
+	eg := reply(resp)
+	log.Println("Encoding entryGlob: ", eg)
+	err = enc.Encode(eg)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Encode failed for struct: %#v", tg)
+		return errors.Wrapf(err, "Encode failed for struct: %#v", eg)
 	}
-	log.Println("Flushing buffer")
-	err = rw.Flush()
+	return errors.Wrap(rw.Flush(), "Flush failed.")
+}
+
+// diffMerkle compares our Merkle tree with the one on ip over a single connection and
+// returns the leaves that differ, along with the dots the peer had seen
+func diffMerkle(ip string, db dbAccess) (merkleDiff, error) {
+	rw, err := Open(ip)
 	if err != nil {
-		return nil, errors.Wrap(err, "Flush failed.")
+		return merkleDiff{}, errors.Wrap(err, "Client: Failed to open connection to "+ip)
 	}
 
-	// Create a decoder that decodes directly into a struct variable.
+	log.Println("Sending command initialization: 'merkle'")
+	n, err := rw.WriteString("merkle\n")
+	if err != nil {
+		return merkleDiff{}, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+
+	enc := gob.NewEncoder(rw)
 	dec := gob.NewDecoder(rw)
-	log.Println("Reading timeGlob response")
-	err = dec.Decode(&out)
+	var frontier map[string]int
+	ask := func(nodes []int) ([]uint64, error) {
+		err := enc.Encode(merkleRequest{Nodes: nodes})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Encode failed for nodes: %v", nodes)
+		}
+		err = rw.Flush()
+		if err != nil {
+			return nil, errors.Wrap(err, "Flush failed.")
+		}
+		var resp merkleResponse
+		err = dec.Decode(&resp)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error decoding GOB data")
+		}
+		if resp.Frontier != nil {
+			frontier = resp.Frontier
+		}
+		return resp.Hashes, nil
+	}
+
+	diff, err := compareMerkle(db, ask)
 	if err != nil {
-		log.Println("Error decoding GOB data:", err)
-		return nil, err
+		return diff, err
 	}
+	diff.Frontier = frontier
 
-	return &out, nil
+	// Let the server go
+	err = enc.Encode(merkleRequest{})
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		log.Println("Error ending Merkle session: ", err)
+	}
+	return diff, nil
 }
 
 func sendEntryGlob(ip string, eg entryGlob) error {
@@ -289,7 +427,8 @@ func sendEntryGlob(ip string, eg entryGlob) error {
 	return nil
 }
 
-func sendViewList(ip string, v []string) error {
+// sendView sends our view along with its stamps to ip
+func sendView(ip string, v viewState) error {
 	rw, err := Open(ip)
 	if err != nil {
 		return errors.Wrap(err, "Client: failed to open connection to "+ip)
@@ -301,10 +440,10 @@ func sendViewList(ip string, v []string) error {
 		return errors.Wrap(err, "Could not write view data ("+strconv.Itoa(n)+" bytes written)")
 	}
 
-	log.Println("Encoding view []string")
+	log.Println("Encoding viewState")
 	err = enc.Encode(v)
 	if err != nil {
-		return errors.Wrapf(err, "Encode failed for slice: %#v", v)
+		return errors.Wrapf(err, "Encode failed for view: %#v", v)
 
 	}
 	log.Println("Flushing buffer")
@@ -338,6 +477,18 @@ func server(a App, g GossipVals) {
 	gob.Register(timeGlob{})
 	gob.Register(entryGlob{})
 	gob.Register(Entry{})
+	gob.Register(merkleRequest{})
+	gob.Register(merkleResponse{})
+	gob.Register(syncRequest{})
+	gob.Register(syncResponse{})
+	gob.Register(pingMsg{})
+	gob.Register(pingReqMsg{})
+	gob.Register(ackMsg{})
+	gob.Register(joinRequest{})
+	gob.Register(viewState{})
+	gob.Register(migrateRequest{})
+	gob.Register(migrateAck{})
+	gob.Register(rebalanceDone{})
 
 	// Create a  listener
 	l, err := net.Listen("tcp", port)
@@ -355,10 +506,21 @@ func server(a App, g GossipVals) {
 
 	// Create the TCP endpoint
 	endpoint := NewEndpoint()
-	// Add HandleTimeGob
-	endpoint.AddHandleFunc("time", endpoint.handleTimeGob)
+	// Add HandleSync
+	endpoint.AddHandleFunc("sync", endpoint.handleSync)
 	// Add HandleEntryGob
 	endpoint.AddHandleFunc("entry", endpoint.handleEntryGob)
+	// Add HandleMerkle
+	endpoint.AddHandleFunc("merkle", endpoint.handleMerkle)
+	// Add the failure detector's probes
+	endpoint.AddHandleFunc("ping", endpoint.handlePing)
+	endpoint.AddHandleFunc("ping-req", endpoint.handlePingReq)
+	// Add HandleJoin
+	endpoint.AddHandleFunc("join", endpoint.handleJoin)
+	// Add HandleMigrate
+	endpoint.AddHandleFunc("migrate", endpoint.handleMigrate)
+	// Add HandleRebalanced
+	endpoint.AddHandleFunc("rebalanced", endpoint.handleRebalanced)
 	// Add HandleViewListGob
 	endpoint.AddHandleFunc("view", endpoint.handleViewGob)
 	// Add HandleHelp
@@ -20,7 +20,7 @@ type tcpInterface interface {
 
 	sendEntryGlob(ip string, eg entryGlob) error
 
-	sendTimeGlob(ip string, tg timeGlob) (*timeGlob, error)
+	sendSync(ip string, req syncRequest, reply func(syncResponse) entryGlob) error
 
 	server() error
 }
@@ -0,0 +1,158 @@
+// tombstone.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines garbage collection of tombstones in the KVS. A deleted key stays in the db
+// as a tombstone until every peer in the view has acknowledged that exact version of
+// it, or until the grace period runs out, and is then purged so it no longer ships
+// in every gossip round.
+//
+// A peer acknowledges a key when the timeGlob it prunes during gossip shows that it
+// holds the same timestamp we do, or when the part of our Merkle trees the key is
+// under matches. Purged tombstones are moved to a graveyard. While a key is in the
+// graveyard GetClock and GetTimestamp still report the tombstone, so
+// ConflictResolution keeps rejecting stale copies of the key that a lagging peer might
+// send us instead of resurrecting it.
+//
+// A tombstone purged because the grace period ran out may not have reached every
+// owner yet, and an owner that never saw the delete still holds the key from before
+// it. So a graveyard entry only expires once every owner has acknowledged it, which
+// they keep doing for buried keys the same way as for tombstones, and the retention
+// period has passed.
+//
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// burial is a purged tombstone along with the time it was purged
+type burial struct {
+	Entry   Entry     // The tombstone as it was when it was purged
+	At      time.Time // When it was purged, used to expire it from the graveyard
+	Settled bool      // Every owner has acknowledged it, so it can expire
+}
+
+// AckTombstones records that peer holds every key in acked at the given timestamp.
+// Only tombstones are tracked, acknowledgements for live keys are ignored.
+func (k *KVS) AckTombstones(peer string, acked timeGlob) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for key, ts := range acked.List {
+		k.ack(peer, key, ts)
+	}
+}
+
+// ack records that peer holds a key at the given timestamp if we hold a tombstone for
+// it at that timestamp, in the db or in the graveyard. The caller must hold the write
+// lock.
+func (k *KVS) ack(peer string, key string, ts time.Time) {
+	e, ok := k.db[key]
+	if !ok {
+		e = k.buried(key)
+	}
+	if e == nil || e.Alive() || !e.GetTimestamp().Equal(ts) {
+		return
+	}
+	if k.acks == nil {
+		k.acks = make(map[string]map[string]time.Time)
+	}
+	if k.acks[key] == nil {
+		k.acks[key] = make(map[string]time.Time)
+	}
+	k.acks[key][peer] = ts
+}
+
+// CollectTombstones purges every tombstone that all of the given peers have
+// acknowledged, or that is older than the grace period, and expires graveyard
+// entries that all of them have acknowledged once they're past the retention period.
+// When keys are partitioned, only the peers that own a key have to acknowledge it,
+// with ownership worked out among every member of the view. It returns the number of
+// keys purged.
+func (k *KVS) CollectTombstones(peers []string, members []string) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	now := time.Now()
+	purged := 0
+	for key, e := range k.db {
+		if e.Alive() {
+			continue
+		}
+		ts := e.GetTimestamp()
+		seen := k.ackedByAll(key, ts, peers, members)
+		expired := tombstoneGrace > 0 && now.Sub(ts) > tombstoneGrace
+
+		if seen || expired {
+			log.Println("Purging tombstone for key ", key)
+			k.bury(key, toEntry(e), now, seen)
+			if err := k.logEntry(walPurge, key); err != nil {
+				log.Println("Error logging purge: ", err)
+			}
+			delete(k.db, key)
+			delete(k.history, key)
+			k.index.Remove(key)
+			k.rehash(key)
+			purged++
+		}
+	}
+
+	// The graveyard only needs to outlive the longest partition we're willing to
+	// tolerate, but not before every owner has the tombstone
+	for key, b := range k.graveyard {
+		if !b.Settled && k.ackedByAll(key, b.Entry.Timestamp, peers, members) {
+			b.Settled = true
+			k.graveyard[key] = b
+			delete(k.acks, key)
+		}
+		if b.Settled && tombstoneRetention > 0 && now.Sub(b.At) > tombstoneRetention {
+			delete(k.graveyard, key)
+		}
+	}
+	return purged
+}
+
+// ackedByAll returns true if every one of the peers that owns a key has acknowledged
+// it at the given timestamp. The caller must hold a lock.
+func (k *KVS) ackedByAll(key string, ts time.Time, peers []string, members []string) bool {
+	for _, p := range peers {
+		// Only the owners of a key ever hold it
+		if partitioned() && !ring.Owns(p, key, members) {
+			continue
+		}
+		if at, ok := k.acks[key][p]; !ok || !at.Equal(ts) {
+			return false
+		}
+	}
+	return true
+}
+
+// bury moves a tombstone into the graveyard, the caller must hold the write lock. The
+// acknowledgements are kept until every owner has acknowledged it.
+func (k *KVS) bury(key string, e Entry, at time.Time, settled bool) {
+	if k.graveyard == nil {
+		k.graveyard = make(map[string]burial)
+	}
+	k.graveyard[key] = burial{Entry: e, At: at, Settled: settled}
+	if settled {
+		delete(k.acks, key)
+	}
+}
+
+// buried returns the purged tombstone for a key, or nil if it isn't in the graveyard.
+// The caller must hold a lock.
+func (k *KVS) buried(key string) KeyEntry {
+	if b, ok := k.graveyard[key]; ok {
+		e := b.Entry
+		return &e
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// tombstone_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for tombstone garbage collection
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	peerOne = "176.32.164.10:8083"
+	peerTwo = "176.32.164.10:8084"
+)
+
+// deadKVS returns a KVS holding a single tombstone for keyExists
+func deadKVS() *KVS {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	k.Delete(keyExists, time.Now(), map[string]int{})
+	return k
+}
+
+func TestCollectTombstonesWaitsForEveryPeer(t *testing.T) {
+	k := deadKVS()
+	ts := k.GetTimestamp(keyExists)
+	acked := timeGlob{List: map[string]time.Time{keyExists: ts}}
+
+	k.AckTombstones(peerOne, acked)
+	equals(t, 0, k.CollectTombstones([]string{peerOne, peerTwo}, nil))
+	_, found := k.GetTimeGlob().List[keyExists]
+	assert(t, found, "Tombstone purged before every peer saw it")
+
+	k.AckTombstones(peerTwo, acked)
+	equals(t, 1, k.CollectTombstones([]string{peerOne, peerTwo}, nil))
+	_, found = k.GetTimeGlob().List[keyExists]
+	assert(t, !found, "Tombstone still shipped in the timeGlob")
+}
+
+func TestCollectTombstonesOwnersFromWholeView(t *testing.T) {
+	defer func() { setNumShards(1) }()
+	v := NewView(testMain, shardView)
+	v.SetShards(2)
+	members := v.List()
+	peers := without(shardsOf(v)[shardOf(v, testMain)], testMain)
+	equals(t, []string{peerTwo}, peers)
+
+	// Our shard peer owns every key we do, and has to see the tombstone first
+	key := ownedKey(testMain, members)
+	k := NewKVS()
+	k.Put(key, valone, time.Now(), map[string]int{})
+	k.Delete(key, time.Now(), map[string]int{})
+	equals(t, 0, k.CollectTombstones(peers, members))
+
+	k.AckTombstones(peerTwo, timeGlob{List: map[string]time.Time{key: k.GetTimestamp(key)}})
+	equals(t, 1, k.CollectTombstones(peers, strings.Split(shardView, ",")))
+}
+
+func TestAckTombstonesIgnoresOtherVersions(t *testing.T) {
+	k := deadKVS()
+
+	// An ack for an older version of the key doesn't count
+	k.AckTombstones(peerOne, timeGlob{List: map[string]time.Time{keyExists: time.Now().Add(-time.Hour)}})
+	equals(t, 0, k.CollectTombstones([]string{peerOne}, nil))
+
+	// Neither does an ack for a live key
+	k.Put(keyone, valone, time.Now(), map[string]int{})
+	k.AckTombstones(peerOne, timeGlob{List: map[string]time.Time{keyone: k.GetTimestamp(keyone)}})
+	equals(t, 0, len(k.acks[keyone]))
+}
+
+func TestCollectTombstonesAfterGrace(t *testing.T) {
+	tombstoneGrace = time.Minute
+	defer func() { tombstoneGrace = 0 }()
+
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	k.Delete(keyExists, time.Now().Add(-2*time.Minute), map[string]int{})
+
+	equals(t, 1, k.CollectTombstones([]string{peerOne}, nil))
+}
+
+func TestPurgedKeyKeepsItsVersion(t *testing.T) {
+	k := deadKVS()
+	_, before := k.Contains(keyExists)
+	equals(t, 1, k.CollectTombstones(nil, nil))
+
+	alive, after := k.Contains(keyExists)
+	assert(t, !alive, "Purged key is alive")
+	equals(t, before, after)
+}
+
+func TestPurgedKeyCantBeResurrected(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+
+	// A lagging peer still has the original live version
+	stale := toEntry(k.db[keyExists])
+
+	k.Delete(keyExists, time.Now(), map[string]int{})
+	equals(t, 1, k.CollectTombstones(nil, nil))
+
+	g := GossipVals{kvs: k, view: &TestView{view: testMain}}
+	g.UpdateKVS(entryGlob{Keys: map[string]Entry{keyExists: stale}})
+
+	alive, _ := k.Contains(keyExists)
+	assert(t, !alive, "Stale entry resurrected a purged key")
+
+	// A genuinely newer write still gets through
+	newer := Entry{
+		Version:   3,
+		Timestamp: time.Now(),
+		Clock:     past(k.buried(keyExists)),
+		Value:     valtwo,
+		Node:      viewExist,
+		Dot:       1,
+	}
+	g.UpdateKVS(entryGlob{Keys: map[string]Entry{keyExists: newer}})
+	alive, _ = k.Contains(keyExists)
+	assert(t, alive, "Newer write was rejected")
+}
+
+func TestClockPrunePrunesPurgedTombstones(t *testing.T) {
+	k := deadKVS()
+	ts := k.GetTimestamp(keyExists)
+	equals(t, 1, k.CollectTombstones(nil, nil))
+
+	g := GossipVals{kvs: k, view: &TestView{view: testMain}}
+	pruned := g.ClockPrune(timeGlob{List: map[string]time.Time{keyExists: ts}})
+	equals(t, 0, len(pruned.List))
+}
+
+func TestGraveyardSurvivesRestart(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := deadKVS()
+	equals(t, 1, k.CollectTombstones(nil, nil))
+	ok(t, k.Close())
+
+	r := NewKVS()
+	defer r.Close()
+	_, found := r.GetTimeGlob().List[keyExists]
+	assert(t, !found, "Purged key came back from the log")
+	equals(t, k.GetDot(keyExists), r.GetDot(keyExists))
+}
+
+func TestGraveyardWaitsForEveryOwner(t *testing.T) {
+	tombstoneGrace = time.Minute
+	tombstoneRetention = time.Nanosecond
+	defer func() { tombstoneGrace, tombstoneRetention = 0, 0 }()
+
+	// The grace period runs out before peerOne has seen the delete
+	k := NewKVS()
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	k.Delete(keyExists, time.Now().Add(-2*time.Minute), map[string]int{})
+	ts := k.GetTimestamp(keyExists)
+	equals(t, 1, k.CollectTombstones([]string{peerOne}, nil))
+	time.Sleep(time.Millisecond)
+	k.CollectTombstones([]string{peerOne}, nil)
+	assert(t, k.buried(keyExists) != nil, "Graveyard expired before every owner saw the tombstone")
+
+	// Once it has, the graveyard can let go of it
+	k.AckTombstones(peerOne, timeGlob{List: map[string]time.Time{keyExists: ts}})
+	k.CollectTombstones([]string{peerOne}, nil)
+	assert(t, k.buried(keyExists) == nil, "Graveyard kept a tombstone every owner has")
+}
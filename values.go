@@ -12,18 +12,122 @@
 
 package main
 
+import "time"
+
 const (
 	// These control the REST API
-	rootURL   = "/keyValue-store" // We hang the router off this
-	port      = ":8080"           // This is used for the TCP module
-	search    = "/search"
-	view      = "/view"
-	keySuffix = "/{subject}"
+	rootURL            = "/keyValue-store" // We hang the router off this
+	port               = ":8080"           // This is used for the TCP module
+	search             = "/search"
+	view               = "/view"
+	keySuffix          = "/{subject}"
+	admin              = "/admin"
+	snapshotSuffix     = "/snapshot"
+	node               = "/node"
+	decommissionSuffix = "/decommission"
+	historySuffix      = "/history"
+	counterSuffix      = "/counter"
+	setSuffix          = "/set"
+	registerSuffix     = "/register"
+	batchSuffix        = "/_batch"
+	statusSuffix       = "/status"
 
 	// Maximum input restrictions
 	maxVal = 1048576 // 1 megabyte
 	maxKey = 200     // 200 characters
 
+	// These control the write-ahead log
+	walFile         = "kvs.wal"       // Name of the log file inside the data directory
+	walSyncAlways   = "always"        // fsync after every record
+	walSyncInterval = "interval"      // fsync every walSyncPeriod
+	walSyncNone     = "none"          // Leave flushing to the OS
+	walSyncPeriod   = 1 * time.Second // How often the interval policy syncs
+
+	// These control snapshots of the KVS
+	snapFile                 = "kvs.snap"      // Prefix of snapshot files inside the data directory
+	snapshotPoll             = 1 * time.Second // How often the snapshot loop checks its triggers
+	defaultSnapshotInterval  = 5 * time.Minute // Time between scheduled snapshots
+	defaultSnapshotThreshold = 64 << 20        // Log bytes that trigger a snapshot early
+
+	// These control the hybrid logical clock
+	defaultMaxClockOffset = 30 * time.Second // Furthest a peer's timestamp can be ahead of our wall clock
+
+	// These control tombstone garbage collection
+	defaultTombstoneGrace     = 10 * time.Minute // Tombstones older than this are purged even if a peer hasn't seen them
+	defaultTombstoneRetention = 24 * time.Hour   // Purged tombstones block resurrection for this long
+
+	// These control key expiry
+	ttlField     = "ttl"           // Form field a PUT can carry a TTL in
+	ttlHeader    = "X-TTL"         // Header a PUT can carry a TTL in
+	reapInterval = 1 * time.Second // How often the reaper looks for expired keys
+
+	// These control range scans
+	rangeDefaultLimit = 100  // Page size when the client doesn't ask for one
+	rangeMaxLimit     = 1000 // Largest page a client can ask for
+
+	// These control version history
+	defaultHistoryDepth = 10 // Replaced versions kept per key
+
+	// These control batches
+	batchMaxOps = 1000 // Most operations a single batch can hold
+
+	// These control anti-entropy
+	merkleDepth = 10 // Levels of the Merkle tree below the root, which gives it 1024 leaves
+
+	// These control gossip rounds
+	gossipPoll            = 50 * time.Millisecond // How often the heartbeat checks whether a round is due
+	defaultGossipFanout   = 2                     // Peers synced with each round
+	defaultGossipInterval = 5 * time.Second       // Longest wait between rounds
+
+	// These control the failure detector
+	swimProbeInterval  = 1 * time.Second        // Time between probes
+	swimPingTimeout    = 500 * time.Millisecond // How long a member gets to answer a ping
+	swimIndirect       = 3                      // Members asked to ping one that didn't answer
+	swimSuspectTimeout = 5 * time.Second        // How long a suspect has to show it's alive
+
+	// These control phi accrual failure detection
+	defaultPhiThreshold = 8.0                    // Phi past which a peer is skipped
+	phiWindow           = 100                    // Gaps between contacts kept per peer
+	phiMinStdDev        = 100 * time.Millisecond // Floor on the spread of the gaps, so a steady peer isn't suspected at the first hiccup
+	phiMax              = 1000.0                 // Phi is capped here, anything past it is as good as dead
+
+	// These control joining through a seed
+	joinChunkSize = 256             // Entries sent to a joining node per chunk
+	joinTimeout   = 5 * time.Minute // How long a whole state transfer may take
+	joinRetry     = 2 * time.Second // How long to wait before going through the seeds again
+
+	// These control decommissioning
+	decommissionTimeout = 2 * time.Minute        // How long peers have to catch up before we give up leaving
+	decommissionPoll    = 500 * time.Millisecond // How long to wait between rounds with peers that are behind
+
+	// These control partitioning
+	defaultVirtualNodes = 64               // Points each member gets on the hash ring
+	forwardTimeout      = 5 * time.Second  // How long an owner has to answer a forwarded request
+	ownersHeader        = "X-Key-Owners"   // Response header naming the owners of the key
+	forwardedHeader     = "X-Forwarded-By" // Request header marking a request forwarded by another node
+
+	// These control shards and moving keys between them
+	shard             = "/shard"
+	myIDSuffix        = "/my_id"
+	allIDsSuffix      = "/all_ids"
+	membersSuffix     = "/members/{id}"
+	countSuffix       = "/count/{id}"
+	changeShardSuffix = "/changeShardNumber"
+	migrateChunkSize  = 256              // Entries sent to a new owner at once
+	migrateWindow     = 4                // Chunks sent to a new owner that it hasn't answered yet
+	migrateTimeout    = 30 * time.Second // How long a new owner has to take a chunk
+
+	// These control rebalancing
+	rebalanceSuffix = "/rebalance"
+	rebalancePoll   = 1 * time.Second  // How often to check whether keys have to move
+	handoffHeader   = "X-Handoff-Read" // Request header marking a read sent to the old owners of a key
+
+	// These control push gossip
+	deltaBufferSize = 1024                 // Most recent mutations waiting to be pushed
+	deltaRounds     = 3                    // Rounds each mutation is pushed for
+	deltaFanout     = 2                    // Peers each round is pushed to
+	deltaPushDelay  = 5 * time.Millisecond // Wait before a round so writes made together go together
+
 	// These are for unit tests
 	keyExists    = "KEY_EXISTS"
 	keyNotExists = "KEY_DOESN'T_EXIST"
@@ -47,7 +151,36 @@ const (
 )
 
 // These values are used throughout the app and are initially set in main
-var myIP string     // set as environment variable IP_PORT
-var wakeGossip bool // If true, we wake up during the heartbeat loop
-var needHelp bool   // If this is true, we haven't heard anything in a while
-var viewChange bool // If this is true, we need to communicate a view change
+var myIP string      // set as environment variable IP_PORT
+var replicaID string // myIP and the time the node started, names our contributions to typed values
+var wakeGossip bool  // If true, we wake up during the heartbeat loop
+var needHelp bool    // If this is true, we haven't heard anything in a while
+var viewChange bool  // If this is true, we need to communicate a view change
+var dataDir string   // set as environment variable DATA_DIR, persistence is off if empty
+var walSync string   // set as environment variable WAL_SYNC, one of the walSync* policies
+
+var snapshotInterval time.Duration // set as environment variable SNAPSHOT_INTERVAL, 0 disables it
+var snapshotThreshold int64        // set as environment variable SNAPSHOT_BYTES, 0 disables it
+
+var maxClockOffset = defaultMaxClockOffset // set as environment variable MAX_CLOCK_OFFSET, 0 lets the clock follow any timestamp
+
+var tombstoneGrace time.Duration     // set as environment variable TOMBSTONE_GRACE, 0 waits for every peer
+var tombstoneRetention time.Duration // set as environment variable TOMBSTONE_RETENTION, 0 keeps them forever
+
+var siblingPrefixes []string // set as environment variable SIBLING_PREFIXES, keys under these keep concurrent values
+
+var defaultResolver ConflictResolver = vectorClockResolver{} // set as environment variable CONFLICT_POLICY
+var conflictPolicies []resolverPolicy                        // set as environment variable CONFLICT_POLICIES
+
+var gossipFanout = defaultGossipFanout            // set as environment variable GOSSIP_FANOUT
+var gossipInterval = defaultGossipInterval        // set as environment variable GOSSIP_INTERVAL
+var gossipJitter time.Duration                    // set as environment variable GOSSIP_JITTER, 0 keeps rounds exactly an interval apart
+var peerSelection peerSelector = randomSelector{} // set as environment variable GOSSIP_PEERS
+var phiThreshold = defaultPhiThreshold            // set as environment variable PHI_THRESHOLD, 0 turns it off
+
+var replicas int                       // set as environment variable REPLICAS, 0 keeps every key on every node
+var shardCount int32 = 1               // set as environment variable SHARDS, and by the view when it changes
+var virtualNodes = defaultVirtualNodes // set as environment variable VNODES
+
+var historyDepth = defaultHistoryDepth // set as environment variable HISTORY_DEPTH, 0 turns history off
+var historyMaxAge time.Duration        // set as environment variable HISTORY_AGE, 0 keeps versions until they're pushed out
@@ -9,12 +9,29 @@
 //
 // Defines an interface and struct for maintaining the view of the system.
 //
+// Every member of the view, including the ones that have been removed, carries a stamp
+// saying when it was last added or removed: the view epoch the change was made at and
+// the node that made it. A node making a change stamps it with one more than the
+// highest epoch it has seen. Views are sent around with their stamps and merged member
+// by member, keeping whichever stamp is newer, so a peer with an old view can't undo a
+// recent change, and two changes made at the same time both end up applied. If they
+// touch the same member the removal wins, and two of the same kind are ordered by
+// origin, so every node settles on the same view.
+//
+// The number of shards the view is divided into travels with it under a stamp of its
+// own, and is merged the same way.
+//
+// The view is changed by the gossip and TCP goroutines while every request reads it,
+// so a viewList guards itself with a lock. Copies of a viewList share their maps, so
+// they share the lock too.
+//
 
 package main
 
 import (
 	"sort"
 	"strings"
+	"sync"
 )
 
 // A View maintains a list of IP:Port pairs as its view of the system configuration and implements methods for modifying it
@@ -37,9 +54,25 @@ type View interface {
 	// Returns the item associated with this server
 	Primary() string
 
-	// Overwrite is used by gossiping to overwrite the view
+	// Overwrite replaces the view with the given list as a single change
 	Overwrite([]string)
 
+	// Merge takes every change in a view sent by a peer that's newer than ours, and
+	// returns true if anything changed
+	Merge(viewState) bool
+
+	// State returns the view with its stamps, to send to a peer
+	State() viewState
+
+	// Epoch returns the highest epoch any change to the view was made at
+	Epoch() int
+
+	// Shards returns the number of shards the view is divided into
+	Shards() int
+
+	// SetShards changes the number of shards
+	SetShards(int)
+
 	// List just gives a []string of our views to make it easy to gossip
 	List() []string
 
@@ -47,15 +80,63 @@ type View interface {
 	String() string
 }
 
+// A viewStamp records the last change made to a member of the view
+type viewStamp struct {
+	Epoch   int    // The view epoch the change was made at
+	Origin  string // The node that made the change
+	Removed bool   // True if the member was removed
+}
+
+// newer returns true if s was made after o. At the same epoch a removal beats an add,
+// and the origin breaks any remaining tie.
+func (s viewStamp) newer(o viewStamp) bool {
+	if s.Epoch != o.Epoch {
+		return s.Epoch > o.Epoch
+	}
+	if s.Removed != o.Removed {
+		return s.Removed
+	}
+	return s.Origin > o.Origin
+}
+
+// A shardStamp records the last change to the number of shards
+type shardStamp struct {
+	Count int
+	Stamp viewStamp
+}
+
+// A viewState is a view with the stamps of its members, which is what's sent between nodes
+type viewState struct {
+	Members map[string]viewStamp
+	Shards  shardStamp
+}
+
+// List returns the members of the view that haven't been removed, in order
+func (s viewState) List() []string {
+	var l []string
+	for m, st := range s.Members {
+		if !st.Removed {
+			l = append(l, m)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
 // A viewList is a struct which implements the View interface and holds the view of the server configs
 type viewList struct {
-	views   map[string]string // This is a map because it gives O(1) lookups
-	primary string            // This is the server we're actually on
+	mutex   *sync.RWMutex        // Guards everything below, shared by copies like the maps are
+	views   map[string]string    // This is a map because it gives O(1) lookups
+	stamps  map[string]viewStamp // The last change to every member we've heard of, removed ones too
+	shards  *shardStamp          // The last change to the number of shards
+	primary string               // This is the server we're actually on
 }
 
 // List spits out a byte slice
 func (v *viewList) List() []string {
 	if v != nil {
+		v.mutex.RLock()
+		defer v.mutex.RUnlock()
 		var s []string
 		for k := range v.views {
 			s = append(s, k)
@@ -65,34 +146,152 @@ func (v *viewList) List() []string {
 	return nil
 }
 
-// Overwrite simply replaces the view list
+// Overwrite replaces the view list, stamping every member it adds or removes with the
+// same new epoch
 func (v *viewList) Overwrite(n []string) {
 	if v != nil && v.views != nil {
-		diff := false
-		if len(n) == len(v.views) {
-			for _, val := range n {
-				if !v.Contains(val) {
-					diff = true
-				}
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		keep := make(map[string]bool, len(n))
+		for _, k := range n {
+			keep[k] = true
+		}
+		stamp := v.nextStamp()
+		for k := range v.views {
+			if !keep[k] {
+				v.set(k, stamp, true)
 			}
-		} else {
-			diff = true
 		}
-		if diff {
-			for k := range v.views {
-				delete(v.views, k)
+		for k := range keep {
+			if _, ok := v.views[k]; !ok {
+				v.set(k, stamp, false)
 			}
-			for _, k := range n {
-				v.views[k] = k
+		}
+	}
+}
+
+// Merge takes the stamps in s that are newer than ours
+func (v *viewList) Merge(s viewState) bool {
+	if v == nil || v.views == nil {
+		return false
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	changed := false
+	for k, st := range s.Members {
+		if cur, ok := v.stamps[k]; ok && !st.newer(cur) {
+			continue
+		}
+		v.set(k, st, st.Removed)
+		changed = true
+	}
+	if s.Shards.Count > 0 && v.shards != nil && s.Shards.Stamp.newer(v.shards.Stamp) {
+		v.setShards(s.Shards)
+		changed = true
+	}
+	return changed
+}
+
+// State returns a copy of the stamps of every member
+func (v *viewList) State() viewState {
+	s := viewState{Members: make(map[string]viewStamp)}
+	if v != nil {
+		v.mutex.RLock()
+		defer v.mutex.RUnlock()
+		for k, st := range v.stamps {
+			s.Members[k] = st
+		}
+		if v.shards != nil {
+			s.Shards = *v.shards
+		}
+	}
+	return s
+}
+
+// Epoch returns the highest epoch in the view
+func (v *viewList) Epoch() int {
+	if v == nil {
+		return 0
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	return v.epoch()
+}
+
+// epoch returns the highest epoch in the view. The caller must hold a lock.
+func (v *viewList) epoch() int {
+	e := 0
+	if v != nil {
+		for _, st := range v.stamps {
+			if st.Epoch > e {
+				e = st.Epoch
 			}
-			viewChange = true
 		}
+		if v.shards != nil && v.shards.Stamp.Epoch > e {
+			e = v.shards.Stamp.Epoch
+		}
+	}
+	return e
+}
+
+// Shards returns the number of shards, 1 if the view isn't divided
+func (v *viewList) Shards() int {
+	if v == nil {
+		return 1
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if v.shards != nil && v.shards.Count > 0 {
+		return v.shards.Count
 	}
+	return 1
+}
+
+// SetShards changes the number of shards as a new change to the view
+func (v *viewList) SetShards(n int) {
+	if v != nil && n > 0 {
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		v.setShards(shardStamp{Count: n, Stamp: v.nextStamp()})
+	}
+}
+
+// setShards records a change to the number of shards. The caller must hold a lock.
+func (v *viewList) setShards(s shardStamp) {
+	if v.shards == nil {
+		v.shards = &shardStamp{}
+	}
+	*v.shards = s
+	setNumShards(s.Count)
+	viewChange = true
+}
+
+// nextStamp returns the stamp for a change made here. The caller must hold a lock.
+func (v *viewList) nextStamp() viewStamp {
+	return viewStamp{Epoch: v.epoch() + 1, Origin: v.primary}
+}
+
+// set records a change to a member and applies it to the list. The caller must hold a
+// lock.
+func (v *viewList) set(item string, st viewStamp, removed bool) {
+	if v.stamps == nil {
+		v.stamps = make(map[string]viewStamp)
+	}
+	st.Removed = removed
+	v.stamps[item] = st
+	if removed {
+		delete(v.views, item)
+	} else {
+		v.views[item] = item
+	}
+	viewChange = true
 }
 
 // Count returns the number of elements in the view list
 func (v *viewList) Count() int {
 	if v != nil {
+		v.mutex.RLock()
+		defer v.mutex.RUnlock()
 		return len(v.views)
 	}
 	return 0
@@ -101,6 +300,8 @@ func (v *viewList) Count() int {
 // Contains returns true if the viewList contains a particular item
 func (v *viewList) Contains(item string) bool {
 	if v != nil {
+		v.mutex.RLock()
+		defer v.mutex.RUnlock()
 		_, ok := v.views[item]
 		return ok
 	}
@@ -110,8 +311,9 @@ func (v *viewList) Contains(item string) bool {
 // Remove deletes an item from the view
 func (v *viewList) Remove(item string) bool {
 	if v != nil {
-		delete(v.views, item)
-		viewChange = true
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		v.set(item, v.nextStamp(), true)
 		return true
 	}
 	return false
@@ -120,8 +322,9 @@ func (v *viewList) Remove(item string) bool {
 // Add inserts an item into the view
 func (v *viewList) Add(item string) bool {
 	if v != nil {
-		v.views[item] = item
-		viewChange = true
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		v.set(item, v.nextStamp(), false)
 		return true
 	}
 	return false
@@ -130,6 +333,8 @@ func (v *viewList) Add(item string) bool {
 // Random picks up to N random elements and returns them as a slice (up to because it'll max out at the number of items available)
 func (v *viewList) Random(n int) []string {
 	if v != nil {
+		v.mutex.RLock()
+		defer v.mutex.RUnlock()
 		var m int
 		// The limit here is len()-1 because we don't want to return the primary
 		if len(v.views)-1 > n {
@@ -144,7 +349,8 @@ func (v *viewList) Random(n int) []string {
 				items = append(items, k)
 			}
 		}
-		return items[0:m]
+		// Map order isn't random enough to sample from, so shuffle first
+		return shuffled(items)[0:m]
 	}
 	return nil
 }
@@ -160,6 +366,8 @@ func (v *viewList) Primary() string {
 // String converts the view into a comma-separated string
 func (v *viewList) String() string {
 	if v != nil {
+		v.mutex.RLock()
+		defer v.mutex.RUnlock()
 		var items []string
 		for _, k := range v.views {
 			items = append(items, k)
@@ -185,13 +393,19 @@ func NewView(main string, input string) *viewList {
 	// Convert the input string into a slice
 	slice := strings.Split(input, ",")
 
-	// Insert each element of the slice into the map
+	// Insert each element of the slice into the map. Everyone starts from the same
+	// list, so it's the view at epoch 0.
+	stamps := make(map[string]viewStamp)
 	for _, s := range slice {
 		v[s] = s
+		stamps[s] = viewStamp{}
 	}
 
 	list := viewList{
+		mutex:   &sync.RWMutex{},
 		views:   v,
+		stamps:  stamps,
+		shards:  &shardStamp{Count: numShards()},
 		primary: main,
 	}
 	return &list
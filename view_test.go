@@ -183,3 +183,79 @@ func TestStringViewNilReturnsEmpty(t *testing.T) {
 	var v *viewList
 	assert(t, v.String() == "", "String blew up")
 }
+
+// Every change raises the epoch past anything the view has seen
+func TestViewChangesRaiseEpoch(t *testing.T) {
+	v := NewView(testMain, testView)
+	equals(t, 0, v.Epoch())
+	v.Add(viewNotExist)
+	equals(t, 1, v.Epoch())
+	v.Remove(viewNotExist)
+	equals(t, 2, v.Epoch())
+	v.Overwrite([]string{testMain, viewExist})
+	equals(t, 3, v.Epoch())
+	equals(t, viewStamp{Epoch: 3, Origin: testMain, Removed: true}, v.State().Members["176.32.164.10:8084"])
+}
+
+// A view that's behind can't undo a newer change
+func TestMergeIgnoresStaleView(t *testing.T) {
+	a := NewView(testMain, testView)
+	b := NewView(viewExist, testView)
+	stale := b.State()
+
+	a.Remove("176.32.164.10:8084")
+	a.Add(viewNotExist)
+	assert(t, !a.Merge(stale), "Stale view changed anything")
+	assert(t, !a.Contains("176.32.164.10:8084"), "Stale view undid a removal")
+	assert(t, a.Contains(viewNotExist), "Stale view undid an add")
+
+	// The other way round, b catches up
+	assert(t, b.Merge(a.State()), "Newer view changed nothing")
+	equals(t, a.String(), b.String())
+	equals(t, a.Epoch(), b.Epoch())
+}
+
+// Changes made at the same time on two nodes are both kept, and they settle on the
+// same view whichever order they merge in
+func TestMergeConcurrentChanges(t *testing.T) {
+	a := NewView(testMain, testView)
+	b := NewView(viewExist, testView)
+	a.Add(viewNotExist)
+	b.Remove("176.32.164.10:8084")
+	a.Merge(b.State())
+	b.Merge(a.State())
+	equals(t, strings.Join([]string{testMain, viewExist, viewNotExist}, ","), a.String())
+	equals(t, a.String(), b.String())
+
+	// Both touch the same member at the same epoch, and the removal wins on either side
+	a.Remove(viewNotExist)
+	b.Add(viewNotExist)
+	equals(t, a.Epoch(), b.Epoch())
+	c := NewView(viewNotExist, testView)
+	c.Merge(b.State())
+	c.Merge(a.State())
+	a.Merge(b.State())
+	b.Merge(a.State())
+	equals(t, a.String(), b.String())
+	equals(t, a.String(), c.String())
+	assert(t, !a.Contains(viewNotExist), "Concurrent add beat a removal")
+}
+
+// Gossip changes the view while requests read it, which the race detector checks
+func TestViewChangesWhileRead(t *testing.T) {
+	v := NewView(testMain, testView)
+	app := App{view: *v}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			v.Remove(viewExist)
+			v.Add(viewExist)
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		app.view.List()
+		app.view.State()
+	}
+	<-done
+}
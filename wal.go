@@ -0,0 +1,433 @@
+// wal.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines an append-only write-ahead log for the KVS. Every mutation of the db is
+// written to the log as a framed, checksummed record before the write is reported
+// back to the client, and the log is replayed by NewKVS so that a restarted replica
+// comes back with all of its keys, tombstones, versions and clocks intact.
+//
+// Each record on disk looks like this:
+//
+//     | length (4 bytes) | crc32 (4 bytes) | gob-encoded walRecord (length bytes) |
+//
+// A crash in the middle of an append leaves a torn record at the end of the file,
+// either cut short or with a length that made it to disk ahead of its payload. When
+// the log is opened, a record at the end of the newest segment that's cut short, fails
+// its checksum or can't be decoded is treated as the end of the log and truncated. A
+// bad record with intact records after it, or a torn one in an older segment, means
+// the log is damaged, and the node refuses to start rather than replay it with a gap.
+//
+// The log is split into numbered segments so it can be compacted behind snapshots,
+// see snapshot.go.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// walOp identifies which KVS method produced a log record
+type walOp uint8
+
+const (
+	walPut       walOp = iota + 1 // Written by KVS.Put
+	walDelete                     // Written by KVS.Delete
+	walOverwrite                  // Written by KVS.OverwriteEntry
+	walPurge                      // Written by KVS.CollectTombstones
+	walBatch                      // Written by KVS.Batch and KVS.OverwriteEntries
+	walForget                     // Written by KVS.Forget
+)
+
+// walHeaderSize is the size of the length and checksum fields in front of each record
+const walHeaderSize = 8
+
+// walRecord is a single mutation as it is stored in the log. The entry is the full
+// state of the key after the mutation was applied, so replaying a record is just a
+// matter of storing it.
+//
+// A batch is logged as a single record with every key in Batch, so that a torn
+// append can't leave half of it behind after a crash.
+type walRecord struct {
+	Op      walOp
+	Key     string
+	Entry   Entry
+	Batch   map[string]Entry
+	Settled bool // For a purge, every owner had acknowledged the tombstone
+}
+
+// writeAheadLog is an append-only sequence of segment files holding walRecords.
+// Segments are named kvs.wal.NNNNNNNN and a new one is started every time a
+// snapshot is taken, so that older segments can be deleted once they are covered.
+type writeAheadLog struct {
+	dir    string        // Directory holding the segments
+	seq    uint64        // Sequence number of the segment being appended to
+	size   int64         // Bytes in the current segment
+	file   *os.File      // The current segment, positioned at its end
+	writer *bufio.Writer // Buffered writer on top of the file
+	policy string        // One of the walSync* policies
+	dirty  bool          // True if there are writes that haven't been fsynced
+	mutex  sync.Mutex    // Serializes appends, syncs and closes
+	done   chan struct{} // Closed to stop the background sync loop
+}
+
+// segmentPath returns the path of the log segment with the given sequence number
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%08d", walFile, seq))
+}
+
+// listSequences returns the sorted sequence numbers of the files in dir named prefix.NNNNNNNN
+func listSequences(dir string, prefix string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, prefix+".*"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Listing "+prefix+" files failed")
+	}
+	var seqs []uint64
+	for _, n := range names {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(n), prefix+"."), 10, 64)
+		if err != nil {
+			// Temp files and anything else that isn't ours
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// openWAL reads every intact record from the log segments in dir that come after the
+// segment numbered after, truncates any torn record at the tail of the newest segment,
+// and returns the log positioned for appends along with the records to replay.
+func openWAL(dir string, after uint64, policy string) (*writeAheadLog, []walRecord, error) {
+	seqs, err := listSequences(dir, walFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Segments at or below 'after' are already covered by a snapshot
+	var live []uint64
+	for _, seq := range seqs {
+		if seq > after {
+			live = append(live, seq)
+		}
+	}
+	if len(live) == 0 {
+		live = append(live, after+1)
+	}
+
+	var records []walRecord
+	var f *os.File
+	for i, seq := range live {
+		path := segmentPath(dir, seq)
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Opening write-ahead log "+path+" failed")
+		}
+
+		recs, good, torn, err := readWAL(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, errors.Wrap(err, "Reading write-ahead log "+path+" failed")
+		}
+		records = append(records, recs...)
+
+		// Only the newest segment is kept open for appends, and only it can be torn
+		if i < len(live)-1 {
+			f.Close()
+			if torn {
+				return nil, nil, errors.New("Write-ahead log " + path + " ends in an incomplete record")
+			}
+			continue
+		}
+
+		// Anything after the last good record is a torn write, so cut it off
+		if err = truncateWAL(f, good); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+
+	w := &writeAheadLog{
+		dir:    dir,
+		seq:    live[len(live)-1],
+		file:   f,
+		writer: bufio.NewWriter(f),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	w.size, _ = f.Seek(0, io.SeekCurrent)
+
+	// The interval policy leaves fsync to a background loop
+	if policy == walSyncInterval {
+		go w.syncLoop(walSyncPeriod)
+	}
+
+	log.Printf("Opened write-ahead log %s with %d records\n", segmentPath(dir, w.seq), len(records))
+	return w, records, nil
+}
+
+// truncateWAL cuts the file off at the end of the last good record and positions it for appends
+func truncateWAL(f *os.File, good int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "Reading write-ahead log size failed")
+	}
+	if info.Size() > good {
+		log.Printf("Truncating torn tail of write-ahead log: %d bytes\n", info.Size()-good)
+		if err = f.Truncate(good); err != nil {
+			return errors.Wrap(err, "Truncating write-ahead log failed")
+		}
+		if err = f.Sync(); err != nil {
+			return errors.Wrap(err, "Syncing write-ahead log failed")
+		}
+	}
+	if _, err = f.Seek(good, io.SeekStart); err != nil {
+		return errors.Wrap(err, "Seeking write-ahead log failed")
+	}
+	return nil
+}
+
+// readWAL reads records from the start of the file until it hits EOF or a record
+// that is torn. It returns the records, the offset just past the last good one, and
+// whether the file ended in a torn record. A record that fails its checksum or can't
+// be decoded is torn if no intact record follows it, and an error otherwise.
+func readWAL(f *os.File) ([]walRecord, int64, bool, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, false, errors.Wrap(err, "Seeking write-ahead log failed")
+	}
+	r := bufio.NewReader(f)
+
+	var records []walRecord
+	var good int64
+	header := make([]byte, walHeaderSize)
+	for {
+		n, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return records, good, false, nil
+		}
+		if err != nil {
+			log.Printf("Write-ahead log header is incomplete: %d bytes\n", n)
+			return records, good, true, nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+
+		// Copy rather than allocating 'length' bytes up front, since a torn header can hold garbage
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+			log.Println("Write-ahead log record is incomplete: ", err)
+			return records, good, true, nil
+		}
+		rec, err := decodeRecord(buf.Bytes(), sum)
+		if err != nil {
+			if !intactFollows(r) {
+				log.Println("Write-ahead log ends in a bad record: ", err)
+				return records, good, true, nil
+			}
+			return nil, good, false, errors.Wrapf(err, "Write-ahead log record at offset %d is damaged", good)
+		}
+		records = append(records, rec)
+		good += int64(walHeaderSize) + int64(length)
+	}
+}
+
+// decodeRecord checks a record's payload against its checksum and decodes it
+func decodeRecord(payload []byte, sum uint32) (walRecord, error) {
+	var rec walRecord
+	if crc32.ChecksumIEEE(payload) != sum {
+		return rec, errors.New("Checksum failed")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		return rec, errors.Wrap(err, "Decode failed")
+	}
+	return rec, nil
+}
+
+// intactFollows returns true if an intact record can be read from the rest of the log
+func intactFollows(r *bufio.Reader) bool {
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return false
+		}
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(binary.BigEndian.Uint32(header[0:4]))); err != nil {
+			return false
+		}
+		if _, err := decodeRecord(buf.Bytes(), binary.BigEndian.Uint32(header[4:8])); err == nil {
+			return true
+		}
+	}
+}
+
+// Append writes a record to the end of the log and syncs it according to the policy
+func (w *writeAheadLog) Append(rec walRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return errors.Wrapf(err, "Encode failed for record: %#v", rec)
+	}
+	payload := buf.Bytes()
+
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, err := w.writer.Write(header); err != nil {
+		return errors.Wrap(err, "Writing write-ahead log header failed")
+	}
+	if _, err := w.writer.Write(payload); err != nil {
+		return errors.Wrap(err, "Writing write-ahead log record failed")
+	}
+
+	// Always hand the record to the OS so a crash of the process alone can't lose it
+	if err := w.writer.Flush(); err != nil {
+		return errors.Wrap(err, "Flushing write-ahead log failed")
+	}
+	w.dirty = true
+	w.size += int64(len(header) + len(payload))
+
+	if w.policy == walSyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+// sync flushes the file to stable storage, the caller must hold the mutex
+func (w *writeAheadLog) sync() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return errors.Wrap(err, "Syncing write-ahead log failed")
+	}
+	w.dirty = false
+	return nil
+}
+
+// Size returns the number of bytes written to the current segment
+func (w *writeAheadLog) Size() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.size
+}
+
+// Rotate syncs and closes the current segment and starts a new one. It returns the
+// sequence number of the segment that was closed, every record appended before
+// Rotate was called is in that segment or an earlier one.
+func (w *writeAheadLog) Rotate() (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.writer.Flush(); err != nil {
+		return 0, errors.Wrap(err, "Flushing write-ahead log failed")
+	}
+	w.dirty = true
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+
+	path := segmentPath(w.dir, w.seq+1)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, errors.Wrap(err, "Opening write-ahead log "+path+" failed")
+	}
+	if err = w.file.Close(); err != nil {
+		log.Println("Error closing write-ahead log segment: ", err)
+	}
+
+	closed := w.seq
+	w.seq++
+	w.file = f
+	w.writer = bufio.NewWriter(f)
+	w.size = 0
+	log.Println("Rotated write-ahead log to " + path)
+	return closed, nil
+}
+
+// removeSegments deletes every segment in dir numbered at or below seq
+func removeSegments(dir string, seq uint64) error {
+	seqs, err := listSequences(dir, walFile)
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s > seq {
+			break
+		}
+		if err = os.Remove(segmentPath(dir, s)); err != nil {
+			return errors.Wrap(err, "Removing write-ahead log segment failed")
+		}
+	}
+	return nil
+}
+
+// Sync forces any outstanding writes to stable storage
+func (w *writeAheadLog) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.sync()
+}
+
+// syncLoop fsyncs the log periodically until the log is closed
+func (w *writeAheadLog) syncLoop(period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := w.Sync(); err != nil {
+				log.Println("Error syncing write-ahead log: ", err)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the log file
+func (w *writeAheadLog) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	select {
+	case <-w.done:
+		// Already closed
+		return nil
+	default:
+		close(w.done)
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return errors.Wrap(err, "Flushing write-ahead log failed")
+	}
+	w.dirty = true
+	if err := w.sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
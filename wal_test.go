@@ -0,0 +1,218 @@
+// wal_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the write-ahead log
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWALAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, records, err := openWAL(dir, 0, walSyncAlways)
+	ok(t, err)
+	equals(t, 0, len(records))
+
+	e := NewEntry(time.Now().UTC(), map[string]int{keyExists: 1}, valExists, 1)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyExists, Entry: *e}))
+	ok(t, w.Append(walRecord{Op: walDelete, Key: keyone, Entry: Entry{Version: 2, Clock: map[string]int{keyone: 2}, Tombstone: true}}))
+	ok(t, w.Close())
+
+	w, records, err = openWAL(dir, 0, walSyncAlways)
+	ok(t, err)
+	defer w.Close()
+	equals(t, 2, len(records))
+	equals(t, walPut, records[0].Op)
+	equals(t, keyExists, records[0].Key)
+	equals(t, *e, records[0].Entry)
+	assert(t, records[1].Entry.Tombstone, "Tombstone was not replayed")
+}
+
+func TestWALTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	path := segmentPath(dir, 1)
+	w, _, err := openWAL(dir, 0, walSyncNone)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 1, Value: valone}}))
+	ok(t, w.Close())
+
+	info, err := os.Stat(path)
+	ok(t, err)
+	good := info.Size()
+
+	// Simulate a crash halfway through writing the second record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	ok(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 9, 9})
+	ok(t, err)
+	ok(t, f.Close())
+
+	w, records, err := openWAL(dir, 0, walSyncNone)
+	ok(t, err)
+	equals(t, 1, len(records))
+
+	info, err = os.Stat(path)
+	ok(t, err)
+	equals(t, good, info.Size())
+
+	// New records go after the truncation point and are readable
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyExists, Entry: Entry{Version: 1, Value: valtwo}}))
+	ok(t, w.Close())
+	w, records, err = openWAL(dir, 0, walSyncNone)
+	ok(t, err)
+	defer w.Close()
+	equals(t, 2, len(records))
+	equals(t, valtwo, records[1].Entry.Value)
+}
+
+func TestWALRefusesCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	path := segmentPath(dir, 1)
+	w, _, err := openWAL(dir, 0, walSyncInterval)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 1, Value: valone}}))
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 2, Value: valtwo}}))
+	ok(t, w.Close())
+
+	// Flip a byte in the first record's payload so its checksum fails
+	b, err := os.ReadFile(path)
+	ok(t, err)
+	b[walHeaderSize] ^= 0xff
+	ok(t, os.WriteFile(path, b, 0666))
+
+	_, _, err = openWAL(dir, 0, walSyncInterval)
+	assert(t, err != nil, "Opened a log with a corrupt record")
+
+	// Nothing after the bad record was thrown away
+	after, err := os.ReadFile(path)
+	ok(t, err)
+	equals(t, len(b), len(after))
+}
+
+func TestWALTruncatesBadLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	path := segmentPath(dir, 1)
+	w, _, err := openWAL(dir, 0, walSyncAlways)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 1, Value: valone}}))
+	info, err := os.Stat(path)
+	ok(t, err)
+	good := info.Size()
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 2, Value: valtwo}}))
+	ok(t, w.Close())
+
+	// The length of the last record made it to disk but its payload didn't
+	b, err := os.ReadFile(path)
+	ok(t, err)
+	for i := int(good) + walHeaderSize; i < len(b); i++ {
+		b[i] = 0
+	}
+	ok(t, os.WriteFile(path, b, 0666))
+
+	w, records, err := openWAL(dir, 0, walSyncAlways)
+	ok(t, err)
+	defer w.Close()
+	equals(t, 1, len(records))
+	info, err = os.Stat(path)
+	ok(t, err)
+	equals(t, good, info.Size())
+}
+
+func TestWALRefusesTornOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, _, err := openWAL(dir, 0, walSyncAlways)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 1, Value: valone}}))
+	_, err = w.Rotate()
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 2, Value: valtwo}}))
+	ok(t, w.Close())
+
+	// Only the newest segment can end in a torn record
+	f, err := os.OpenFile(segmentPath(dir, 1), os.O_APPEND|os.O_WRONLY, 0666)
+	ok(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 9, 9})
+	ok(t, err)
+	ok(t, f.Close())
+
+	_, _, err = openWAL(dir, 0, walSyncAlways)
+	assert(t, err != nil, "Opened a log with a gap in an older segment")
+}
+
+func TestWALRotateStartsNewSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, _, err := openWAL(dir, 0, walSyncAlways)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 1, Value: valone}}))
+	assert(t, w.Size() > 0, "Size didn't count the append")
+
+	closed, err := w.Rotate()
+	ok(t, err)
+	equals(t, uint64(1), closed)
+	equals(t, int64(0), w.Size())
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: Entry{Version: 2, Value: valtwo}}))
+	ok(t, w.Close())
+
+	seqs, err := listSequences(dir, walFile)
+	ok(t, err)
+	equals(t, []uint64{1, 2}, seqs)
+
+	// Skipping the first segment only replays the second
+	w, records, err := openWAL(dir, 1, walSyncAlways)
+	ok(t, err)
+	defer w.Close()
+	equals(t, 1, len(records))
+	equals(t, valtwo, records[0].Entry.Value)
+}
+
+func TestNewKVSReplaysLog(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	k.Put(keyone, valone, time.Now(), map[string]int{})
+	k.Put(keyExists, valExists, time.Now(), map[string]int{})
+	k.Put(keyExists, valtwo, time.Now(), map[string]int{})
+	k.Delete(keyone, time.Now(), map[string]int{})
+	k.OverwriteEntry(keyNotExists, NewEntry(time.Now(), map[string]int{keyNotExists: 4}, valNotExists, 4))
+	ok(t, k.Close())
+
+	r := NewKVS()
+	defer r.Close()
+
+	alive, version := r.Contains(keyone)
+	assert(t, !alive, "Deleted key came back alive")
+	equals(t, 2, version)
+
+	val, _ := r.Get(keyExists, map[string]int{})
+	equals(t, valtwo, val)
+	equals(t, k.GetDot(keyExists), r.GetDot(keyExists))
+
+	_, version = r.Contains(keyNotExists)
+	equals(t, 4, version)
+}
+
+func TestWritesFailWhenLogFails(t *testing.T) {
+	dataDir = t.TempDir()
+	walSync = walSyncAlways
+	defer func() { dataDir = "" }()
+
+	k := NewKVS()
+	ok(t, k.wal.file.Close())
+
+	_, err := k.Put(keyone, valone, time.Now(), map[string]int{})
+	equals(t, errNotDurable, err)
+	_, _, err = k.Batch([]batchOp{{Op: batchPut, Key: keyExists, Val: valone}}, time.Now(), map[string]int{})
+	equals(t, errNotDurable, err)
+}